@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// accessLoggedPaths are the endpoints whose requests are recorded in the access log
+var accessLoggedPaths = map[string]bool{
+	"/probe":   true,
+	"/metrics": true,
+}
+
+// statusRecorder is an http.ResponseWriter that records the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withAccessLog wraps a handler so that requests to /probe and /metrics are logged, if the access log is enabled.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled := cfg().Logging.AccessLog
+		if !enabled || !accessLoggedPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		user, _, _ := r.BasicAuth()
+		accessLog.Info("Request",
+			"client", client,
+			"user", user,
+			"path", r.URL.Path,
+			"target", r.URL.Query().Get("target"),
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
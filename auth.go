@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// secureCompare compares two strings in constant time.  Both are hashed first so that their lengths aren't revealed.
+func secureCompare(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// authorized returns true if the request carries valid credentials, or if no authentication has been configured.
+func authorized(r *http.Request) bool {
+	users := cfg().Exporter.BasicAuthUsers
+	token := cfg().Exporter.BearerToken
+	if len(users) == 0 && token == "" {
+		return true
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		expected, exists := users[username]
+		// Always perform the comparison so that unknown usernames take as long as known ones.
+		return secureCompare(password, expected) && exists
+	}
+	if token != "" {
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			return secureCompare(strings.TrimPrefix(header, "Bearer "), token)
+		}
+	}
+	return false
+}
+
+// clientAllowed returns true if the request comes from an address permitted by allowed_cidrs.  Requests on a Unix
+// domain socket have no client address and are always permitted.
+func clientAllowed(r *http.Request) bool {
+	if len(cfg().Exporter.AllowedCIDRs) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr == "" || r.RemoteAddr == "@"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range cfg().Exporter.AllowedCIDRs {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAllowedCIDRs wraps a handler so that requests from clients outside allowed_cidrs are rejected.
+func withAllowedCIDRs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(r) {
+			exporter.deniedRequests.Inc()
+			httpLog.Debug("Request denied by allowed_cidrs", "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withAuth wraps a handler so that requests must be authenticated if basic auth users or a bearer token have been
+// configured.
+func withAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="openotp_exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
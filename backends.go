@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// collectBackends checks the OTP delivery backends.  The SMTP server is checked directly by the exporter, if one is
+// configured.
+func (m *prometheusMetrics) collectBackends(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	if cfg().Backends.SMTP == "" {
+		return nil
+	}
+	err := checkSMTP(ctx, cfg().Backends.SMTP)
+	m.mailBackendUp.Set(boolToFloat(err == nil))
+	if err != nil {
+		return fmt.Errorf("mail backend %s: %v", cfg().Backends.SMTP, err)
+	}
+	return nil
+}
+
+// checkSMTP connects to the SMTP server at hostport and completes a greeting
+func checkSMTP(ctx context.Context, hostport string) error {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned when a probe is skipped because its target has failed too many consecutive probes
+var errCircuitOpen = errors.New("circuit open")
+
+// circuit tracks the consecutive failures of a single target
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	lastErr   error
+}
+
+// circuitBreaker skips probes of targets that are persistently failing so that a dead node doesn't hold every scrape
+// until its timeout.  Once the cooldown expires, a single probe is permitted to test whether the target has recovered.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+var breaker = &circuitBreaker{circuits: make(map[string]*circuit)}
+
+// allow returns an error wrapping errCircuitOpen if probes of target should be skipped
+func (b *circuitBreaker) allow(target string) error {
+	if cfg().Exporter.CircuitBreaker.Failures <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[target]
+	if !ok || c.failures < cfg().Exporter.CircuitBreaker.Failures {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(c.openUntil) {
+		return fmt.Errorf("%w until %s after %d consecutive failures: %v", errCircuitOpen,
+			c.openUntil.Format(time.RFC3339), c.failures, c.lastErr)
+	}
+	// Let this probe through to test the target, but keep the circuit open to concurrent probes until it completes.
+	c.openUntil = now.Add(cfg().Exporter.CircuitBreaker.Cooldown)
+	return nil
+}
+
+// record updates the circuit for target with the result of a probe.  A nil err closes the circuit.
+func (b *circuitBreaker) record(target string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.circuits, target)
+		if exporter != nil {
+			exporter.circuitOpen.WithLabelValues(target).Set(0)
+		}
+		return
+	}
+	c, ok := b.circuits[target]
+	if !ok {
+		c = new(circuit)
+		b.circuits[target] = c
+	}
+	c.failures++
+	c.lastErr = err
+	if threshold := cfg().Exporter.CircuitBreaker.Failures; threshold > 0 && c.failures >= threshold {
+		if c.failures == threshold {
+			rpcLog.Warn("Opening circuit", "target", target, "failures", c.failures, "cooldown", cfg().Exporter.CircuitBreaker.Cooldown)
+		}
+		c.openUntil = time.Now().Add(cfg().Exporter.CircuitBreaker.Cooldown)
+		if exporter != nil {
+			exporter.circuitOpen.WithLabelValues(target).Set(1)
+		}
+	}
+}
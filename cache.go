@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// cacheKey identifies a cached RPC response
+type cacheKey struct {
+	target string
+	method string
+}
+
+type cacheEntry struct {
+	response *jsonrpc.RPCResponse
+	expires  time.Time
+}
+
+// responseCache stores RPC responses for methods whose results change infrequently, such as license details.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+// rpcCache is shared by all probes
+var rpcCache = newResponseCache()
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[cacheKey]cacheEntry)}
+}
+
+// get returns the cached response for method on target, or nil if there isn't an unexpired one.
+func (c *responseCache) get(target, method string) *jsonrpc.RPCResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{target: target, method: method}
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.response
+}
+
+// put caches a response for the given duration.  Expired entries are purged at the same time so that probes of
+// targets that are no longer scraped don't accumulate.
+func (c *responseCache) put(target, method string, response *jsonrpc.RPCResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[cacheKey{target: target, method: method}] = cacheEntry{response: response, expires: now.Add(ttl)}
+}
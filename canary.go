@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// OpenOTP authentication response codes.  Any other code is a failure.
+const (
+	authSuccess   = 1
+	authChallenge = 2
+)
+
+// authResponse contains the fields of interest from an OpenOTP authentication response
+type authResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Session string `json:"session"`
+}
+
+// collectAuthCanary logs in to OpenOTP with the canary account to verify the authentication path end to end.  If
+// OpenOTP responds with a challenge, the canary's static OTP is submitted.
+func (m *prometheusMetrics) collectAuthCanary(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	start := time.Now()
+	err := authCanary(ctx, target)
+	m.canaryAuthDuration.Set(time.Since(start).Seconds())
+	m.canaryAuthSuccess.Set(boolToFloat(err == nil))
+	if err != nil {
+		return fmt.Errorf("canary login as %s: %v", cfg().Canary.Username, err)
+	}
+	return nil
+}
+
+// authCanary performs the canary login against the OpenOTP authentication API on the WebADM server hosting target.
+// The admin credentials aren't sent to the authentication API.
+func authCanary(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	u.Path = "/" + cfg().Canary.Path
+	u.RawQuery = ""
+	httpClient, err := rpcPool.getHTTP(target)
+	if err != nil {
+		return err
+	}
+	client := jsonrpc.NewClientWithOpts(u.String(), &jsonrpc.RPCClientOpts{HTTPClient: httpClient})
+	var resp authResponse
+	err = client.CallFor(ctx, &resp, "openotpSimpleLogin", map[string]string{
+		"username":    cfg().Canary.Username,
+		"domain":      cfg().Canary.Domain,
+		"anyPassword": cfg().Canary.Password,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Code == authChallenge {
+		if cfg().Canary.OTP == "" {
+			return fmt.Errorf("challenged for an OTP but none is configured")
+		}
+		err = client.CallFor(ctx, &resp, "openotpChallenge", map[string]string{
+			"username":    cfg().Canary.Username,
+			"domain":      cfg().Canary.Domain,
+			"session":     resp.Session,
+			"otpPassword": cfg().Canary.OTP,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Code != authSuccess {
+		return fmt.Errorf("authentication failed (code %d): %s", resp.Code, resp.Message)
+	}
+	return nil
+}
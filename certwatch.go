@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+)
+
+// certModTime returns the latest modification time of the files, or the zero time if any can't be read
+func certModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// certExpiry returns the expiry time of the leaf certificate of cert
+func certExpiry(cert tls.Certificate) (time.Time, bool) {
+	if len(cert.Certificate) == 0 {
+		return time.Time{}, false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return leaf.NotAfter, true
+}
+
+// watchCertificates reloads the listener and API client certificates when their files change, for example when
+// they're renewed by cert-manager, and records their expiry.  A replacement that fails to load is logged and the
+// current certificate remains in use.  The API client certificate is only parsed when its files, or the config
+// naming them, change, as decrypting its key is relatively expensive.
+func watchCertificates(m *exporterMetrics) {
+	var listenerMod, clientMod time.Time
+	// clientLoaded identifies the API client certificate files and passphrase last parsed
+	var clientLoaded string
+	for {
+		serverTLS := cfg().Exporter.TLS
+		certFile, keyFile, passphrase := cfg().API.ClientCert, cfg().API.ClientKey, cfg().API.ClientKeyPassphrase
+		interval := cfg().Exporter.CertReloadInterval
+
+		if serverTLS.Enabled() && listenerTLS.Load() != nil {
+			mod := certModTime(serverTLS.CertFile, serverTLS.KeyFile)
+			if !listenerMod.IsZero() && mod.After(listenerMod) {
+				if tlsConfig, err := serverTLSConfig(serverTLS); err != nil {
+					httpLog.Warn("Unable to reload listener certificate", "err", err)
+				} else {
+					listenerTLS.Store(tlsConfig)
+					httpLog.Info("Reloaded listener certificate", "cert_file", serverTLS.CertFile)
+				}
+			}
+			listenerMod = mod
+			if expiry, ok := certExpiry(listenerTLS.Load().Certificates[0]); ok {
+				m.certExpiry.WithLabelValues("listener").Set(float64(expiry.Unix()))
+			}
+		}
+
+		if certFile != "" {
+			mod := certModTime(certFile, keyFile)
+			if !clientMod.IsZero() && mod.After(clientMod) {
+				// Pooled clients hold the old certificate so they're replaced
+				rpcLog.Info("API client certificate has changed, replacing pooled clients", "cert_file", certFile)
+				rpcPool.flush()
+			}
+			loaded := fmt.Sprintf("%s\x00%s\x00%s\x00%d", certFile, keyFile, passphrase, mod.UnixNano())
+			if mod.IsZero() || loaded != clientLoaded {
+				if cert, err := loadClientCert(certFile, keyFile, passphrase); err != nil {
+					rpcLog.Warn("Unable to load API client certificate", "err", err)
+				} else if expiry, ok := certExpiry(cert); ok {
+					m.certExpiry.WithLabelValues("client").Set(float64(expiry.Unix()))
+				}
+				clientLoaded = loaded
+			}
+			clientMod = mod
+		}
+		time.Sleep(interval)
+	}
+}
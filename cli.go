@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+)
+
+// probeCommand performs a single probe of the target given on the command line and writes the resulting metrics to
+// stdout in the Prometheus text format, or pushes them to the Pushgateway if one is configured.  The returned exit
+// status reflects the success of the probe.
+func probeCommand() int {
+	if flags.Target == "" {
+		fmt.Fprintln(os.Stderr, "The probe command requires a --target")
+		return 2
+	}
+	module, ok := cfg().Modules[flags.Module]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown module: %s\n", flags.Module)
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().API.Timeout)
+	defer cancel()
+	reg := prometheus.NewRegistry()
+	m := initCollectors(reg)
+	success := m.probe(ctx, expandTarget(flags.Target), module, false)
+	if cfg().Pushgateway.URL != "" {
+		if err := pushMetrics(reg, flags.Target); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to push metrics: %v\n", redactString(err.Error()))
+			return 2
+		}
+	} else if err := writeMetrics(reg, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write metrics: %v\n", err)
+		return 2
+	}
+	if !success {
+		return 1
+	}
+	return 0
+}
+
+// pushMetrics replaces the metrics of target's group on the Pushgateway with those gathered from g
+func pushMetrics(g prometheus.Gatherer, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().API.Timeout)
+	defer cancel()
+	pusher := push.New(cfg().Pushgateway.URL, cfg().Pushgateway.Job).Gatherer(withMetricFilters(g)).Grouping("target", target)
+	for name, value := range cfg().Pushgateway.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if cfg().Pushgateway.Username != "" {
+		pusher = pusher.BasicAuth(cfg().Pushgateway.Username, cfg().Pushgateway.Password)
+	}
+	return pusher.PushContext(ctx)
+}
+
+// writeMetrics writes the metrics gathered from g, after applying the metric filters, to w in the Prometheus text
+// format
+func writeMetrics(g prometheus.Gatherer, w io.Writer) error {
+	mfs, err := withMetricFilters(g).Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initConfigCommand writes a starter config file to the --config path.  Values not given as flags are prompted for
+// when stdin is a terminal.  With --scrape-config, a matching Prometheus scrape config is printed to stdout.
+func initConfigCommand() int {
+	if _, err := os.Stat(flags.Config); err == nil && !flags.Force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use --force to overwrite it\n", flags.Config)
+		return 2
+	}
+	targetList, username, tlsCert, tlsKey := flags.Target, flags.Username, flags.TLSCert, flags.TLSKey
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		in := bufio.NewReader(os.Stdin)
+		prompt := func(question string, value *string) {
+			if *value != "" {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%s: ", question)
+			line, _ := in.ReadString('\n')
+			*value = strings.TrimSpace(line)
+		}
+		prompt("Targets, e.g. https://otp1.example.com:8443 (comma separated)", &targetList)
+		prompt("API username", &username)
+		prompt("Listener certificate file (blank for HTTP)", &tlsCert)
+		if tlsCert != "" {
+			prompt("Listener key file", &tlsKey)
+		}
+	}
+	var targets []string
+	for _, t := range strings.Split(targetList, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	c := config.Starter(targets, username, tlsCert, tlsKey)
+	if err := c.WriteConfig(flags.Config); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s.  Set OPENOTP_EXPORTER_API_PASSWORD, or edit the file, before starting the exporter.\n", flags.Config)
+	if flags.ScrapeConfig {
+		data, err := scrapeConfigYAML("openotp", exporterAddress(c), c.Exporter.TLS.Enabled(), c.Targets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to generate scrape config: %v\n", err)
+			return 1
+		}
+		os.Stdout.Write(data)
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// loadClientCert reads a PEM encoded certificate and key pair.  If a passphrase is provided, the key is assumed to be
+// encrypted.
+func loadClientCert(certFile, keyFile, passphrase string) (tls.Certificate, error) {
+	if passphrase == "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("no PEM data found in %s", keyFile)
+	}
+	// DecryptPEMBlock is deprecated but remains the only stdlib option for legacy encrypted PEM keys.
+	der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to decrypt %s: %v", keyFile, err)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// apiTLSConfig returns the tls.Config used when connecting to the OpenOTP API at target.  Any TLS settings of a
+// matching static target override those of the API.
+func apiTLSConfig(target string) (*tls.Config, error) {
+	tc := cfg().API.TLS.Merge(staticTarget(target).TLS)
+	tlsConfig := &tls.Config{
+		Renegotiation:      tc.Renegotiate(),
+		InsecureSkipVerify: cfg().API.InsecureSkipVerify,
+		ServerName:         tc.ServerName,
+		MinVersion:         uint16(tc.MinVersion),
+		CipherSuites:       tc.Ciphers(),
+	}
+	if cfg().API.CertFile != "" {
+		pemCerts, err := os.ReadFile(cfg().API.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read API CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in API CA file %s", cfg().API.CertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg().API.ClientCert != "" {
+		cert, err := loadClientCert(cfg().API.ClientCert, cfg().API.ClientKey, cfg().API.ClientKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load API client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// apiProxy returns the function selecting the proxy for API requests.  A configured proxy takes precedence over the
+// environment.  The username and password, if any, authenticate to a proxy whose URL doesn't include credentials.
+func apiProxy(proxyURL, username, password string) (func(*http.Request) (*url.URL, error), error) {
+	// The transport sends the credentials in the URL as Proxy-Authorization
+	withCredentials := func(u *url.URL) *url.URL {
+		if u == nil || u.User != nil || username == "" {
+			return u
+		}
+		// The environment's proxy URL is shared so it's copied rather than modified
+		withUser := *u
+		withUser.User = url.UserPassword(username, password)
+		return &withUser
+	}
+	if proxyURL == "" {
+		return func(req *http.Request) (*url.URL, error) {
+			u, err := http.ProxyFromEnvironment(req)
+			return withCredentials(u), err
+		}, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	return http.ProxyURL(withCredentials(u)), nil
+}
+
+// newRPC returns an RPC client for url, authenticating with the named credentials profile, reusing a pooled client
+// where possible.
+func newRPC(url, profile string) (jsonrpc.RPCClient, error) {
+	return rpcPool.get(url, profile)
+}
+
+// newAPITransport creates the transport for requests to the WebADM server hosting the API at targetURL.  The TLS,
+// proxy, tunnel and transport settings of a matching static target take precedence over those of the API.
+func newAPITransport(targetURL string) (*http.Transport, error) {
+	tlsConfig, err := apiTLSConfig(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	target := staticTarget(targetURL)
+	// The proxy or tunnel of a static target takes precedence over those of the API.  The API proxy credentials
+	// aren't sent to a target's proxy, whose URL carries its own.
+	proxyURL, sshTunnel := cfg().API.ProxyURL, cfg().API.SSHTunnel
+	proxyUsername, proxyPassword := cfg().API.ProxyUsername, cfg().API.ProxyPassword
+	if target.ProxyURL != "" || target.SSHTunnel != "" {
+		proxyURL, sshTunnel = target.ProxyURL, target.SSHTunnel
+		proxyUsername, proxyPassword = "", ""
+	}
+	proxy, err := apiProxy(proxyURL, proxyUsername, proxyPassword)
+	if err != nil {
+		return nil, err
+	}
+	transportCfg := cfg().API.Transport.Merge(target.Transport)
+	tr := &http.Transport{
+		Proxy:             proxy,
+		TLSClientConfig:   tlsConfig,
+		IdleConnTimeout:   cfg().API.IdleTimeout,
+		DisableKeepAlives: transportCfg.KeepAlivesDisabled(),
+		ForceAttemptHTTP2: !transportCfg.HTTP1Only(),
+	}
+	if transportCfg.HTTP1Only() {
+		// A non-nil empty map disables HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	tr.DialContext = countingDial(defaultDial)
+	if u, err := url.Parse(targetURL); err == nil && target.URL == "" {
+		// A /probe target allowed by its addresses is only connected to at those addresses
+		if nets, byName := allowedNets(u.Hostname()); !byName {
+			tr.DialContext = countingDial(allowedDial(u.Hostname(), nets))
+		}
+	}
+	if sshTunnel != "" {
+		tr.Proxy = nil
+		tr.DialContext = countingDial(sshDialer(sshTunnel))
+	}
+	return tr, nil
+}
+
+// newRPCClient creates an RPC client for url, along with its transport.
+func newRPCClient(url, profile string) (jsonrpc.RPCClient, *http.Transport, error) {
+	tr, err := newAPITransport(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := staticTarget(url)
+	headers := make(map[string]string)
+	for _, h := range []map[string]string{cfg().API.Headers, target.Headers} {
+		for k, v := range h {
+			headers[k] = v
+		}
+	}
+	if ua := target.UserAgent; ua != "" {
+		headers["User-Agent"] = ua
+	} else if cfg().API.UserAgent != "" {
+		headers["User-Agent"] = cfg().API.UserAgent
+	}
+	var transport http.RoundTripper = tracingTransport{metricsTransport{limitTransport{next: tr, max: cfg().API.MaxResponseSize}}}
+	auth := cfg().API.Auth
+	if target.Auth != nil {
+		auth = *target.Auth
+	}
+	switch auth.Type {
+	case "bearer":
+		headers["Authorization"] = "Bearer " + auth.Token
+	case "api_key":
+		headers[auth.Header] = auth.Token
+	case "digest":
+		transport = &digestTransport{next: transport, target: url, profile: profile}
+	case "kerberos":
+		transport = newNegotiateTransport(transport, auth, url)
+	default:
+		// Password authentication is optional when a client certificate is configured.
+		if username, password := apiCredentials(url, profile); username != "" {
+			auth := fmt.Sprintf("%s:%s", username, password)
+			headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+		}
+	}
+	httpClient := &http.Client{
+		Transport: transport,
+	}
+	if cfg().API.Protocol == "soap" {
+		return newSOAPClient(url, httpClient, headers), tr, nil
+	}
+	rpcClient := jsonrpc.NewClientWithOpts(url,
+		&jsonrpc.RPCClientOpts{
+			HTTPClient:    httpClient,
+			CustomHeaders: headers,
+		},
+	)
+	return rpcClient, tr, nil
+}
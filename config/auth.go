@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// Auth selects how the exporter authenticates to the API.  Type is "basic" (the default), which uses the API
+// username and password, "bearer", which sends Token as a bearer token, "api_key", which sends Token in Header, or
+// "digest", which uses the API username and password with HTTP digest authentication, or "kerberos", which
+// negotiates with a service ticket obtained using Keytab and is only available when built with -tags kerberos.
+type Auth struct {
+	Type   string `yaml:"type"`
+	Token  string `yaml:"token"`
+	Header string `yaml:"header"`
+	// Keytab and Principal are the keytab file and client principal used to obtain Kerberos tickets.  SPN is the
+	// service principal of the API, which defaults to HTTP/<target host>.  Principal's realm defaults to the
+	// default_realm of Krb5Config, the krb5.conf, which defaults to $KRB5_CONFIG or /etc/krb5.conf.
+	Keytab     string `yaml:"keytab"`
+	Principal  string `yaml:"principal"`
+	SPN        string `yaml:"spn"`
+	Krb5Config string `yaml:"krb5_config"`
+}
+
+// setDefaults populates any unset fields with default values and validates the result
+func (a *Auth) setDefaults() error {
+	switch a.Type {
+	case "":
+		a.Type = "basic"
+	case "basic", "digest":
+	case "bearer", "api_key":
+		if a.Token == "" {
+			return fmt.Errorf("auth type %s requires a token", a.Type)
+		}
+	case "kerberos":
+		if a.Keytab == "" || a.Principal == "" {
+			return fmt.Errorf("auth type %s requires a keytab and principal", a.Type)
+		}
+		if a.Krb5Config == "" {
+			a.Krb5Config = os.Getenv("KRB5_CONFIG")
+		}
+		if a.Krb5Config == "" {
+			a.Krb5Config = "/etc/krb5.conf"
+		}
+	default:
+		return fmt.Errorf("unknown auth type: %s", a.Type)
+	}
+	if a.Type == "api_key" && a.Header == "" {
+		a.Header = "X-API-Key"
+	}
+	return nil
+}
+
+// Credentials are a named API account, selected by the auth parameter of a probe or by the credentials of a target,
+// for deployments where targets require different admin accounts
+type Credentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
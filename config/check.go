@@ -0,0 +1,85 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CheckConfig performs a thorough validation of a config file.  In addition to the checks made by ParseConfig, it
+// rejects unknown keys, checks that required fields are present and verifies that all referenced files are
+// readable.  All the problems found are returned.
+func CheckConfig(filename string) []error {
+	var errs []error
+	if filename != "" {
+		node, err := loadConfigNode(filename, nil)
+		if err != nil {
+			return []error{err}
+		}
+		// Re-encode the merged config as the decoder is needed to reject unknown keys
+		data, err := yaml.Marshal(node)
+		if err != nil {
+			return []error{err}
+		}
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		if err := d.Decode(new(Config)); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return []error{err}
+			}
+			for _, e := range typeErr.Errors {
+				errs = append(errs, errors.New(e))
+			}
+		}
+	}
+
+	config, err := ParseConfig(filename)
+	if err != nil {
+		return append(errs, err)
+	}
+	if config.API.Username == "" && config.API.ClientCert == "" && !config.Secrets.Vault.Enabled() {
+		errs = append(errs, errors.New("api: no credentials defined.  Set username/password, client_cert/client_key or secrets.vault"))
+	}
+	if config.API.Username != "" && config.API.Password == "" && !config.Secrets.Keyring.Enabled {
+		errs = append(errs, errors.New("api: username is defined but password is empty"))
+	}
+	files := map[string]string{
+		"api certfile":                         config.API.CertFile,
+		"api client_cert":                      config.API.ClientCert,
+		"api client_key":                       config.API.ClientKey,
+		"exporter tls_server_config cert_file": config.Exporter.TLS.CertFile,
+		"exporter tls_server_config key_file":  config.Exporter.TLS.KeyFile,
+		"exporter tls_server_config client_ca": config.Exporter.TLS.ClientCAFile,
+		"secrets vault ca_file":                config.Secrets.Vault.CAFile,
+	}
+	for name, path := range files {
+		if path == "" {
+			continue
+		}
+		if err := checkReadable(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	return errs
+}
+
+// checkReadable returns an error if filename is not a readable, regular file
+func checkReadable(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", filename)
+	}
+	return nil
+}
@@ -2,48 +2,376 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Flags are command line arguments
 type Flags struct {
-	Config string
+	// Command is an optional subcommand, such as "check-config".  It precedes any flags.
+	Command string
+	Config  string
+	// Version requests the exporter's version instead of running it
+	Version bool
+	// Target and Module are used by the probe command
+	Target string
+	Module string
+	// Username, TLSCert and TLSKey are written to the config by the init-config command, along with Target.  Force
+	// allows an existing config to be replaced and ScrapeConfig prints a matching Prometheus scrape config.
+	Username     string
+	TLSCert      string
+	TLSKey       string
+	Force        bool
+	ScrapeConfig bool
+	// Job and ExporterAddress customise the output of the gen-scrape-config command
+	Job             string
+	ExporterAddress string
+}
+
+// Methods are the OpenOTP RPC methods that modules may request, each of whose response is processed on its own.
+// They're methods of the WebADM Manager API, which is described in the Manager API section of the RCDevs WebADM
+// Administrator Guide.
+var Methods = []string{
+	"Count_Activated_Users",
+	"Get_License_Details",
+	"Server_Status",
+}
+
+// PseudoMethods may be requested by modules alongside Methods but aren't called in the probe's batch.
+// Count_Domain_Users calls List_Domains and then Count_Domain_Users for each domain, and the checks test a service
+// directly.  As they have no single response, they can't be cached.
+var PseudoMethods = []string{
+	"Count_Domain_Users",
+	"Check_Backends",
+	"Check_CA",
+	"Check_Auth",
+	"Check_Radius",
+	"Check_LDAP",
+	"Check_SQL",
+}
+
+// DefaultMethods are the methods called by the default module, unless it is overridden in the config file
+var DefaultMethods = []string{
+	"Count_Activated_Users",
+	"Get_License_Details",
+	"Server_Status",
+}
+
+// DefaultModule is the name of the module used when a probe doesn't specify one
+const DefaultModule = "default"
+
+// Module defines the set of RPC methods called during a probe
+type Module struct {
+	Methods []string `yaml:"methods"`
+	// CustomMetrics are the names of the custom metrics collected by the module
+	CustomMetrics []string `yaml:"custom_metrics"`
+}
+
+// Target is an OpenOTP server that is polled whenever /metrics is scraped
+type Target struct {
+	URL    string `yaml:"url"`
+	Module string `yaml:"module"`
+	// Labels are added to the target's metrics when it's probed via /metrics, and attached to the target when it's
+	// published for service discovery, e.g. datacenter
+	Labels map[string]string `yaml:"labels"`
+	// ProxyURL and SSHTunnel override the API settings of the same names for this target
+	ProxyURL  string `yaml:"proxy_url"`
+	SSHTunnel string `yaml:"ssh_tunnel"`
+	// TLS overrides the API TLS settings for this target
+	TLS TLSClientConfig `yaml:"tls_config"`
+	// Headers are added to those of the API, replacing any of the same name.  UserAgent overrides that of the API.
+	Headers   map[string]string `yaml:"headers"`
+	UserAgent string            `yaml:"user_agent"`
+	// Auth overrides the API authentication for this target
+	Auth *Auth `yaml:"auth"`
+	// Credentials is the name of the credentials profile used instead of the API username and password
+	Credentials string `yaml:"credentials"`
+	// Cluster groups the nodes of a WebADM cluster, whose versions are expected to match
+	Cluster string `yaml:"cluster"`
+	// Transport overrides the API transport settings for this target
+	Transport Transport `yaml:"transport"`
+}
+
+// Logging configures where log messages are written and at what level
+type Logging struct {
+	// Filename is the file to log to.  If it's not defined, logs are written to stdout.
+	Filename string `yaml:"filename"`
+	// MaxSize (in megabytes) and MaxAge trigger rotation of the log file.  MaxBackups limits the number of rotated
+	// files retained and Compress gzips them.
+	MaxSize    int           `yaml:"max_size"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBackups int           `yaml:"max_backups"`
+	Compress   bool          `yaml:"compress"`
+	Journal    bool          `yaml:"journal"`
+	// EventLog logs to the Windows event log.  It requires the event source created by the install-service command.
+	EventLog bool   `yaml:"eventlog"`
+	LevelStr string `yaml:"level"`
+	// Format is "text" (the default) or "json"
+	Format string `yaml:"format"`
+	// Components overrides the level for individual components, e.g. rpc: debug
+	Components map[string]string `yaml:"components"`
+	// AccessLog logs each request to /probe and /metrics
+	AccessLog bool `yaml:"access_log"`
 }
 
 type Config struct {
 	API struct {
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
+		// CertFile is a PEM bundle of the CA certificates trusted to sign the API's server certificate
 		CertFile string `yaml:"certfile"`
 		Path     string `yaml:"path"`
+		// Protocol is "jsonrpc" or "soap".  SOAP is for deployments where the JSON-RPC interface is disabled.
+		Protocol string `yaml:"protocol"`
+		// Scheme and Port are used to construct the API URL when a target is given as a bare hostname
+		Scheme string `yaml:"scheme"`
+		Port   int    `yaml:"port"`
+		// InsecureSkipVerify disables verification of the API's server certificate.  For lab use only!
+		InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+		// TLS tunes the TLS connections to the API
+		TLS TLSClientConfig `yaml:"tls_config"`
+		// Headers are added to API requests, e.g. for a WAF in front of WebADM.  UserAgent replaces the Go default.
+		Headers   map[string]string `yaml:"headers"`
+		UserAgent string            `yaml:"user_agent"`
+		// Auth selects the authentication scheme
+		Auth Auth `yaml:"auth"`
+		// Transport tunes connection reuse and HTTP/2
+		Transport Transport `yaml:"transport"`
+		// Unbatched calls each method in its own request instead of a single batch.  This is slower but allows the
+		// duration of each call to be measured.
+		Unbatched bool `yaml:"unbatched"`
+		// Timeout is applied to probes when Prometheus doesn't advertise a scrape timeout
+		Timeout time.Duration `yaml:"timeout"`
+		// Retry configures retries of RPC batches that fail with a transient error
+		Retry Retry `yaml:"retry"`
+		// MaxResponseSize is the largest API response, in bytes, that will be read.  The default is 4 MiB.
+		MaxResponseSize int64 `yaml:"max_response_size"`
+		// IdleTimeout is how long an unused connection to a target is kept open for reuse
+		IdleTimeout time.Duration `yaml:"idle_timeout"`
+		// ClientCert and ClientKey authenticate the exporter to the API with an admin certificate
+		ClientCert          string `yaml:"client_cert"`
+		ClientKey           string `yaml:"client_key"`
+		ClientKeyPassphrase string `yaml:"client_key_passphrase"`
+		// ProxyURL is an HTTP or SOCKS5 proxy through which targets are reached.  If it's not defined, the
+		// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables are honoured.  ProxyUsername and ProxyPassword
+		// authenticate to this proxy, or to one from the environment, unless its URL includes credentials.  They
+		// aren't sent to a target's proxy_url, which may include its own.
+		ProxyURL      string `yaml:"proxy_url"`
+		ProxyUsername string `yaml:"proxy_username"`
+		ProxyPassword string `yaml:"proxy_password"`
+		// SSHTunnel is an SSH jump host, e.g. user@bastion, through which targets are reached.  Connections are
+		// forwarded by the ssh command so its client config and keys apply.
+		SSHTunnel string `yaml:"ssh_tunnel"`
 	} `yaml:"api"`
-	Logging struct {
-		Filename string `yaml:"filename"`
-		Journal  bool   `yaml:"journal"`
-		LevelStr string `yaml:"level"`
-	} `yaml:"logging"`
+	Logging  Logging `yaml:"logging"`
 	Exporter struct {
 		Hostname string `yaml:"hostname"`
 		Port     int    `yaml:"port"`
+		// Listen overrides Hostname and Port.  A unix:// URL, e.g. unix:///run/openotp_exporter.sock, listens on a
+		// Unix domain socket instead of a TCP port.
+		Listen string `yaml:"listen"`
+		// SocketMode is the octal permissions of a Unix domain socket.  The default is 0660.
+		SocketMode  string      `yaml:"socket_mode"`
+		SocketPerm  os.FileMode `yaml:"-"`
+		SocketOwner string      `yaml:"socket_owner"`
+		SocketGroup string      `yaml:"socket_group"`
+		// DedupWindow is how long the responses of a probe are shared with identical probes that follow it, e.g.
+		// from an HA pair of Prometheus servers.  Concurrent identical probes always share responses.
+		DedupWindow time.Duration `yaml:"dedup_window"`
+		// TimeoutOffset is subtracted from the Prometheus scrape timeout to give the probe timeout
+		TimeoutOffset time.Duration `yaml:"timeout_offset"`
+		// DrainTimeout is how long in-flight requests are given to complete during shutdown
+		DrainTimeout time.Duration `yaml:"drain_timeout"`
+		// TelemetryAddress is an optional host:port on which the exporter's own metrics are served, separately
+		// from the probe endpoints
+		TelemetryAddress string `yaml:"telemetry_address"`
+		// Pprof mounts the net/http/pprof profiling handlers under /debug/pprof/ on the telemetry listener, or on
+		// the main listener if there isn't one
+		Pprof bool `yaml:"pprof"`
+		// AllowedTargets restricts the hosts that /probe may query.  Entries are hostnames, wildcard domains
+		// (*.example.com) or CIDRs.  If empty, any host is permitted.
+		AllowedTargets []string `yaml:"allowed_targets"`
+		// AllowedCIDRs restricts the client addresses that may access the exporter's endpoints.  Entries are CIDRs or
+		// IP addresses.  If empty, any client is permitted.
+		AllowedCIDRs []string `yaml:"allowed_cidrs"`
+		// RateLimit limits the rate of requests to /probe
+		RateLimit RateLimit `yaml:"rate_limit"`
+		// MetricFilters drop series, or rewrite their labels, before they're exposed, e.g. to remove customer IDs
+		MetricFilters []MetricFilter `yaml:"metric_filters"`
+		// AllowedSchemes restricts the URL schemes that /probe may query
+		AllowedSchemes []string `yaml:"allowed_schemes"`
+		// BasicAuthUsers maps usernames to passwords that may access the exporter's endpoints
+		BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+		// BearerToken is a static token that may be used to access the exporter's endpoints
+		BearerToken string `yaml:"bearer_token"`
+		// Namespace overrides the "openotp" prefix of the exported metric names
+		Namespace string `yaml:"namespace"`
+		// Labels are constant labels added to every exported metric, e.g. environment or site
+		Labels map[string]string `yaml:"labels"`
+		// OmitLicenseLabels removes the customer and license ID labels from the numeric license metrics.  The IDs remain
+		// available on the license info metric.
+		OmitLicenseLabels bool `yaml:"omit_license_labels"`
+		// UnlimitedUsers is exported as the maximum users of products whose license has no user cap.  The default is
+		// -1; .inf is also accepted.
+		UnlimitedUsers *float64 `yaml:"unlimited_users"`
+		// GoCollector and ProcessCollector control whether the Go runtime and process metrics of the exporter
+		// itself are served on /metrics.  Both default to true.
+		GoCollector      *bool `yaml:"go_collector"`
+		ProcessCollector *bool `yaml:"process_collector"`
+		// LicenseTimezone is the zone of license dates that don't include one, e.g. Europe/Luxembourg.  The default
+		// is UTC.
+		LicenseTimezone string         `yaml:"license_timezone"`
+		LicenseLocation *time.Location `yaml:"-"`
+		// MaxConcurrentProbes limits the number of probes calling the API at once.  Probes wait for a free slot until
+		// their deadline.  Zero means unlimited.
+		MaxConcurrentProbes int `yaml:"max_concurrent_probes"`
+		// ProbeHistory is the number of recent probes of each target shown on /probes.  A negative value disables the
+		// history.
+		ProbeHistory int `yaml:"probe_history"`
+		// CircuitBreaker skips probes of targets that have failed too many consecutive probes
+		CircuitBreaker struct {
+			// Failures is the number of consecutive failures that open the circuit.  Zero disables the breaker.
+			Failures int `yaml:"failures"`
+			// Cooldown is how long probes are skipped before the target is tried again
+			Cooldown time.Duration `yaml:"cooldown"`
+		} `yaml:"circuit_breaker"`
+		// Mode is "scrape", where /metrics probes the targets on each scrape, or "poll", where each target is probed
+		// in the background every PollInterval and /metrics serves the most recent results.
+		Mode         string        `yaml:"mode"`
+		PollInterval time.Duration `yaml:"poll_interval"`
+		// OpenMetrics enables the OpenMetrics exposition format for scrapers that request it
+		OpenMetrics bool `yaml:"openmetrics"`
+		// ProbeTimestamps attaches the time of the poll that produced them to the metrics served in poll mode
+		ProbeTimestamps bool `yaml:"probe_timestamps"`
+		// StaleAfter is how long a polled target's last good metrics continue to be served while its polls are
+		// failing.  Zero drops them at the first failure.
+		StaleAfter time.Duration `yaml:"stale_after"`
+		// TLS enables HTTPS on the exporter's listener
+		TLS TLSServerConfig `yaml:"tls_server_config"`
+		// CertReloadInterval is how often the listener and API client certificate files are checked for changes
+		CertReloadInterval time.Duration `yaml:"cert_reload_interval"`
+		// HTTPServer limits the resources a client of the exporter's listeners may consume.  Zero timeouts are
+		// unlimited.  WriteTimeout must allow for the probe timeout.
+		HTTPServer struct {
+			ReadTimeout       time.Duration `yaml:"read_timeout"`
+			ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+			WriteTimeout      time.Duration `yaml:"write_timeout"`
+			IdleTimeout       time.Duration `yaml:"idle_timeout"`
+			MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+		} `yaml:"http_server"`
 	} `yaml:"exporter"`
+	Cache struct {
+		// TTL defines how long the response from each RPC method is cached.  Methods without a TTL aren't cached.
+		TTL map[string]time.Duration `yaml:"ttl"`
+	} `yaml:"cache"`
+	Backends struct {
+		// SMTP is the host:port of the mail server WebADM uses to deliver OTPs
+		SMTP string `yaml:"smtp"`
+	} `yaml:"backends"`
+	// Credentials are profiles of API credentials, selected by the auth parameter of a probe
+	Credentials map[string]Credentials `yaml:"credentials"`
+	Secrets     struct {
+		Vault Vault `yaml:"vault"`
+		// Keyring takes precedence over the password in the api block, but not over Vault
+		Keyring Keyring `yaml:"keyring"`
+	} `yaml:"secrets"`
+	// Canary is a dedicated test account that the Check_Auth method logs in with.  It should have a policy of LDAP
+	// password only, or a static OTP.
+	Canary struct {
+		// Path is the location of the OpenOTP authentication API on the WebADM server
+		Path     string `yaml:"path"`
+		Username string `yaml:"username"`
+		Domain   string `yaml:"domain"`
+		Password string `yaml:"password"`
+		// OTP is submitted if OpenOTP challenges the login
+		OTP string `yaml:"otp"`
+	} `yaml:"canary"`
+	// Radius is the Radius Bridge that the Check_Radius method authenticates the canary account through
+	Radius struct {
+		// Address is the host:port of the Radius Bridge.  It defaults to the target's host on port 1812.
+		Address       string `yaml:"address"`
+		Secret        string `yaml:"secret"`
+		NASIdentifier string `yaml:"nas_identifier"`
+	} `yaml:"radius"`
+	// LDAP is the directory that the Check_LDAP method binds to and searches, independently of WebADM.  If it's
+	// configured, the Check_CA method also counts the certificates issued to its users.
+	LDAP struct {
+		// URL is an ldap:// or ldaps:// URL
+		URL          string `yaml:"url"`
+		BindDN       string `yaml:"bind_dn"`
+		BindPassword string `yaml:"bind_password"`
+		BaseDN       string `yaml:"base_dn"`
+		// Filter must match at least one entry.  Only equality and presence filters are supported, e.g. (uid=canary).
+		Filter             string `yaml:"filter"`
+		CAFile             string `yaml:"ca_file"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	} `yaml:"ldap"`
+	// SQL is the database server whose reachability the Check_SQL method checks, independently of WebADM.  The
+	// check ends at the server's handshake and never authenticates.
+	SQL struct {
+		// DSN is a mysql:// or postgres:// URL.  Only the host, port, user and database are used.
+		DSN string `yaml:"dsn"`
+	} `yaml:"sql"`
+	// Pushgateway receives the metrics of the probe command, instead of them being written to stdout
+	Pushgateway struct {
+		URL string `yaml:"url"`
+		Job string `yaml:"job"`
+		// Grouping labels are added to the target label to identify the group of metrics that each push replaces
+		Grouping map[string]string `yaml:"grouping"`
+		Username string            `yaml:"username"`
+		Password string            `yaml:"password"`
+	} `yaml:"pushgateway"`
+	OTLP OTLP `yaml:"otlp"`
+	// Textfile writes the results of probing the static targets to a file for node_exporter's textfile collector,
+	// instead of listening for scrapes.
+	Textfile struct {
+		Filename string        `yaml:"filename"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"textfile"`
+	// CustomMetrics define additional metrics populated from RPC responses
+	CustomMetrics []CustomMetric    `yaml:"custom_metrics"`
+	Modules       map[string]Module `yaml:"modules"`
+	Targets       []Target          `yaml:"targets"`
+	Discovery     struct {
+		Kubernetes Kubernetes `yaml:"kubernetes"`
+	} `yaml:"discovery"`
+	// TargetsFile is a YAML or JSON list of additional targets.  It's watched for changes and re-read when modified.
+	TargetsFile string `yaml:"targets_file"`
 }
 
-// ParseConfig imports a yaml formatted config file into a Config struct
-func ParseConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+// metricNameRE matches valid Prometheus label names and metric name prefixes
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 
+// ParseConfig imports a yaml formatted config file, and any files it includes, into a Config struct.  If filename is
+// empty, the config is taken entirely from flags and environment variables.
+func ParseConfig(filename string) (*Config, error) {
 	config := &Config{}
-	d := yaml.NewDecoder(file)
-	if err := d.Decode(&config); err != nil {
+	if filename != "" {
+		node, err := loadConfigNode(filename, nil)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			if err := node.Decode(config); err != nil {
+				return nil, err
+			}
+		}
+		if err := expandEnv(reflect.ValueOf(config)); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyOverrides(config); err != nil {
 		return nil, err
 	}
 
@@ -51,28 +379,410 @@ func ParseConfig(filename string) (*Config, error) {
 	if config.API.Path == "" {
 		config.API.Path = "manag/"
 	}
+	switch config.API.Protocol {
+	case "":
+		config.API.Protocol = "jsonrpc"
+	case "jsonrpc", "soap":
+	default:
+		return nil, fmt.Errorf("invalid api protocol: %s", config.API.Protocol)
+	}
+	if config.Canary.Path == "" {
+		config.Canary.Path = "openotp/"
+	}
+	config.Canary.Path = strings.TrimPrefix(config.Canary.Path, "/")
+	if config.LDAP.Filter == "" {
+		config.LDAP.Filter = "(objectClass=*)"
+	}
+	config.LDAP.CAFile = expandTilde(config.LDAP.CAFile)
+	if config.Radius.NASIdentifier == "" {
+		config.Radius.NASIdentifier = "openotp_exporter"
+	}
+	if config.API.Scheme == "" {
+		config.API.Scheme = "https"
+	}
+	if config.API.Port == 0 {
+		// The default port of the WebADM admin interface
+		config.API.Port = 8443
+	}
+	if config.API.MaxResponseSize == 0 {
+		config.API.MaxResponseSize = 4 << 20
+	}
+	if config.API.IdleTimeout == 0 {
+		config.API.IdleTimeout = 90 * time.Second
+	}
+	if config.API.Timeout == 0 {
+		config.API.Timeout = 10 * time.Second
+	}
+	if config.Exporter.DrainTimeout == 0 {
+		config.Exporter.DrainTimeout = 10 * time.Second
+	}
+	if config.Exporter.TimeoutOffset == 0 {
+		config.Exporter.TimeoutOffset = 500 * time.Millisecond
+	}
+	if config.Exporter.Namespace != "" && !metricNameRE.MatchString(config.Exporter.Namespace) {
+		return nil, fmt.Errorf("invalid exporter namespace: %s", config.Exporter.Namespace)
+	}
+	for name := range config.Exporter.Labels {
+		if !metricNameRE.MatchString(name) || strings.HasPrefix(name, "__") || name == "target" {
+			return nil, fmt.Errorf("invalid exporter label name: %s", name)
+		}
+	}
+	if config.Exporter.CertReloadInterval == 0 {
+		config.Exporter.CertReloadInterval = time.Minute
+	}
+	if config.Exporter.CertReloadInterval < 0 {
+		return nil, fmt.Errorf("cert_reload_interval must be positive")
+	}
+	if config.Exporter.HTTPServer.ReadHeaderTimeout == 0 {
+		config.Exporter.HTTPServer.ReadHeaderTimeout = 10 * time.Second
+	}
+	if config.Exporter.CircuitBreaker.Cooldown == 0 {
+		config.Exporter.CircuitBreaker.Cooldown = time.Minute
+	}
+	switch config.Exporter.Mode {
+	case "":
+		config.Exporter.Mode = "scrape"
+	case "scrape", "poll":
+	default:
+		return nil, fmt.Errorf("invalid exporter mode: %s", config.Exporter.Mode)
+	}
+	if config.Exporter.PollInterval == 0 {
+		config.Exporter.PollInterval = time.Minute
+	}
+	if config.Exporter.SocketMode == "" {
+		config.Exporter.SocketMode = "0660"
+	}
+	perm, err := strconv.ParseUint(config.Exporter.SocketMode, 8, 32)
+	if err != nil || perm > 0777 {
+		return nil, fmt.Errorf("invalid exporter socket_mode: %s", config.Exporter.SocketMode)
+	}
+	config.Exporter.SocketPerm = os.FileMode(perm)
+	if strings.Contains(config.Exporter.Listen, "://") && !strings.HasPrefix(config.Exporter.Listen, "unix://") {
+		return nil, fmt.Errorf("invalid exporter listen address: %s", config.Exporter.Listen)
+	}
+	if config.Exporter.LicenseTimezone == "" {
+		config.Exporter.LicenseTimezone = "UTC"
+	}
+	if config.Exporter.LicenseLocation, err = time.LoadLocation(config.Exporter.LicenseTimezone); err != nil {
+		return nil, fmt.Errorf("invalid exporter license_timezone: %v", err)
+	}
+	if config.Exporter.UnlimitedUsers == nil {
+		unlimited := -1.0
+		config.Exporter.UnlimitedUsers = &unlimited
+	}
+	enabled := true
+	if config.Exporter.GoCollector == nil {
+		config.Exporter.GoCollector = &enabled
+	}
+	if config.Exporter.ProcessCollector == nil {
+		config.Exporter.ProcessCollector = &enabled
+	}
+	if config.Exporter.ProbeHistory == 0 {
+		config.Exporter.ProbeHistory = 10
+	}
+	if len(config.Exporter.AllowedSchemes) == 0 {
+		config.Exporter.AllowedSchemes = []string{"https", "http"}
+	}
+	for _, entry := range config.Exporter.AllowedTargets {
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return nil, fmt.Errorf("invalid allowed_targets entry: %v", err)
+			}
+		}
+	}
+	for _, entry := range config.Exporter.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return nil, fmt.Errorf("invalid allowed_cidrs entry: %s", entry)
+		}
+	}
 	if config.Logging.LevelStr == "" {
 		config.Logging.LevelStr = "info"
 	}
+	switch config.Logging.Format {
+	case "":
+		config.Logging.Format = "text"
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid logging format: %s", config.Logging.Format)
+	}
 	if config.Exporter.Port == 0 {
 		// This is the default port assigned in the prometheus Wiki
 		config.Exporter.Port = 9794
 	}
+	config.API.CertFile = expandTilde(config.API.CertFile)
+	config.API.ClientCert = expandTilde(config.API.ClientCert)
+	config.API.ClientKey = expandTilde(config.API.ClientKey)
+	if (config.API.ClientCert == "") != (config.API.ClientKey == "") {
+		return nil, fmt.Errorf("api client_cert and client_key must be defined together")
+	}
+	if err := validateProxy(config.API.ProxyURL, config.API.SSHTunnel); err != nil {
+		return nil, fmt.Errorf("api: %v", err)
+	}
+	if err := config.API.TLS.validate(); err != nil {
+		return nil, fmt.Errorf("api tls_config: %v", err)
+	}
+	if err := config.API.Auth.setDefaults(); err != nil {
+		return nil, fmt.Errorf("api: %v", err)
+	}
+	if err := config.API.Retry.setDefaults(); err != nil {
+		return nil, fmt.Errorf("api retry: %v", err)
+	}
+	if err := config.Exporter.RateLimit.setDefaults(); err != nil {
+		return nil, fmt.Errorf("exporter rate_limit: %v", err)
+	}
+	for i := range config.Exporter.MetricFilters {
+		if err := config.Exporter.MetricFilters[i].setDefaults(); err != nil {
+			return nil, fmt.Errorf("exporter metric_filters[%d]: %v", i, err)
+		}
+	}
+	if err := config.Secrets.Vault.setDefaults(); err != nil {
+		return nil, fmt.Errorf("secrets vault: %v", err)
+	}
+	config.Secrets.Keyring.setDefaults()
+	for name, c := range config.Credentials {
+		if c.Username == "" {
+			return nil, fmt.Errorf("credentials %s: username must be defined", name)
+		}
+	}
+	if err := config.Exporter.TLS.validate(); err != nil {
+		return nil, fmt.Errorf("exporter tls_server_config: %v", err)
+	}
+	customNames := make(map[string]bool)
+	for i := range config.CustomMetrics {
+		c := &config.CustomMetrics[i]
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("custom metric %s: %v", c.Name, err)
+		}
+		if customNames[c.Name] {
+			return nil, fmt.Errorf("custom metric %s is defined more than once", c.Name)
+		}
+		customNames[c.Name] = true
+	}
+	if config.Modules == nil {
+		config.Modules = make(map[string]Module)
+	}
+	if _, ok := config.Modules[DefaultModule]; !ok {
+		// The default module collects all the custom metrics
+		module := Module{Methods: append([]string(nil), DefaultMethods...)}
+		for _, c := range config.CustomMetrics {
+			module.CustomMetrics = append(module.CustomMetrics, c.Name)
+		}
+		config.Modules[DefaultModule] = module
+	}
+	for name, module := range config.Modules {
+		if len(module.Methods) == 0 && len(module.CustomMetrics) == 0 {
+			return nil, fmt.Errorf("module %s has no methods defined", name)
+		}
+		for _, c := range module.CustomMetrics {
+			if !customNames[c] {
+				return nil, fmt.Errorf("module %s: unknown custom metric %s", name, c)
+			}
+		}
+		for i, m := range module.Methods {
+			method, ok := canonicalMethod(m)
+			if !ok {
+				return nil, fmt.Errorf("module %s: unknown method %s", name, m)
+			}
+			if (method == "Check_Auth" || method == "Check_Radius") && config.Canary.Username == "" {
+				return nil, fmt.Errorf("module %s: %s requires a canary username", name, method)
+			}
+			if method == "Check_Radius" && config.Radius.Secret == "" {
+				return nil, fmt.Errorf("module %s: Check_Radius requires a radius secret", name)
+			}
+			if method == "Check_LDAP" && !strings.HasPrefix(config.LDAP.URL, "ldap://") &&
+				!strings.HasPrefix(config.LDAP.URL, "ldaps://") {
+				return nil, fmt.Errorf("module %s: Check_LDAP requires an ldap:// or ldaps:// url", name)
+			}
+			if method == "Check_SQL" && !strings.HasPrefix(config.SQL.DSN, "mysql://") &&
+				!strings.HasPrefix(config.SQL.DSN, "postgres://") && !strings.HasPrefix(config.SQL.DSN, "postgresql://") {
+				return nil, fmt.Errorf("module %s: Check_SQL requires a mysql:// or postgres:// dsn", name)
+			}
+			module.Methods[i] = method
+		}
+	}
+	if config.TargetsFile != "" {
+		config.TargetsFile = expandTilde(config.TargetsFile)
+		targets, err := readTargetsFile(config.TargetsFile)
+		if err != nil {
+			return nil, fmt.Errorf("targets_file: %v", err)
+		}
+		config.Targets = append(config.Targets, targets...)
+	}
+	if err := config.Discovery.Kubernetes.setDefaults(); err != nil {
+		return nil, fmt.Errorf("discovery kubernetes: %v", err)
+	}
+	if err := config.OTLP.setDefaults(); err != nil {
+		return nil, fmt.Errorf("otlp: %v", err)
+	}
+	if config.Pushgateway.Job == "" {
+		config.Pushgateway.Job = "openotp"
+	}
+	for name := range config.Pushgateway.Grouping {
+		if !metricNameRE.MatchString(name) || name == "target" || name == "job" {
+			return nil, fmt.Errorf("invalid pushgateway grouping label: %s", name)
+		}
+	}
+	if config.Textfile.Filename != "" {
+		if len(config.Targets) == 0 && !config.Discovery.Kubernetes.Enabled() {
+			return nil, fmt.Errorf("textfile output requires targets to be defined")
+		}
+		if config.Textfile.Interval == 0 {
+			config.Textfile.Interval = time.Minute
+		}
+		config.Textfile.Filename = expandTilde(config.Textfile.Filename)
+	}
+	ttls := make(map[string]time.Duration)
+	for m, ttl := range config.Cache.TTL {
+		method, ok := canonicalMethod(m)
+		if !ok {
+			return nil, fmt.Errorf("cache ttl: unknown method %s", m)
+		}
+		if isPseudoMethod(method) {
+			return nil, fmt.Errorf("cache ttl: %s has no single response and can't be cached", method)
+		}
+		ttls[method] = ttl
+	}
+	config.Cache.TTL = ttls
+	if k := config.Discovery.Kubernetes; k.Enabled() {
+		if _, ok := config.Modules[k.Module]; !ok {
+			return nil, fmt.Errorf("discovery kubernetes: unknown module %s", k.Module)
+		}
+	}
+	urls := make(map[string]bool)
+	for i, t := range config.Targets {
+		// Each target's metrics are registered once, so a URL can't be listed twice, even with different modules
+		if urls[t.URL] {
+			return nil, fmt.Errorf("target %s: duplicate url", t.URL)
+		}
+		urls[t.URL] = true
+		if t.Module == "" {
+			config.Targets[i].Module = DefaultModule
+		}
+		if _, ok := config.Modules[config.Targets[i].Module]; !ok {
+			return nil, fmt.Errorf("target %s: unknown module %s", t.URL, t.Module)
+		}
+		if err := validateProxy(t.ProxyURL, t.SSHTunnel); err != nil {
+			return nil, fmt.Errorf("target %s: %v", t.URL, err)
+		}
+		if err := config.Targets[i].TLS.validate(); err != nil {
+			return nil, fmt.Errorf("target %s tls_config: %v", t.URL, err)
+		}
+		for name := range t.Labels {
+			if !metricNameRE.MatchString(name) || strings.HasPrefix(name, "__") || name == "target" {
+				return nil, fmt.Errorf("target %s: invalid label name: %s", t.URL, name)
+			}
+		}
+		if _, ok := config.Credentials[t.Credentials]; t.Credentials != "" && !ok {
+			return nil, fmt.Errorf("target %s: unknown credentials profile %s", t.URL, t.Credentials)
+		}
+		if a := config.Targets[i].Auth; a != nil {
+			if err := a.setDefaults(); err != nil {
+				return nil, fmt.Errorf("target %s: %v", t.URL, err)
+			}
+		}
+	}
 	return config, nil
 }
 
+// validateProxy checks a proxy URL and SSH tunnel, which are mutually exclusive
+func validateProxy(proxyURL, sshTunnel string) error {
+	if proxyURL != "" && sshTunnel != "" {
+		return fmt.Errorf("proxy_url and ssh_tunnel cannot both be defined")
+	}
+	if proxyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy_url: %s", proxyURL)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("proxy_url scheme must be http, https or socks5: %s", u.Scheme)
+}
+
+// readTargetsFile returns the targets listed in a YAML or JSON formatted file
+func readTargetsFile(filename string) ([]Target, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	if err := yaml.Unmarshal(data, &targets); err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.URL == "" {
+			return nil, fmt.Errorf("%s: target with no url", filename)
+		}
+	}
+	return targets, nil
+}
+
+// isPseudoMethod returns true if method is one of the PseudoMethods
+func isPseudoMethod(method string) bool {
+	for _, m := range PseudoMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalMethod returns the canonical form of an RPC method name.  OpenOTP method names are case-insensitive.
+func canonicalMethod(name string) (string, bool) {
+	for _, m := range append(Methods[:len(Methods):len(Methods)], PseudoMethods...) {
+		if strings.EqualFold(m, name) {
+			return m, true
+		}
+	}
+	return "", false
+}
+
 // parseFlags processes arguments passed on the command line in the format
 // standard format: --foo=bar
 func ParseFlags() *Flags {
 	f := new(Flags)
 	flag.StringVar(&f.Config, "config", "config.yml", "Path to configuration file")
-	flag.Parse()
+	flag.BoolVar(&f.Version, "version", false, "Print the version and exit")
+	flag.StringVar(&f.Target, "target", "", "Target to probe (probe command only)")
+	flag.StringVar(&f.Module, "module", DefaultModule, "Module to probe the target with (probe command only)")
+	flag.StringVar(&f.Username, "username", "", "API username (init-config command only)")
+	flag.StringVar(&f.TLSCert, "tls-cert", "", "Listener certificate file (init-config command only)")
+	flag.StringVar(&f.TLSKey, "tls-key", "", "Listener key file (init-config command only)")
+	flag.BoolVar(&f.Force, "force", false, "Overwrite an existing config file (init-config command only)")
+	flag.BoolVar(&f.ScrapeConfig, "scrape-config", false, "Also print a Prometheus scrape config (init-config command only)")
+	flag.StringVar(&f.Job, "job", "openotp", "Prometheus job name (gen-scrape-config command only)")
+	flag.StringVar(&f.ExporterAddress, "exporter-address", "", "Address at which Prometheus reaches the exporter (gen-scrape-config command only)")
+	registerOverrides(flag.CommandLine)
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		f.Command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	configSet := false
+	flag.Visit(func(fl *flag.Flag) {
+		configSet = configSet || fl.Name == "config"
+	})
+	// Containers may be configured entirely by environment variables, in which case the default config file needn't
+	// exist.
+	if _, err := os.Stat(f.Config); os.IsNotExist(err) && !configSet && f.Command != "init-config" && envConfigured() {
+		f.Config = ""
+	}
 	return f
 }
 
-// WriteConfig will create a YAML formatted config file from a Config struct
+// WriteConfig will create a YAML formatted config file from a Config struct.  Options that haven't been set are
+// omitted and the common ones are commented.
 func (c *Config) WriteConfig(filename string) error {
-	data, err := yaml.Marshal(c)
+	node, err := configNode(reflect.ValueOf(c))
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(node)
 	if err != nil {
 		return err
 	}
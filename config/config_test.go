@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -34,3 +35,329 @@ func getTestFile(filename string) (testFile *os.File) {
 	}
 	return
 }
+
+func TestModules(t *testing.T) {
+	testFile := getTestFile("testcfg")
+	defer os.Remove(testFile.Name())
+	writeCfg := new(Config)
+	writeCfg.Modules = map[string]Module{
+		"status": {Methods: []string{"server_status"}},
+	}
+	writeCfg.Targets = []Target{{URL: "https://otp.example.com"}}
+	writeCfg.WriteConfig(testFile.Name())
+
+	readCfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if len(readCfg.Modules[DefaultModule].Methods) != len(DefaultMethods) {
+		t.Errorf("Default module not populated. Got=%v", readCfg.Modules[DefaultModule])
+	}
+	if readCfg.Modules["status"].Methods[0] != "Server_Status" {
+		t.Errorf("Unexpected method. Expected=Server_Status, Got=%s", readCfg.Modules["status"].Methods[0])
+	}
+	if readCfg.Targets[0].Module != DefaultModule {
+		t.Errorf("Unexpected target module. Expected=%s, Got=%s", DefaultModule, readCfg.Targets[0].Module)
+	}
+
+	writeCfg.Modules["status"] = Module{Methods: []string{"No_Such_Method"}}
+	writeCfg.WriteConfig(testFile.Name())
+	if _, err := ParseConfig(testFile.Name()); err == nil {
+		t.Error("ParseConfig accepted an unknown method")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("OPENOTP_TEST_USER", "admin")
+	t.Setenv("OPENOTP_TEST_PASS", "p@ss: word")
+	testFile := getTestFile("testcfg")
+	defer os.Remove(testFile.Name())
+	writeCfg := new(Config)
+	writeCfg.API.Username = "${OPENOTP_TEST_USER}"
+	writeCfg.API.Password = "${OPENOTP_TEST_PASS}"
+	writeCfg.WriteConfig(testFile.Name())
+
+	readCfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if readCfg.API.Username != "admin" {
+		t.Errorf("Unexpected API username. Expected=admin, Got=%s", readCfg.API.Username)
+	}
+	if readCfg.API.Password != "p@ss: word" {
+		t.Errorf("Unexpected API password. Expected=p@ss: word, Got=%s", readCfg.API.Password)
+	}
+
+	writeCfg.API.Password = "${OPENOTP_TEST_UNDEFINED}"
+	writeCfg.WriteConfig(testFile.Name())
+	if _, err := ParseConfig(testFile.Name()); err == nil {
+		t.Error("ParseConfig accepted a reference to an undefined environment variable")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	testFile := getTestFile("testcfg")
+	defer os.Remove(testFile.Name())
+	testFile.WriteString("api:\n  username: admin\n  pasword: secret\n  certfile: /nonexistent/ca.pem\n")
+	testFile.Close()
+
+	errs := CheckConfig(testFile.Name())
+	// Expect an unknown key (pasword), an empty password and an unreadable certfile
+	if len(errs) != 3 {
+		t.Errorf("Unexpected number of errors. Expected=3, Got=%d: %v", len(errs), errs)
+	}
+}
+
+func TestTargetsFile(t *testing.T) {
+	targetsFile := getTestFile("testtargets")
+	defer os.Remove(targetsFile.Name())
+	targetsFile.WriteString(`[{"url": "https://otp2.example.com", "labels": {"datacenter": "dc2"}}]`)
+	targetsFile.Close()
+	testFile := getTestFile("testcfg")
+	defer os.Remove(testFile.Name())
+	writeCfg := new(Config)
+	writeCfg.Targets = []Target{{URL: "https://otp1.example.com"}}
+	writeCfg.TargetsFile = targetsFile.Name()
+	writeCfg.WriteConfig(testFile.Name())
+
+	readCfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if len(readCfg.Targets) != 2 {
+		t.Fatalf("Unexpected number of targets. Expected=2, Got=%d", len(readCfg.Targets))
+	}
+	if readCfg.Targets[1].Module != DefaultModule {
+		t.Errorf("Unexpected target module. Expected=%s, Got=%s", DefaultModule, readCfg.Targets[1].Module)
+	}
+	if readCfg.Targets[1].Labels["datacenter"] != "dc2" {
+		t.Errorf("Unexpected target labels. Got=%v", readCfg.Targets[1].Labels)
+	}
+
+	// A target in the targets file duplicating a static target is rejected
+	writeCfg.Targets = []Target{{URL: "https://otp2.example.com"}}
+	writeCfg.WriteConfig(testFile.Name())
+	if _, err := ParseConfig(testFile.Name()); err == nil {
+		t.Error("ParseConfig accepted a duplicate target")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	t.Setenv("OPENOTP_EXPORTER_LISTEN_PORT", "9100")
+	t.Setenv("OPENOTP_EXPORTER_API_TIMEOUT", "5s")
+	t.Setenv("OPENOTP_EXPORTER_LOG_LEVEL", "debug")
+	flagOverrides["logging.level"] = "warn"
+	defer delete(flagOverrides, "logging.level")
+	testFile := getTestFile("testcfg")
+	defer os.Remove(testFile.Name())
+	writeCfg := new(Config)
+	writeCfg.Exporter.Port = 9794
+	writeCfg.Logging.LevelStr = "error"
+	writeCfg.WriteConfig(testFile.Name())
+
+	readCfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if readCfg.Exporter.Port != 9100 {
+		t.Errorf("Unexpected exporter port. Expected=9100, Got=%d", readCfg.Exporter.Port)
+	}
+	if readCfg.API.Timeout != 5*time.Second {
+		t.Errorf("Unexpected API timeout. Expected=5s, Got=%s", readCfg.API.Timeout)
+	}
+	// Flags take precedence over the environment
+	if readCfg.Logging.LevelStr != "warn" {
+		t.Errorf("Unexpected log level. Expected=warn, Got=%s", readCfg.Logging.LevelStr)
+	}
+
+	t.Setenv("OPENOTP_EXPORTER_LISTEN_PORT", "http")
+	if _, err := ParseConfig(testFile.Name()); err == nil {
+		t.Error("ParseConfig accepted an invalid port")
+	}
+}
+
+func TestKubernetesServiceEnv(t *testing.T) {
+	// Kubernetes defines these for a service named openotp-exporter.  They aren't options.
+	t.Setenv("OPENOTP_EXPORTER_PORT", "tcp://10.96.0.10:9794")
+	t.Setenv("OPENOTP_EXPORTER_SERVICE_HOST", "10.96.0.10")
+	t.Setenv("OPENOTP_EXPORTER_SERVICE_PORT", "9794")
+	if envConfigured() {
+		t.Error("Kubernetes service variables were taken as config options")
+	}
+	testFile := getTestFile("testcfg")
+	defer os.Remove(testFile.Name())
+	writeCfg := new(Config)
+	writeCfg.Exporter.Port = 9100
+	writeCfg.WriteConfig(testFile.Name())
+	readCfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if readCfg.Exporter.Port != 9100 {
+		t.Errorf("Unexpected exporter port. Expected=9100, Got=%d", readCfg.Exporter.Port)
+	}
+}
+
+func TestEnvOnlyConfig(t *testing.T) {
+	t.Setenv("OPENOTP_EXPORTER_API_USERNAME", "admin")
+	t.Setenv("OPENOTP_EXPORTER_API_PASSWORD", "secret")
+	t.Setenv("OPENOTP_EXPORTER_TARGETS", "https://otp1.example.com, https://otp2.example.com")
+	readCfg, err := ParseConfig("")
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if readCfg.API.Username != "admin" || readCfg.API.Password != "secret" {
+		t.Errorf("Unexpected API credentials. Got=%s/%s", readCfg.API.Username, readCfg.API.Password)
+	}
+	if len(readCfg.Targets) != 2 || readCfg.Targets[1].URL != "https://otp2.example.com" {
+		t.Fatalf("Unexpected targets. Got=%v", readCfg.Targets)
+	}
+	if readCfg.Targets[0].Module != DefaultModule {
+		t.Errorf("Unexpected target module. Expected=%s, Got=%s", DefaultModule, readCfg.Targets[0].Module)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/base.yml", []byte("api:\n  username: admin\n  port: 443\nexporter:\n  port: 9100\n"), 0644)
+	os.MkdirAll(dir+"/sites", 0755)
+	os.WriteFile(dir+"/sites/dc1.yml", []byte("targets:\n  - url: https://otp1.example.com\n"), 0644)
+	os.WriteFile(dir+"/config.yml", []byte("include:\n  - base.yml\n  - sites/*.yml\napi:\n  port: 8443\n"), 0644)
+
+	readCfg, err := ParseConfig(dir + "/config.yml")
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if readCfg.API.Username != "admin" || readCfg.Exporter.Port != 9100 {
+		t.Errorf("Included options not set. Got username=%s, port=%d", readCfg.API.Username, readCfg.Exporter.Port)
+	}
+	// The including file overrides the files it includes
+	if readCfg.API.Port != 8443 {
+		t.Errorf("Unexpected API port. Expected=8443, Got=%d", readCfg.API.Port)
+	}
+	if len(readCfg.Targets) != 1 {
+		t.Errorf("Unexpected number of targets. Expected=1, Got=%d", len(readCfg.Targets))
+	}
+
+	os.WriteFile(dir+"/base.yml", []byte("include: config.yml\n"), 0644)
+	if _, err := ParseConfig(dir + "/config.yml"); err == nil {
+		t.Error("ParseConfig accepted an include cycle")
+	}
+}
+
+func TestMetricFilters(t *testing.T) {
+	tests := []struct {
+		filter MetricFilter
+		valid  bool
+	}{
+		{MetricFilter{Action: "drop", Metric: "openotp_license_.*"}, true},
+		{MetricFilter{Action: "labeldrop", Label: "customer"}, true},
+		{MetricFilter{Action: "labeldrop"}, false},
+		{MetricFilter{Action: "replace", Label: "target", Regex: "https://(.*)", Replacement: "$1"}, true},
+		{MetricFilter{Action: "keep", Metric: "("}, false},
+		{MetricFilter{Action: "hashmod"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.filter.setDefaults(); (err == nil) != tt.valid {
+			t.Errorf("Unexpected result for %+v. Expected valid=%t, Got=%v", tt.filter, tt.valid, err)
+		}
+	}
+	f := MetricFilter{Action: "drop", Metric: "openotp_users_active", Label: "target", Regex: "https://otp2.*"}
+	f.setDefaults()
+	if !f.Matches("openotp_users_active", "https://otp2.example.com", true) {
+		t.Error("Filter didn't match a series of the metric with a matching label")
+	}
+	if f.Matches("openotp_users_active_total", "https://otp2.example.com", true) {
+		t.Error("Filter matched a different metric")
+	}
+}
+
+func TestCustomMetricValidate(t *testing.T) {
+	tests := []struct {
+		value  string
+		labels map[string]string
+		valid  bool
+	}{
+		{"users", nil, true},
+		{"domains.*.users", map[string]string{"domain": "$1"}, true},
+		{"domains.*.users", map[string]string{"domain": "domains.*.name"}, true},
+		{"domains.*.users", nil, false},
+		{"domains.*.users.*", map[string]string{"domain": "$1"}, false},
+		{"domains.*.users.*", map[string]string{"domain": "$1", "user": "$2"}, true},
+		{"domains.*.users.*", map[string]string{"user": "domains.*.users.*.name"}, true},
+		{"domains.*.users", map[string]string{"domain": "$2"}, false},
+		{"domains.*.users", map[string]string{"domain": "domains.*.x.*"}, false},
+		{"domains.*.users", map[string]string{"target": "$1"}, false},
+	}
+	for _, test := range tests {
+		c := CustomMetric{Name: "test", Method: "Test", Value: test.value, Labels: test.labels}
+		if err := c.validate(); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for %s with labels %v: %v", test.value, test.labels, err)
+		}
+	}
+}
+
+func TestOTLPProtocol(t *testing.T) {
+	tests := []struct {
+		protocol string
+		valid    bool
+	}{
+		{"", true},
+		{"http/json", true},
+		{"grpc", false},
+		{"http/protobuf", false},
+	}
+	for _, test := range tests {
+		o := OTLP{Endpoint: "http://collector:4318", Protocol: test.protocol}
+		if err := o.setDefaults(); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for protocol %q: %v", test.protocol, err)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		method string
+		valid  bool
+	}{
+		{"Get_License_Details", true},
+		{"get_license_details", true},
+		{"Check_CA", false},
+		{"Count_Domain_Users", false},
+		{"No_Such_Method", false},
+	}
+	for _, test := range tests {
+		testFile := getTestFile("testcfg")
+		writeCfg := new(Config)
+		writeCfg.Cache.TTL = map[string]time.Duration{test.method: time.Hour}
+		writeCfg.WriteConfig(testFile.Name())
+		_, err := ParseConfig(testFile.Name())
+		os.Remove(testFile.Name())
+		if (err == nil) != test.valid {
+			t.Errorf("Unexpected result for a cache ttl for %s: %v", test.method, err)
+		}
+	}
+}
+
+func TestExporterLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"environment", true},
+		{"target", false},
+		{"__meta", false},
+		{"bad-name", false},
+	}
+	for _, test := range tests {
+		testFile := getTestFile("testcfg")
+		writeCfg := new(Config)
+		writeCfg.Exporter.Labels = map[string]string{test.name: "value"}
+		writeCfg.WriteConfig(testFile.Name())
+		_, err := ParseConfig(testFile.Name())
+		os.Remove(testFile.Name())
+		if (err == nil) != test.valid {
+			t.Errorf("Unexpected result for an exporter label named %s: %v", test.name, err)
+		}
+	}
+}
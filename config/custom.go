@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CustomMetric maps a field of an RPC response to a metric, allowing API data to be exported without changes to the
+// exporter.
+type CustomMetric struct {
+	// Name is prefixed with the exporter's namespace
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	// Type is gauge, counter or untyped
+	Type   string `yaml:"type"`
+	Method string `yaml:"method"`
+	// Params are passed to the method as given, typically a list or a map
+	Params interface{} `yaml:"params"`
+	// Value is the dot separated path to the metric's value within the response, e.g. "domains.*.users".  A "*"
+	// matches every element of a list or map, producing a series for each.  An empty path is the whole response.
+	Value string `yaml:"value"`
+	// Labels maps label names to paths.  The wildcards in a label's path match the same elements as the value's
+	// wildcards, so "domains.*.name" labels each series with its domain's name.  "$1" is the key or index matched by
+	// the first wildcard, "$2" the second, and so on.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// SplitPath returns the elements of a custom metric path
+func SplitPath(path string) []string {
+	path = strings.Trim(path, ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// wildcards returns the number of wildcards in a custom metric path
+func wildcards(path string) int {
+	n := 0
+	for _, elem := range SplitPath(path) {
+		if elem == "*" {
+			n++
+		}
+	}
+	return n
+}
+
+// validate checks that the custom metric is well formed and populates any defaults
+func (c *CustomMetric) validate() error {
+	if !metricNameRE.MatchString(c.Name) {
+		return fmt.Errorf("invalid metric name: %q", c.Name)
+	}
+	if c.Method == "" {
+		return fmt.Errorf("no method defined")
+	}
+	switch c.Type {
+	case "":
+		c.Type = "gauge"
+	case "gauge", "counter", "untyped":
+	default:
+		return fmt.Errorf("invalid metric type: %s", c.Type)
+	}
+	if c.Help == "" {
+		c.Help = fmt.Sprintf("Custom metric from the %s method", c.Method)
+	}
+	n := wildcards(c.Value)
+	// referenced records the value path wildcards that distinguish the series, which must all be used by a label or
+	// the series of different elements would be identical.
+	referenced := make([]bool, n+1)
+	for name, path := range c.Labels {
+		if !metricNameRE.MatchString(name) || strings.HasPrefix(name, "__") || name == "target" {
+			return fmt.Errorf("invalid label name: %s", name)
+		}
+		if ref, ok := strings.CutPrefix(path, "$"); ok {
+			i, err := strconv.Atoi(ref)
+			if err != nil || i < 1 || i > n {
+				return fmt.Errorf("label %s: %s doesn't refer to a wildcard in the value path", name, path)
+			}
+			referenced[i] = true
+			continue
+		}
+		w := wildcards(path)
+		if w > n {
+			return fmt.Errorf("label %s: path has more wildcards than the value path", name)
+		}
+		for i := 1; i <= w; i++ {
+			referenced[i] = true
+		}
+	}
+	for i := 1; i <= n; i++ {
+		if !referenced[i] {
+			return fmt.Errorf("value path wildcard %d isn't used by any label", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Headers that identify an age encrypted file in its binary and armored forms
+var (
+	ageHeader      = []byte("age-encryption.org/v1\n")
+	ageArmorHeader = []byte("-----BEGIN AGE ENCRYPTED FILE-----")
+)
+
+// decryptConfig returns the plaintext of a config file encrypted with SOPS or age, or data unchanged if it isn't
+// encrypted.  Decryption is performed by the sops or age command, so that the config can be stored encrypted
+// alongside the rest of a deployment.  The age identity is taken from the SOPS_AGE_KEY or SOPS_AGE_KEY_FILE
+// environment variable, as used by sops.
+func decryptConfig(filename string, data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, ageHeader) || bytes.HasPrefix(bytes.TrimSpace(data), ageArmorHeader):
+		identity, err := ageIdentity()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		cmd := exec.Command("age", "--decrypt", "--identity", "-", filename)
+		cmd.Stdin = strings.NewReader(identity)
+		return runDecrypt(filename, cmd)
+	case isSOPS(data):
+		// sops finds the keys itself
+		return runDecrypt(filename, exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", filename))
+	}
+	return data, nil
+}
+
+// isSOPS returns true if data is a YAML document with SOPS metadata
+func isSOPS(data []byte) bool {
+	var doc struct {
+		SOPS struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	return doc.SOPS.MAC != ""
+}
+
+// ageIdentity returns the age identity used to decrypt config files
+func ageIdentity() (string, error) {
+	if key, ok := os.LookupEnv("SOPS_AGE_KEY"); ok {
+		return key, nil
+	}
+	keyFile, ok := os.LookupEnv("SOPS_AGE_KEY_FILE")
+	if !ok {
+		return "", fmt.Errorf("encrypted with age but neither SOPS_AGE_KEY nor SOPS_AGE_KEY_FILE is set")
+	}
+	key, err := os.ReadFile(expandTilde(keyFile))
+	if err != nil {
+		return "", fmt.Errorf("unable to read age key: %v", err)
+	}
+	return string(key), nil
+}
+
+// runDecrypt runs a decryption command and returns its output
+func runDecrypt(filename string, cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("unable to decrypt %s: %s", filename, msg)
+		}
+		return nil, fmt.Errorf("unable to decrypt %s: %v", filename, err)
+	}
+	return out, nil
+}
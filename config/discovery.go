@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kubernetes configures discovery of WebADM pods or services using the Kubernetes API.  The exporter must be running
+// in the cluster as it authenticates with its service account.
+type Kubernetes struct {
+	// Role is either "pod" or "service"
+	Role          string `yaml:"role"`
+	Namespace     string `yaml:"namespace"`
+	LabelSelector string `yaml:"label_selector"`
+	// Module is the module used to probe discovered targets
+	Module          string        `yaml:"module"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// Enabled returns true if Kubernetes discovery has been configured
+func (k *Kubernetes) Enabled() bool {
+	return k.LabelSelector != ""
+}
+
+// setDefaults populates any unset fields with default values and validates the result
+func (k *Kubernetes) setDefaults() error {
+	if !k.Enabled() {
+		return nil
+	}
+	if k.Role == "" {
+		k.Role = "pod"
+	}
+	if k.Module == "" {
+		k.Module = DefaultModule
+	}
+	if k.RefreshInterval == 0 {
+		k.RefreshInterval = time.Minute
+	}
+	if k.Role != "pod" && k.Role != "service" {
+		return fmt.Errorf("unknown role: %s", k.Role)
+	}
+	return nil
+}
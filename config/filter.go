@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MetricFilter is a rule that drops series, or rewrites their labels, before they're exposed.  Filters are applied in
+// order to every series served by the exporter.
+type MetricFilter struct {
+	// Action is one of:
+	//   keep: drop series that don't match
+	//   drop: drop series that match
+	//   labeldrop: remove Label from the series of metrics matching Metric
+	//   replace: replace the value of Label, where it matches Regex, with Replacement.  An empty result removes the
+	//   label.
+	Action string `yaml:"action"`
+	// Metric is a regex matched against metric names.  If it's empty, all metrics match.
+	Metric string `yaml:"metric"`
+	// Label and Regex additionally require the value of a label to match for keep and drop
+	Label       string `yaml:"label"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	// MetricRE and RegexRE are the compiled, anchored forms of Metric and Regex
+	MetricRE *regexp.Regexp `yaml:"-"`
+	RegexRE  *regexp.Regexp `yaml:"-"`
+}
+
+// Matches returns true if a series of the named metric, with the given value of Label, matches the filter.  ok
+// indicates whether the series has the label.
+func (f *MetricFilter) Matches(name, value string, ok bool) bool {
+	if !f.MetricRE.MatchString(name) {
+		return false
+	}
+	return f.Label == "" || (ok && f.RegexRE.MatchString(value))
+}
+
+// setDefaults compiles the regexes and validates the filter
+func (f *MetricFilter) setDefaults() error {
+	switch f.Action {
+	case "keep", "drop":
+	case "labeldrop", "replace":
+		if f.Label == "" {
+			return fmt.Errorf("action %s requires a label", f.Action)
+		}
+	default:
+		return fmt.Errorf("invalid action: %s", f.Action)
+	}
+	if f.Label != "" && !metricNameRE.MatchString(f.Label) {
+		return fmt.Errorf("invalid label name: %s", f.Label)
+	}
+	var err error
+	if f.MetricRE, err = anchoredRegexp(f.Metric); err != nil {
+		return fmt.Errorf("invalid metric regex: %v", err)
+	}
+	if f.RegexRE, err = anchoredRegexp(f.Regex); err != nil {
+		return fmt.Errorf("invalid regex: %v", err)
+	}
+	return nil
+}
+
+// anchoredRegexp compiles a regex that must match the whole of a string.  An empty regex matches anything.
+func anchoredRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		expr = ".*"
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeKey is the top-level key listing the config fragments that a file includes.  Entries are filenames or glob
+// patterns, relative to the including file.
+const includeKey = "include"
+
+// loadConfigNode reads a config file and the fragments it includes, returning the merged document.  The included
+// fragments are merged in the order listed, then the including file is merged on top of them, so a file overrides
+// what it includes.  Mappings are merged key by key; any other value replaces the one it overrides.  stack holds the
+// files being included, to detect cycles.
+func loadConfigNode(filename string, stack []string) (*yaml.Node, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+		}
+	}
+	stack = append(stack, abs)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decryptConfig(filename, data); err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		// An empty file
+		return nil, nil
+	}
+	root := doc.Content[0]
+	patterns, err := removeIncludes(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var merged *yaml.Node
+	for _, pattern := range patterns {
+		pattern = expandTilde(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %s: %v", filename, pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: included file %s does not exist", filename, pattern)
+		}
+		for _, match := range matches {
+			node, err := loadConfigNode(match, stack)
+			if err != nil {
+				return nil, err
+			}
+			merged = mergeNodes(merged, node)
+		}
+	}
+	return mergeNodes(merged, root), nil
+}
+
+// removeIncludes removes the include key from a config document and returns the patterns it listed
+func removeIncludes(root *yaml.Node) ([]string, error) {
+	if root.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		if root.Content[i].Value != includeKey {
+			continue
+		}
+		var patterns []string
+		value := root.Content[i+1]
+		if value.Kind == yaml.ScalarNode {
+			patterns = []string{value.Value}
+		} else if err := value.Decode(&patterns); err != nil {
+			return nil, fmt.Errorf("include must be a filename or list of filenames")
+		}
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// mergeNodes merges src on top of dst and returns the result
+func mergeNodes(dst, src *yaml.Node) *yaml.Node {
+	if dst == nil {
+		return src
+	}
+	if src == nil {
+		return dst
+	}
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		return src
+	}
+	for i := 0; i < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		found := false
+		for j := 0; j < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				dst.Content[j+1] = mergeNodes(dst.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Content = append(dst.Content, key, value)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OTLP sends telemetry to an OpenTelemetry collector using OTLP/HTTP with JSON encoding.  OTLP/gRPC isn't supported.
+type OTLP struct {
+	// Endpoint is the collector's base URL, e.g. http://collector:4318
+	Endpoint string `yaml:"endpoint"`
+	// Protocol is the OTLP transport.  Only http/json, the default, is supported.
+	Protocol string            `yaml:"protocol"`
+	Headers  map[string]string `yaml:"headers"`
+	// Signals are the types of telemetry sent: metrics, traces or both.  The default is metrics.
+	Signals []string `yaml:"signals"`
+	// Interval is how often the metrics served by /metrics are sent
+	Interval time.Duration `yaml:"interval"`
+	// Timeout limits each request to the collector.  It doesn't include the time taken to probe the targets.
+	Timeout time.Duration `yaml:"timeout"`
+	// ResourceAttributes are added to the service.name attribute identifying the exporter
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+	CAFile             string            `yaml:"ca_file"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+}
+
+// Exports returns true if the given signal is sent to the collector
+func (o OTLP) Exports(signal string) bool {
+	if o.Endpoint == "" {
+		return false
+	}
+	for _, s := range o.Signals {
+		if s == signal {
+			return true
+		}
+	}
+	return false
+}
+
+// setDefaults populates any unset fields with default values and validates the result
+func (o *OTLP) setDefaults() error {
+	if o.Interval == 0 {
+		o.Interval = time.Minute
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	switch o.Protocol {
+	case "":
+		o.Protocol = "http/json"
+	case "http/json":
+	case "grpc":
+		return fmt.Errorf("protocol grpc isn't supported, use http/json and the collector's OTLP/HTTP port (usually 4318)")
+	default:
+		return fmt.Errorf("unsupported protocol %s, only http/json is supported", o.Protocol)
+	}
+	if len(o.Signals) == 0 {
+		o.Signals = []string{"metrics"}
+	}
+	for _, s := range o.Signals {
+		if s != "metrics" && s != "traces" {
+			return fmt.Errorf("unknown signal: %s", s)
+		}
+	}
+	o.CAFile = expandTilde(o.CAFile)
+	if o.Endpoint != "" && !strings.HasPrefix(o.Endpoint, "http://") && !strings.HasPrefix(o.Endpoint, "https://") {
+		return fmt.Errorf("endpoint must be an http:// or https:// URL")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// override is a config option that may be set by a command line flag or an environment variable instead of the
+// config file.  The environment variable is the flag name prefixed by OPENOTP_EXPORTER_, e.g. --log-level becomes
+// OPENOTP_EXPORTER_LOG_LEVEL.  Flags take precedence over environment variables, which take precedence over the
+// config file.
+type override struct {
+	flag string
+	// path is the location of the option in the config file, e.g. exporter.port
+	path  string
+	usage string
+	// envOnly options, such as passwords, have no flag as it would be visible to other users in the process list
+	envOnly bool
+	// set is used instead of decoding the value into the option at path
+	set func(config *Config, value string) error
+}
+
+// The flag names avoid the variables Kubernetes defines for a service named openotp-exporter, such as
+// OPENOTP_EXPORTER_PORT=tcp://10.0.0.1:9794, which would otherwise be taken as options.
+var overrides = []override{
+	{flag: "listen-address", path: "exporter.listen", usage: "Address to listen on, as host:port or unix:///path/to/socket"},
+	{flag: "listen-port", path: "exporter.port", usage: "Port to listen on"},
+	{flag: "log-level", path: "logging.level", usage: "Log level: trace, debug, info, warn or error"},
+	{flag: "log-format", path: "logging.format", usage: "Log format: text or json"},
+	{flag: "api-path", path: "api.path", usage: "Path of the WebADM manager API"},
+	{flag: "api-timeout", path: "api.timeout", usage: "Probe timeout when Prometheus doesn't advertise a scrape timeout, e.g. 10s"},
+	{flag: "timeout-offset", path: "exporter.timeout_offset", usage: "Subtracted from the Prometheus scrape timeout to give the probe timeout"},
+	{flag: "api-username", path: "api.username", usage: "API username"},
+	{flag: "api-password", path: "api.password", usage: "API password", envOnly: true},
+	{flag: "targets", path: "targets", usage: "Comma-separated list of targets, replacing those in the config file", set: setTargets},
+}
+
+// setTargets replaces the configured targets with a comma-separated list of target URLs
+func setTargets(config *Config, value string) error {
+	config.Targets = nil
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			config.Targets = append(config.Targets, Target{URL: url})
+		}
+	}
+	return nil
+}
+
+// envConfigured returns true if any option is set by an environment variable
+func envConfigured() bool {
+	for _, o := range overrides {
+		if _, ok := os.LookupEnv(o.envName()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flagOverrides are the values of the override flags given on the command line, keyed by path
+var flagOverrides = make(map[string]string)
+
+// envName returns the environment variable corresponding to an override
+func (o override) envName() string {
+	return "OPENOTP_EXPORTER_" + strings.ToUpper(strings.ReplaceAll(o.flag, "-", "_"))
+}
+
+// registerOverrides defines the override flags.  They're recorded for ParseConfig rather than returned in Flags so
+// that they also apply when the config is reloaded.
+func registerOverrides(fs *flag.FlagSet) {
+	for _, o := range overrides {
+		if o.envOnly {
+			continue
+		}
+		path := o.path
+		fs.Func(o.flag, fmt.Sprintf("%s (env %s)", o.usage, o.envName()), func(s string) error {
+			flagOverrides[path] = s
+			return nil
+		})
+	}
+}
+
+// applyOverrides sets the options given by flags or environment variables.  Flags take precedence over environment
+// variables, which take precedence over the config file.
+func applyOverrides(config *Config) error {
+	for _, o := range overrides {
+		value, ok := flagOverrides[o.path]
+		source := "--" + o.flag
+		if !ok {
+			value, ok = os.LookupEnv(o.envName())
+			source = o.envName()
+		}
+		if !ok {
+			continue
+		}
+		set := o.set
+		if set == nil {
+			path := o.path
+			set = func(config *Config, value string) error {
+				return setPath(reflect.ValueOf(config).Elem(), path, value)
+			}
+		}
+		if err := set(config, value); err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+	}
+	return nil
+}
+
+// setPath decodes value into the field of v at the given path of YAML keys
+func setPath(v reflect.Value, path, value string) error {
+	for _, key := range strings.Split(path, ".") {
+		field, ok := fieldByKey(v, key)
+		if !ok {
+			return fmt.Errorf("unknown config option: %s", path)
+		}
+		v = field
+	}
+	node := yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	return node.Decode(v.Addr().Interface())
+}
+
+// fieldByKey returns the field of struct v with the given YAML key
+func fieldByKey(v reflect.Value, key string) (reflect.Value, bool) {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
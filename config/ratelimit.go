@@ -0,0 +1,26 @@
+package config
+
+import "fmt"
+
+// RateLimit limits the rate of probe requests, both in total and from each client address.  Rates are requests per
+// second and zero rates are unlimited.
+type RateLimit struct {
+	Rate           float64 `yaml:"rate"`
+	Burst          int     `yaml:"burst"`
+	PerClientRate  float64 `yaml:"per_client_rate"`
+	PerClientBurst int     `yaml:"per_client_burst"`
+}
+
+// setDefaults populates any unset fields with default values and validates the result
+func (r *RateLimit) setDefaults() error {
+	if r.Rate < 0 || r.PerClientRate < 0 {
+		return fmt.Errorf("rates cannot be negative")
+	}
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+	if r.PerClientBurst < 1 {
+		r.PerClientBurst = 1
+	}
+	return nil
+}
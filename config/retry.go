@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RetryClasses are the classes of transient failure that may be retried, in addition to HTTP status codes
+var RetryClasses = []string{"connection_reset", "connection_refused", "eof", "timeout"}
+
+// Retry configures the retrying of RPC batches that fail with a transient error
+type Retry struct {
+	// Count is the maximum number of retries.  Zero disables retries.
+	Count int `yaml:"count"`
+	// Backoff is the delay before the first retry.  It doubles with each subsequent retry, up to MaxBackoff.
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// Jitter randomises each delay by up to this fraction of it
+	Jitter float64 `yaml:"jitter"`
+	// RetryOn lists the failures that are retried: any of RetryClasses or an HTTP status code such as 502
+	RetryOn []string `yaml:"retry_on"`
+}
+
+// setDefaults populates any unset fields with default values and validates the result
+func (r *Retry) setDefaults() error {
+	if r.Backoff == 0 {
+		r.Backoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 2 * time.Second
+	}
+	if r.Jitter == 0 {
+		r.Jitter = 0.2
+	}
+	if len(r.RetryOn) == 0 {
+		r.RetryOn = append(append([]string(nil), RetryClasses...), "502", "503", "504")
+	}
+	if r.Count < 0 {
+		return fmt.Errorf("count cannot be negative")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	for _, class := range r.RetryOn {
+		if code, err := strconv.Atoi(class); err == nil {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid HTTP status code in retry_on: %d", code)
+			}
+			continue
+		}
+		known := false
+		for _, c := range RetryClasses {
+			known = known || c == class
+		}
+		if !known {
+			return fmt.Errorf("unknown retry_on class: %s", class)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Vault configures retrieval of the API credentials from a HashiCorp Vault KV secret
+type Vault struct {
+	Address string `yaml:"address"`
+	// CAFile is a PEM bundle used to verify Vault's server certificate
+	CAFile string `yaml:"ca_file"`
+	// AuthMethod is one of "token", "approle" or "kubernetes"
+	AuthMethod string `yaml:"auth_method"`
+	// AuthMount overrides the path at which the auth method is mounted.  It defaults to the name of the method.
+	AuthMount string `yaml:"auth_mount"`
+	Token     string `yaml:"token"`
+	RoleID    string `yaml:"role_id"`
+	SecretID  string `yaml:"secret_id"`
+	Role      string `yaml:"role"`
+	// JWTFile is the Kubernetes service account token used by the kubernetes auth method
+	JWTFile string `yaml:"jwt_file"`
+	// SecretPath is the API path of the secret, for example "secret/data/openotp" for a KV v2 engine
+	SecretPath      string        `yaml:"secret_path"`
+	UsernameKey     string        `yaml:"username_key"`
+	PasswordKey     string        `yaml:"password_key"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// Enabled returns true if Vault has been configured
+func (v *Vault) Enabled() bool {
+	return v.Address != ""
+}
+
+// setDefaults populates any unset fields with default values and validates the result
+func (v *Vault) setDefaults() error {
+	if !v.Enabled() {
+		return nil
+	}
+	if v.AuthMethod == "" {
+		v.AuthMethod = "token"
+	}
+	if v.AuthMount == "" {
+		v.AuthMount = v.AuthMethod
+	}
+	if v.JWTFile == "" {
+		v.JWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	if v.UsernameKey == "" {
+		v.UsernameKey = "username"
+	}
+	if v.PasswordKey == "" {
+		v.PasswordKey = "password"
+	}
+	if v.RefreshInterval == 0 {
+		v.RefreshInterval = time.Hour
+	}
+	if v.SecretPath == "" {
+		return fmt.Errorf("secret_path must be defined")
+	}
+	switch v.AuthMethod {
+	case "token":
+		if v.Token == "" {
+			return fmt.Errorf("token auth requires a token")
+		}
+	case "approle":
+		if v.RoleID == "" || v.SecretID == "" {
+			return fmt.Errorf("approle auth requires a role_id and secret_id")
+		}
+	case "kubernetes":
+		if v.Role == "" {
+			return fmt.Errorf("kubernetes auth requires a role")
+		}
+	default:
+		return fmt.Errorf("unknown auth_method: %s", v.AuthMethod)
+	}
+	return nil
+}
+
+// Keyring configures retrieval of the API password from the host's keyring: the Secret Service on Linux, the Keychain
+// on macOS or the Credential Manager on Windows.
+type Keyring struct {
+	Enabled bool `yaml:"enabled"`
+	// Service names the keyring entries.  The account of each entry is the hostname of the target it's used for, or
+	// "default" for targets without an entry of their own.  On Windows, entries are generic credentials named
+	// service:account.
+	Service string `yaml:"service"`
+	// CacheTTL is how long a password is used before the keyring is queried again
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// setDefaults populates any unset fields with default values
+func (k *Keyring) setDefaults() {
+	if k.Service == "" {
+		k.Service = "openotp_exporter"
+	}
+	if k.CacheTTL == 0 {
+		k.CacheTTL = 5 * time.Minute
+	}
+}
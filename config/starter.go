@@ -0,0 +1,112 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configComments are written above the corresponding keys by WriteConfig, keyed by their dotted path
+var configComments = map[string]string{
+	"api":                                  "Connection to the OpenOTP/WebADM manager API",
+	"api.username":                         "WebADM admin account used to query the API",
+	"api.password":                         "Environment variables may be referenced, e.g. ${OPENOTP_EXPORTER_API_PASSWORD}",
+	"api.certfile":                         "CA bundle used to verify the API's certificate",
+	"exporter":                             "The exporter's own listener",
+	"exporter.port":                        "9794 is the port allocated to this exporter",
+	"exporter.tls_server_config":           "Serve HTTPS instead of HTTP",
+	"exporter.tls_server_config.cert_file": "PEM certificate and key of the listener",
+	"logging":                              "Log to stdout at the given level, or to filename if set",
+	"targets":                              "Targets probed on each scrape of /metrics.  They may also be probed individually with\n/probe?target=<url>.",
+	"modules":                              "Modules select the RPC methods called for a target",
+}
+
+// configNode converts v to a YAML node, omitting struct fields with zero values so that only the options that have
+// been set are written.
+func configNode(v reflect.Value) (*yaml.Node, error) {
+	node := new(yaml.Node)
+	if err := node.Encode(v.Interface()); err != nil {
+		return nil, err
+	}
+	pruneNode(node, v, "")
+	return node, nil
+}
+
+// pruneNode removes the entries of mapping nodes that correspond to zero struct fields and attaches the comments from
+// configComments.  v is the value that node was encoded from and path is its dotted key path.
+func pruneNode(node *yaml.Node, v reflect.Value, path string) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := make(map[string]reflect.Value)
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = v.Field(i)
+			}
+		}
+		var content []*yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if ok && field.IsZero() {
+				continue
+			}
+			keyPath := strings.TrimPrefix(path+"."+key.Value, ".")
+			key.HeadComment = configComments[keyPath]
+			if ok {
+				pruneNode(value, field, keyPath)
+			}
+			content = append(content, key, value)
+		}
+		node.Content = content
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			for _, k := range v.MapKeys() {
+				if k.Kind() == reflect.String && k.String() == node.Content[i].Value {
+					pruneNode(node.Content[i+1], v.MapIndex(k), path+".*")
+				}
+			}
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			if i < v.Len() {
+				pruneNode(item, v.Index(i), path+".*")
+			}
+		}
+	}
+}
+
+// Starter returns a minimal config for the given targets, as written by the init-config command.  The listener
+// serves HTTPS if a certificate and key are given.
+func Starter(targets []string, username, tlsCert, tlsKey string) *Config {
+	c := new(Config)
+	c.API.Username = username
+	c.API.Password = "${OPENOTP_EXPORTER_API_PASSWORD}"
+	c.Exporter.Port = 9794
+	c.Exporter.TLS.CertFile = tlsCert
+	c.Exporter.TLS.KeyFile = tlsKey
+	c.Logging.LevelStr = "info"
+	for _, t := range targets {
+		c.Targets = append(c.Targets, Target{URL: t, Module: DefaultModule})
+	}
+	c.Modules = map[string]Module{
+		DefaultModule: {Methods: DefaultMethods},
+	}
+	return c
+}
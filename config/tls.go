@@ -0,0 +1,175 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TLSVersion is a TLS protocol version that can be unmarshalled from strings such as "TLS12"
+type TLSVersion uint16
+
+var tlsVersions = map[string]TLSVersion{
+	"TLS13": (TLSVersion)(tls.VersionTLS13),
+	"TLS12": (TLSVersion)(tls.VersionTLS12),
+	"TLS11": (TLSVersion)(tls.VersionTLS11),
+	"TLS10": (TLSVersion)(tls.VersionTLS10),
+}
+
+// UnmarshalYAML converts a TLS version string into a TLSVersion
+func (tv *TLSVersion) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	if s == "" {
+		*tv = 0
+		return nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("unknown TLS version: %s", s)
+	}
+	*tv = v
+	return nil
+}
+
+// MarshalYAML converts a TLSVersion back to its string representation
+func (tv TLSVersion) MarshalYAML() (interface{}, error) {
+	for s, v := range tlsVersions {
+		if v == tv {
+			return s, nil
+		}
+	}
+	return "", nil
+}
+
+// clientAuthTypes maps the exporter-toolkit names for client authentication policies to their tls equivalents
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// TLSServerConfig defines the TLS settings for the exporter's HTTP listener.  The field names follow those used by
+// the prometheus/exporter-toolkit web configuration file.
+type TLSServerConfig struct {
+	CertFile       string     `yaml:"cert_file"`
+	KeyFile        string     `yaml:"key_file"`
+	ClientAuthType string     `yaml:"client_auth_type"`
+	ClientCAFile   string     `yaml:"client_ca_file"`
+	MinVersion     TLSVersion `yaml:"min_version"`
+}
+
+// Enabled returns true if the listener should serve HTTPS
+func (t *TLSServerConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// ClientAuth returns the tls.ClientAuthType corresponding to the configured client_auth_type
+func (t *TLSServerConfig) ClientAuth() tls.ClientAuthType {
+	return clientAuthTypes[t.ClientAuthType]
+}
+
+// validate checks the TLS server config for consistency
+func (t *TLSServerConfig) validate() error {
+	if !t.Enabled() {
+		return nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("both cert_file and key_file must be defined")
+	}
+	if _, ok := clientAuthTypes[t.ClientAuthType]; !ok {
+		return fmt.Errorf("invalid client_auth_type: %s", t.ClientAuthType)
+	}
+	if t.ClientCAFile == "" && (t.ClientAuth() == tls.VerifyClientCertIfGiven || t.ClientAuth() == tls.RequireAndVerifyClientCert) {
+		return fmt.Errorf("client_auth_type %s requires a client_ca_file", t.ClientAuthType)
+	}
+	return nil
+}
+
+// renegotiationPolicies maps the names of TLS renegotiation policies to their tls equivalents
+var renegotiationPolicies = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// TLSClientConfig overrides the TLS settings used when connecting to the API.  Unset fields take the default, or the
+// value from the api block when set on a target.
+type TLSClientConfig struct {
+	// ServerName is used for SNI and to verify the server certificate, e.g. when targets are probed by IP address
+	ServerName string     `yaml:"server_name"`
+	MinVersion TLSVersion `yaml:"min_version"`
+	// CipherSuites are the names of the permitted TLS 1.2 and earlier cipher suites, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.  TLS 1.3 suites aren't configurable.
+	CipherSuites []string `yaml:"cipher_suites"`
+	// Renegotiation is "never", "once" (the default) or "freely"
+	Renegotiation string `yaml:"renegotiation"`
+}
+
+// Merge returns the config with any fields set in override replaced
+func (t TLSClientConfig) Merge(override TLSClientConfig) TLSClientConfig {
+	if override.ServerName != "" {
+		t.ServerName = override.ServerName
+	}
+	if override.MinVersion != 0 {
+		t.MinVersion = override.MinVersion
+	}
+	if len(override.CipherSuites) > 0 {
+		t.CipherSuites = override.CipherSuites
+	}
+	if override.Renegotiation != "" {
+		t.Renegotiation = override.Renegotiation
+	}
+	return t
+}
+
+// Renegotiate returns the tls.RenegotiationSupport corresponding to the configured renegotiation policy
+func (t TLSClientConfig) Renegotiate() tls.RenegotiationSupport {
+	if t.Renegotiation == "" {
+		return tls.RenegotiateOnceAsClient
+	}
+	return renegotiationPolicies[t.Renegotiation]
+}
+
+// Ciphers returns the IDs of the configured cipher suites, or nil if none are configured
+func (t TLSClientConfig) Ciphers() []uint16 {
+	var ids []uint16
+	for _, name := range t.CipherSuites {
+		if id, ok := cipherSuiteID(name); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// cipherSuiteID returns the ID of the named cipher suite.  Insecure suites are accepted as some WebADM appliances
+// only offer legacy ciphers.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			if s.Name == name {
+				return s.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// validate checks the cipher suite and renegotiation policy names
+func (t *TLSClientConfig) validate() error {
+	for _, name := range t.CipherSuites {
+		if _, ok := cipherSuiteID(name); !ok {
+			return fmt.Errorf("unknown cipher suite: %s", name)
+		}
+	}
+	if _, ok := renegotiationPolicies[t.Renegotiation]; t.Renegotiation != "" && !ok {
+		return fmt.Errorf("invalid renegotiation policy: %s", t.Renegotiation)
+	}
+	return nil
+}
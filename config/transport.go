@@ -0,0 +1,31 @@
+package config
+
+// Transport tunes the HTTP transport used to reach the API.  Renegotiation is configured with the TLS settings.
+type Transport struct {
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives *bool `yaml:"disable_keepalives"`
+	// ForceHTTP1 prevents HTTP/2 being negotiated.  It defaults to true as TLS renegotiation, which some WebADM
+	// versions use to request client certificates, isn't possible over HTTP/2.
+	ForceHTTP1 *bool `yaml:"force_http1"`
+}
+
+// Merge returns the transport settings with any fields set in override replaced
+func (t Transport) Merge(override Transport) Transport {
+	if override.DisableKeepAlives != nil {
+		t.DisableKeepAlives = override.DisableKeepAlives
+	}
+	if override.ForceHTTP1 != nil {
+		t.ForceHTTP1 = override.ForceHTTP1
+	}
+	return t
+}
+
+// KeepAlivesDisabled returns the DisableKeepAlives setting, which defaults to false
+func (t Transport) KeepAlivesDisabled() bool {
+	return t.DisableKeepAlives != nil && *t.DisableKeepAlives
+}
+
+// HTTP1Only returns the ForceHTTP1 setting, which defaults to true
+func (t Transport) HTTP1Only() bool {
+	return t.ForceHTTP1 == nil || *t.ForceHTTP1
+}
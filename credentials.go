@@ -0,0 +1,26 @@
+package main
+
+import "context"
+
+// credentialsKey is the context key of the credentials profile selected for a probe
+type credentialsKey struct{}
+
+// withCredentialsProfile returns a context that selects the named credentials profile for the probes made with it
+func withCredentialsProfile(ctx context.Context, profile string) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, profile)
+}
+
+// credentialsProfile returns the credentials profile selected by ctx, or an empty string if there isn't one
+func credentialsProfile(ctx context.Context) string {
+	profile, _ := ctx.Value(credentialsKey{}).(string)
+	return profile
+}
+
+// profileKey qualifies target with the credentials profile selected by ctx, so that cached and shared responses
+// aren't served to probes made with a different account.
+func profileKey(ctx context.Context, target string) string {
+	if profile := credentialsProfile(ctx); profile != "" {
+		return target + "#" + profile
+	}
+	return target
+}
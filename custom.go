@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// customValueTypes maps the configured custom metric types to their Prometheus value types
+var customValueTypes = map[string]prometheus.ValueType{
+	"gauge":   prometheus.GaugeValue,
+	"counter": prometheus.CounterValue,
+	"untyped": prometheus.UntypedValue,
+}
+
+// customMetrics is a collector for the custom metrics gathered during a probe.  It's unchecked as the series depend
+// on the config and on the content of the responses.
+type customMetrics struct {
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+}
+
+func (c *customMetrics) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *customMetrics) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+}
+
+func (c *customMetrics) add(metric prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = append(c.metrics, metric)
+}
+
+// customMetric returns the definition of the named custom metric
+func customMetric(name string) (config.CustomMetric, bool) {
+	for _, c := range cfg().CustomMetrics {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return config.CustomMetric{}, false
+}
+
+// pathMatch is a value found by a custom metric path, along with the keys or indices matched by the path's wildcards
+type pathMatch struct {
+	keys  []string
+	value interface{}
+}
+
+// lookupPath returns the values within v at the given path
+func lookupPath(v interface{}, path []string, keys []string) []pathMatch {
+	if len(path) == 0 {
+		return []pathMatch{{keys: keys, value: v}}
+	}
+	elem, rest := path[0], path[1:]
+	var matches []pathMatch
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if elem != "*" {
+			if child, ok := node[elem]; ok {
+				matches = lookupPath(child, rest, keys)
+			}
+			break
+		}
+		names := make([]string, 0, len(node))
+		for name := range node {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			matches = append(matches, lookupPath(node[name], rest, append(keys[:len(keys):len(keys)], name))...)
+		}
+	case []interface{}:
+		if elem != "*" {
+			if i, err := strconv.Atoi(elem); err == nil && i >= 0 && i < len(node) {
+				matches = lookupPath(node[i], rest, keys)
+			}
+			break
+		}
+		for i, child := range node {
+			matches = append(matches, lookupPath(child, rest, append(keys[:len(keys):len(keys)], strconv.Itoa(i)))...)
+		}
+	}
+	return matches
+}
+
+// labelValue resolves a custom metric's label path within result for a matched value.  The path's wildcards are replaced by the keys
+// that the value's wildcards matched.
+func labelValue(result interface{}, path string, keys []string) string {
+	if ref, ok := strings.CutPrefix(path, "$"); ok {
+		i, _ := strconv.Atoi(ref)
+		return keys[i-1]
+	}
+	elems := config.SplitPath(path)
+	n := 0
+	for i, elem := range elems {
+		if elem == "*" {
+			elems[i] = keys[n]
+			n++
+		}
+	}
+	matches := lookupPath(result, elems, nil)
+	if len(matches) == 0 {
+		return ""
+	}
+	switch v := matches[0].value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// customFloat converts a value within an RPC response to a metric value
+func customFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// customCall returns the RPC call made for a custom metric.  Custom metrics calling the same method with the same
+// parameters share a call.
+func customCall(c config.CustomMetric) rpcCall {
+	var params []interface{}
+	if c.Params != nil {
+		params = append(params, c.Params)
+	}
+	encoded, _ := json.Marshal(params)
+	return rpcCall{key: c.Method + " " + string(encoded), method: c.Method, params: params}
+}
+
+// processCustom adds a series to the custom metrics for each value found at the custom metric's path within response
+func (m *prometheusMetrics) processCustom(c config.CustomMetric, response *jsonrpc.RPCResponse) error {
+	if response == nil {
+		return errors.New("no response received")
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	matches := lookupPath(response.Result, config.SplitPath(c.Value), nil)
+	if len(matches) == 0 {
+		return fmt.Errorf("no value found at %q", c.Value)
+	}
+	names := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	desc := prometheus.NewDesc(addPrefix(c.Name), c.Help, names, nil)
+	for _, match := range matches {
+		value, err := customFloat(match.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", strings.Join(match.keys, "."), err)
+		}
+		labels := make([]string, len(names))
+		for i, name := range names {
+			labels[i] = labelValue(response.Result, c.Labels[name], match.keys)
+		}
+		m.custom.add(prometheus.MustNewConstMetric(desc, customValueTypes[c.Type], value, labels...))
+	}
+	return nil
+}
+
+// descCollector describes a single metric without collecting it, allowing a registry to check it for conflicts
+type descCollector struct {
+	desc *prometheus.Desc
+}
+
+func (d descCollector) Describe(ch chan<- *prometheus.Desc) { ch <- d.desc }
+
+func (d descCollector) Collect(ch chan<- prometheus.Metric) {}
+
+// checkCustomMetrics returns an error if a custom metric has the name of one of the exporter's own metrics, or a
+// label that's added to every metric of a target, as their series would then fail to gather.
+func checkCustomMetrics(c *config.Config) error {
+	probeReg, exporterReg := prometheus.NewRegistry(), prometheus.NewRegistry()
+	initCollectors(probeReg)
+	initExporterCollectors(exporterReg)
+	for _, cm := range c.CustomMetrics {
+		var names []string
+		for name := range cm.Labels {
+			if _, ok := c.Exporter.Labels[name]; ok {
+				return fmt.Errorf("custom metric %s: label %s clashes with the exporter's labels", cm.Name, name)
+			}
+			for _, t := range c.Targets {
+				if _, ok := t.Labels[name]; ok {
+					return fmt.Errorf("custom metric %s: label %s clashes with the labels of target %s", cm.Name, name, t.URL)
+				}
+			}
+			names = append(names, name)
+		}
+		desc := descCollector{prometheus.NewDesc(addPrefix(cm.Name), cm.Help, names, nil)}
+		for _, reg := range []*prometheus.Registry{probeReg, exporterReg} {
+			if err := withConstLabels(reg).Register(desc); err != nil {
+				return fmt.Errorf("custom metric %s: name clashes with one of the exporter's metrics", cm.Name)
+			}
+		}
+	}
+	return nil
+}
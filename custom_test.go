@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+func TestLookupPath(t *testing.T) {
+	var result interface{}
+	decoder := json.NewDecoder(strings.NewReader(`{"domains": [
+		{"name": "Default", "users": 12},
+		{"name": "Staff", "users": "3"}
+	], "queues": {"mail": {"pending": 2}, "sms": {"pending": true}}}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	matches := lookupPath(result, config.SplitPath("domains.*.users"), nil)
+	if len(matches) != 2 {
+		t.Fatalf("Unexpected number of matches. Expected=2, Got=%d", len(matches))
+	}
+	for i, expected := range []struct {
+		name  string
+		value float64
+	}{{"Default", 12}, {"Staff", 3}} {
+		value, err := customFloat(matches[i].value)
+		if err != nil || value != expected.value {
+			t.Errorf("Unexpected value. Expected=%v, Got=%v (%v)", expected.value, value, err)
+		}
+		if name := labelValue(result, "domains.*.name", matches[i].keys); name != expected.name {
+			t.Errorf("Unexpected label. Expected=%s, Got=%s", expected.name, name)
+		}
+	}
+
+	matches = lookupPath(result, config.SplitPath("queues.*.pending"), nil)
+	if len(matches) != 2 {
+		t.Fatalf("Unexpected number of matches. Expected=2, Got=%d", len(matches))
+	}
+	if queue := labelValue(result, "$1", matches[1].keys); queue != "sms" {
+		t.Errorf("Unexpected label. Expected=sms, Got=%s", queue)
+	}
+	if value, _ := customFloat(matches[1].value); value != 1 {
+		t.Errorf("Unexpected value. Expected=1, Got=%v", value)
+	}
+
+	if matches := lookupPath(result, config.SplitPath("domains.5.users"), nil); len(matches) != 0 {
+		t.Errorf("Unexpected matches for an out of range index: %v", matches)
+	}
+}
+
+func TestCheckCustomMetrics(t *testing.T) {
+	currentConfig.Store(new(config.Config))
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"queue_pending", true},
+		{"users_active", false},
+		{"probe_call_success", false},
+		{"exporter_probes_total", false},
+	}
+	for _, test := range tests {
+		c := &config.Config{CustomMetrics: []config.CustomMetric{
+			{Name: test.name, Help: "Test", Labels: map[string]string{"queue": "$1"}},
+		}}
+		if err := checkCustomMetrics(c); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for %s: %v", test.name, err)
+		}
+	}
+}
+
+func TestCheckCustomMetricLabels(t *testing.T) {
+	currentConfig.Store(new(config.Config))
+	tests := []struct {
+		label string
+		valid bool
+	}{
+		{"queue", true},
+		{"datacenter", false},
+		{"environment", false},
+	}
+	for _, test := range tests {
+		c := &config.Config{
+			CustomMetrics: []config.CustomMetric{
+				{Name: "queue_pending", Help: "Test", Labels: map[string]string{test.label: "$1"}},
+			},
+			Targets: []config.Target{{URL: "https://otp.example.com", Labels: map[string]string{"datacenter": "dc1"}}},
+		}
+		c.Exporter.Labels = map[string]string{"environment": "prod"}
+		if err := checkCustomMetrics(c); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for a label named %s: %v", test.label, err)
+		}
+	}
+}
+
+func TestCustomCall(t *testing.T) {
+	a := config.CustomMetric{Name: "a", Method: "Count_Users", Params: map[string]interface{}{"domain": "Default"}}
+	b := config.CustomMetric{Name: "b", Method: "Count_Users", Params: map[string]interface{}{"domain": "Default"}}
+	c := config.CustomMetric{Name: "c", Method: "Count_Users", Params: map[string]interface{}{"domain": "Staff"}}
+	if customCall(a).key != customCall(b).key {
+		t.Errorf("Identical calls have different keys: %s, %s", customCall(a).key, customCall(b).key)
+	}
+	if customCall(a).key == customCall(c).key {
+		t.Errorf("Calls with different params share the key %s", customCall(a).key)
+	}
+	if customCall(a).key == "Count_Users" {
+		t.Error("Custom call key clashes with that of the built-in method")
+	}
+}
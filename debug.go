@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// redactedKeys are substrings of response field names whose values are withheld from debug output
+var redactedKeys = []string{"password", "secret", "passphrase"}
+
+// debugf appends a line to the probe's debug log, if one has been requested.
+func (m *prometheusMetrics) debugf(format string, args ...interface{}) {
+	if m.debugLog == nil {
+		return
+	}
+	fmt.Fprintf(m.debugLog, "%s %s\n", time.Now().Format("15:04:05.000"), redactString(fmt.Sprintf(format, args...)))
+}
+
+// debugResponse appends a decoded RPC response to the probe's debug log, with any secrets redacted.
+func (m *prometheusMetrics) debugResponse(method string, response *jsonrpc.RPCResponse) {
+	if m.debugLog == nil {
+		return
+	}
+	switch {
+	case response == nil:
+		m.debugf("%s: no response received", method)
+	case response.Error != nil:
+		m.debugf("%s: error response: %v", method, response.Error)
+	default:
+		b, err := json.MarshalIndent(redact(response.Result), "", "  ")
+		if err != nil {
+			m.debugf("%s: unable to encode response: %v", method, err)
+			return
+		}
+		m.debugf("%s: response:\n%s", method, b)
+	}
+}
+
+// redact returns a copy of a decoded JSON value in which the values of any sensitive fields have been replaced.
+func redact(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = redact(item)
+			for _, r := range redactedKeys {
+				if strings.Contains(strings.ToLower(k), r) {
+					out[k] = "<redacted>"
+					break
+				}
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redact(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest challenge
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// parseDigestChallenge parses a WWW-Authenticate header.  It returns nil if the header isn't a digest challenge.
+func parseDigestChallenge(header string) *digestChallenge {
+	scheme, params, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return nil
+	}
+	c := new(digestChallenge)
+	for _, p := range splitDigestParams(params) {
+		k, v, _ := strings.Cut(p, "=")
+		v = strings.Trim(v, `"`)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "realm":
+			c.realm = v
+		case "nonce":
+			c.nonce = v
+		case "opaque":
+			c.opaque = v
+		case "algorithm":
+			c.algorithm = v
+		case "qop":
+			// Only auth is supported; auth-int would require hashing the body
+			for _, q := range strings.Split(v, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					c.qop = "auth"
+				}
+			}
+		}
+	}
+	if c.nonce == "" {
+		return nil
+	}
+	return c
+}
+
+// splitDigestParams splits challenge parameters on commas outside quoted strings
+func splitDigestParams(s string) []string {
+	var params []string
+	var quoted bool
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(params, s[start:])
+}
+
+// hash returns the hash function for the challenge's algorithm, and whether session keys are used
+func (c *digestChallenge) hash() (func() hash.Hash, bool, error) {
+	algorithm := strings.ToUpper(c.algorithm)
+	sess := strings.HasSuffix(algorithm, "-SESS")
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		return md5.New, sess, nil
+	case "SHA-256":
+		return sha256.New, sess, nil
+	}
+	return nil, false, fmt.Errorf("unsupported digest algorithm: %s", c.algorithm)
+}
+
+// newCnonce returns a random client nonce
+func newCnonce() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// digestQuote returns s as a quoted-string, escaping quotes and backslashes
+func digestQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// authorization returns the Authorization header for a request, as described in RFC 7616
+func (c *digestChallenge) authorization(username, password, method, uri, cnonce string, nc uint32) (string, error) {
+	newHash, sess, err := c.hash()
+	if err != nil {
+		return "", err
+	}
+	h := func(s string) string {
+		hh := newHash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if sess {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	ncs := fmt.Sprintf("%08x", nc)
+	var response string
+	if c.qop != "" {
+		response = h(strings.Join([]string{ha1, c.nonce, ncs, cnonce, c.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+	fields := []string{
+		"username=" + digestQuote(username),
+		"realm=" + digestQuote(c.realm),
+		"nonce=" + digestQuote(c.nonce),
+		"uri=" + digestQuote(uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		fields = append(fields, "opaque="+digestQuote(c.opaque))
+	}
+	if c.qop != "" {
+		fields = append(fields, "qop="+c.qop, "nc="+ncs, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// digestTransport authenticates requests with HTTP digest authentication.  The most recent challenge is reused for
+// later requests so that only the first request, or one whose nonce has expired, is sent twice.
+type digestTransport struct {
+	next http.RoundTripper
+	// target and profile select the credentials
+	target  string
+	profile string
+	mu      sync.Mutex
+	// challenge is nil until the server has issued one
+	challenge *digestChallenge
+	nc        uint32
+}
+
+// authorize adds an Authorization header to req if a challenge has been received
+func (t *digestTransport) authorize(req *http.Request) error {
+	t.mu.Lock()
+	c := t.challenge
+	t.nc++
+	nc := t.nc
+	t.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	cnonce, err := newCnonce()
+	if err != nil {
+		return err
+	}
+	username, password := apiCredentials(t.target, t.profile)
+	auth, err := c.authorization(username, password, req.Method, req.URL.RequestURI(), cnonce, nc)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	return nil
+}
+
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	first := req.Clone(req.Context())
+	if err := t.authorize(first); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(first)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	c := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if c == nil || req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	t.mu.Lock()
+	t.challenge = c
+	t.nc = 0
+	t.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.authorize(retry); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(retry)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+func TestDigestAuthorization(t *testing.T) {
+	// Test vectors from RFC 7616 section 3.9.1
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		c := parseDigestChallenge(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` +
+			tt.algorithm + `, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+			`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+		if c == nil {
+			t.Fatalf("Unable to parse %s challenge", tt.algorithm)
+		}
+		auth, err := c.authorization("Mufasa", "Circle of Life", http.MethodGet, "/dir/index.html",
+			"f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !strings.Contains(auth, `response="`+tt.expected+`"`) {
+			t.Errorf("Unexpected %s response.  Expected=%s, Got=%s", tt.algorithm, tt.expected, auth)
+		}
+		if !strings.Contains(auth, "nc=00000001") || !strings.Contains(auth, "qop=auth,") {
+			t.Errorf("Unexpected %s qop fields: %s", tt.algorithm, auth)
+		}
+	}
+}
+
+func TestDigestQuote(t *testing.T) {
+	c := &digestChallenge{realm: "r", nonce: "n"}
+	auth, err := c.authorization(`dom\"user`, "p", http.MethodGet, "/", "c", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `username="dom\\\"user"`
+	if !strings.Contains(auth, expected) {
+		t.Errorf("Unexpected username.  Expected=%s, Got=%s", expected, auth)
+	}
+}
+
+func TestDigestTransport(t *testing.T) {
+	c := new(config.Config)
+	c.API.Username = "admin"
+	c.API.Password = "secret"
+	currentConfig.Store(c)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Digest ") || !strings.Contains(auth, `username="admin"`) ||
+			!strings.Contains(auth, `nonce="abc"`) {
+			w.Header().Set("WWW-Authenticate", `Digest realm="webadm", qop="auth", nonce="abc"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &digestTransport{next: http.DefaultTransport, target: server.URL}}
+	for i, expected := range []int{2, 3} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/manag/", strings.NewReader("{}"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status of request %d.  Expected=%d, Got=%d", i, http.StatusOK, resp.StatusCode)
+		}
+		// Only the first request is challenged; the second reuses the challenge
+		if requests != expected {
+			t.Errorf("Unexpected requests after request %d.  Expected=%d, Got=%d", i, expected, requests)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// filterGatherer applies the configured metric filters to the metrics gathered from a Gatherer
+type filterGatherer struct {
+	prometheus.Gatherer
+	filters []config.MetricFilter
+}
+
+// withMetricFilters wraps g so that the configured metric filters are applied to the metrics it gathers.
+func withMetricFilters(g prometheus.Gatherer) prometheus.Gatherer {
+	if len(cfg().Exporter.MetricFilters) == 0 {
+		return g
+	}
+	return filterGatherer{Gatherer: g, filters: cfg().Exporter.MetricFilters}
+}
+
+func (g filterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	return filterFamilies(families, g.filters), err
+}
+
+// filterFamilies applies filters to the series of families.  Families left without any series are removed, as are
+// series that become duplicates of another once their labels are rewritten.
+func filterFamilies(families []*dto.MetricFamily, filters []config.MetricFilter) []*dto.MetricFamily {
+	var filtered []*dto.MetricFamily
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		seen := make(map[string]bool)
+		for _, m := range mf.GetMetric() {
+			labels, keep := filterLabels(mf.GetName(), m.GetLabel(), filters)
+			if !keep {
+				continue
+			}
+			key := seriesKey(labels)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			m.Label = labels
+			metrics = append(metrics, m)
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered
+}
+
+// filterLabels applies filters to a series of the named metric, returning its new labels and whether it's kept
+func filterLabels(name string, labels []*dto.LabelPair, filters []config.MetricFilter) ([]*dto.LabelPair, bool) {
+	for _, f := range filters {
+		value, ok := seriesLabel(labels, f.Label)
+		switch f.Action {
+		case "keep":
+			if !f.Matches(name, value, ok) {
+				return nil, false
+			}
+		case "drop":
+			if f.Matches(name, value, ok) {
+				return nil, false
+			}
+		case "labeldrop":
+			if ok && f.MetricRE.MatchString(name) {
+				labels = setLabel(labels, f.Label, "")
+			}
+		case "replace":
+			if ok && f.Matches(name, value, ok) {
+				replaced := f.RegexRE.ReplaceAllString(value, f.Replacement)
+				labels = setLabel(labels, f.Label, replaced)
+			}
+		}
+	}
+	return labels, true
+}
+
+// seriesLabel returns the value of the named label and whether it's present
+func seriesLabel(labels []*dto.LabelPair, name string) (string, bool) {
+	for _, l := range labels {
+		if l.GetName() == name {
+			return l.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// setLabel returns a copy of labels with the value of the named label replaced.  An empty value removes the label.
+func setLabel(labels []*dto.LabelPair, name, value string) []*dto.LabelPair {
+	var updated []*dto.LabelPair
+	for _, l := range labels {
+		if l.GetName() != name {
+			updated = append(updated, l)
+		} else if value != "" {
+			labelName, labelValue := name, value
+			updated = append(updated, &dto.LabelPair{Name: &labelName, Value: &labelValue})
+		}
+	}
+	return updated
+}
+
+// seriesKey returns a string identifying a series by its labels
+func seriesKey(labels []*dto.LabelPair) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.GetName() + "\x00" + l.GetValue()
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
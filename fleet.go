@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fleetGatherer adds fleet-wide rollups of the license metrics, and the consistency of each cluster, to those gathered
+// from the targets.  The nodes of a cluster share a license, and the users of their shared directory, so summing the
+// per-target metrics would count them once per node.  Instead, each license is counted once, using the highest value
+// reported by the targets that share it, and the licenses of each customer are then summed.
+type fleetGatherer struct {
+	prometheus.Gatherers
+}
+
+// licenseKey identifies a license by its customer and instance IDs
+type licenseKey struct {
+	customer string
+	instance string
+}
+
+func (g fleetGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherers.Gather()
+	fleet, fleetErr := fleetRollups(families).Gather()
+	if fleetErr != nil {
+		return families, fleetErr
+	}
+	families = append(families, fleet...)
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, err
+}
+
+// fleetRollups returns a registry containing the fleet-wide totals of the license metrics in families
+func fleetRollups(families []*dto.MetricFamily) *prometheus.Registry {
+	// licenses maps each target to the license it reported
+	licenses := make(map[string]licenseKey)
+	activeUsers := make(map[string]float64)
+	// versions maps each target to the OpenOTP and WebADM versions it reported
+	versions := make(map[string]string)
+	maxUsers := make(map[string]map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			target, ok := labels["target"]
+			if !ok {
+				continue
+			}
+			switch mf.GetName() {
+			case addPrefix("license_info"):
+				licenses[target] = licenseKey{customer: labels["customer"], instance: labels["instance"]}
+			case addPrefix("server_info"):
+				versions[target] = labels["version"] + " " + labels["webadm_version"]
+			case addPrefix("users_active"):
+				activeUsers[target] = m.GetGauge().GetValue()
+			case addPrefix("license_users_max"):
+				if maxUsers[target] == nil {
+					maxUsers[target] = make(map[string]float64)
+				}
+				maxUsers[target][labels["product"]] = m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	// Take the highest value reported for each license
+	licenseActive := make(map[licenseKey]float64)
+	licenseMax := make(map[licenseKey]map[string]float64)
+	for target, license := range licenses {
+		if users, ok := activeUsers[target]; ok && users > licenseActive[license] {
+			licenseActive[license] = users
+		}
+		if licenseMax[license] == nil {
+			licenseMax[license] = make(map[string]float64)
+		}
+		for product, users := range maxUsers[target] {
+			if current, ok := licenseMax[license][product]; !ok || users > current {
+				licenseMax[license][product] = users
+			}
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	wrapped := withConstLabels(reg)
+	fleetActive := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("fleet_users_active_total"),
+			Help: "Number of license-consuming users across the fleet, counting each license once",
+		},
+		[]string{"customer"},
+	)
+	wrapped.MustRegister(fleetActive)
+	fleetMax := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("fleet_license_users_max_total"),
+			Help: "Maximum number of users permitted for each product across the fleet, counting each license once",
+		},
+		[]string{"customer", "product"},
+	)
+	wrapped.MustRegister(fleetMax)
+	for license, users := range licenseActive {
+		fleetActive.WithLabelValues(license.customer).Add(users)
+	}
+	// A product with an unlimited license is unlimited across the fleet, rather than having the total of the
+	// limited licenses.
+	unlimited := *cfg().Exporter.UnlimitedUsers
+	type customerProduct struct{ customer, product string }
+	totals := make(map[customerProduct]float64)
+	unlimitedProducts := make(map[customerProduct]bool)
+	for license, products := range licenseMax {
+		for product, users := range products {
+			key := customerProduct{license.customer, product}
+			if users == unlimited {
+				unlimitedProducts[key] = true
+			}
+			totals[key] += users
+		}
+	}
+	for key, users := range totals {
+		if unlimitedProducts[key] {
+			users = unlimited
+		}
+		fleetMax.WithLabelValues(key.customer, key.product).Set(users)
+	}
+
+	clusterMismatch := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("cluster_version_mismatch"),
+			Help: "Whether or not the nodes of the cluster report different OpenOTP or WebADM versions",
+		},
+		[]string{"cluster"},
+	)
+	wrapped.MustRegister(clusterMismatch)
+	clusterVersions := make(map[string]map[string]bool)
+	for _, t := range allTargets() {
+		if t.Cluster == "" {
+			continue
+		}
+		if clusterVersions[t.Cluster] == nil {
+			clusterVersions[t.Cluster] = make(map[string]bool)
+		}
+		// Nodes that didn't report their version, e.g. because they're down, are ignored.
+		if v, ok := versions[t.URL]; ok {
+			clusterVersions[t.Cluster][v] = true
+		}
+	}
+	for cluster, v := range clusterVersions {
+		clusterMismatch.WithLabelValues(cluster).Set(boolToFloat(len(v) > 1))
+	}
+	return reg
+}
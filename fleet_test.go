@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fleetGauge returns a gauge for the fleet tests, registered in reg
+func fleetGauge(reg *prometheus.Registry, name string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: addPrefix(name), Help: name}, labels)
+	reg.MustRegister(g)
+	return g
+}
+
+// fleetValues returns the values of the named metric, keyed by the value of label
+func fleetValues(t *testing.T, reg *prometheus.Registry, name, label string) map[string]float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range families {
+		if mf.GetName() != addPrefix(name) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			values[fleetLabel(m, label)] = m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func fleetLabel(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestFleetRollups(t *testing.T) {
+	c := new(config.Config)
+	unlimited := -1.0
+	c.Exporter.UnlimitedUsers = &unlimited
+	currentConfig.Store(c)
+
+	reg := prometheus.NewRegistry()
+	info := fleetGauge(reg, "license_info", "target", "customer", "instance")
+	active := fleetGauge(reg, "users_active", "target")
+	maxUsers := fleetGauge(reg, "license_users_max", "target", "product")
+	// node1 and node2 share a license, node3 has another license of the same customer
+	info.WithLabelValues("node1", "acme", "1").Set(1)
+	info.WithLabelValues("node2", "acme", "1").Set(1)
+	info.WithLabelValues("node3", "acme", "2").Set(1)
+	active.WithLabelValues("node1").Set(10)
+	active.WithLabelValues("node2").Set(12)
+	active.WithLabelValues("node3").Set(5)
+	maxUsers.WithLabelValues("node1", "OpenOTP").Set(100)
+	maxUsers.WithLabelValues("node2", "OpenOTP").Set(100)
+	maxUsers.WithLabelValues("node3", "OpenOTP").Set(50)
+	maxUsers.WithLabelValues("node1", "SpanKey").Set(20)
+	maxUsers.WithLabelValues("node3", "SpanKey").Set(unlimited)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fleet := fleetRollups(families)
+
+	if got := fleetValues(t, fleet, "fleet_users_active_total", "customer")["acme"]; got != 17 {
+		t.Errorf("Unexpected active users.  Expected=%v, Got=%v", 17, got)
+	}
+	expected := map[string]float64{"OpenOTP": 150, "SpanKey": unlimited}
+	got := fleetValues(t, fleet, "fleet_license_users_max_total", "product")
+	for product, users := range expected {
+		if got[product] != users {
+			t.Errorf("Unexpected %s max users.  Expected=%v, Got=%v", product, users, got[product])
+		}
+	}
+}
+
+func TestClusterVersionMismatch(t *testing.T) {
+	c := new(config.Config)
+	unlimited := -1.0
+	c.Exporter.UnlimitedUsers = &unlimited
+	c.Targets = []config.Target{
+		{URL: "a1", Cluster: "a"},
+		{URL: "a2", Cluster: "a"},
+		{URL: "b1", Cluster: "b"},
+		{URL: "b2", Cluster: "b"},
+		// b3 is down so it reports no version
+		{URL: "b3", Cluster: "b"},
+	}
+	currentConfig.Store(c)
+
+	reg := prometheus.NewRegistry()
+	info := fleetGauge(reg, "server_info", "target", "version", "webadm_version")
+	info.WithLabelValues("a1", "2.1.0", "2.3.0").Set(1)
+	info.WithLabelValues("a2", "2.1.1", "2.3.0").Set(1)
+	info.WithLabelValues("b1", "2.1.0", "2.3.0").Set(1)
+	info.WithLabelValues("b2", "2.1.0", "2.3.0").Set(1)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]float64{"a": 1, "b": 0}
+	got := fleetValues(t, fleetRollups(families), "cluster_version_mismatch", "cluster")
+	for cluster, mismatch := range expected {
+		if got[cluster] != mismatch {
+			t.Errorf("Unexpected mismatch of cluster %s.  Expected=%v, Got=%v", cluster, mismatch, got[cluster])
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// batchResult is the outcome of calling a set of methods on a target
+type batchResult struct {
+	responses map[string]*jsonrpc.RPCResponse
+	// durations are the time taken by each call when they're made individually
+	durations map[string]float64
+	// batchDuration is the time taken by the batch when the calls are batched
+	batchDuration float64
+	// trace and oversize record the connections made by the calls and whether a response was too large, so that
+	// every probe sharing the result reports them
+	trace    *probeTrace
+	oversize bool
+}
+
+// flight is a set of RPC calls in progress
+type flight struct {
+	done   chan struct{}
+	result *batchResult
+	err    error
+	// waiters is the number of callers waiting for the result.  The calls are cancelled if they all give up.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup ensures that only one set of RPC calls is in progress for each key.  Callers that arrive while the calls
+// are in progress wait for, and share, their result.  A successful result may also be retained for a short window so
+// that identical probes arriving just afterwards, typically from the other member of an HA Prometheus pair, share it
+// too.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+var inflight = &flightGroup{flights: make(map[string]*flight)}
+
+// do calls fn, unless a call with the same key is already in progress or completed successfully within window, in
+// which case it waits for that call to complete or for ctx to expire.  The shared return value is true if the result
+// came from another caller's call.
+//
+// fn is called with a context that keeps the values of ctx but isn't cancelled with it, so that the first caller
+// giving up doesn't fail the others.  It's cancelled once every caller has given up, or after the API timeout.
+func (g *flightGroup) do(ctx context.Context, key string, window time.Duration, fn func(context.Context) (*batchResult, error)) (*batchResult, bool, error) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if !shared {
+		var fnCtx context.Context
+		var cancel context.CancelFunc
+		if timeout := cfg().API.Timeout; timeout > 0 {
+			fnCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		} else {
+			fnCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+		}
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			f.result, f.err = fn(fnCtx)
+			cancel()
+			close(f.done)
+			if f.err != nil || window <= 0 {
+				g.forget(key, f)
+			} else {
+				time.AfterFunc(window, func() { g.forget(key, f) })
+			}
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, shared, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		select {
+		case <-f.done:
+			// A completed result is retained for the window regardless
+		default:
+			if f.waiters == 0 {
+				// Later callers start afresh rather than sharing the cancelled calls
+				f.cancel()
+				if g.flights[key] == f {
+					delete(g.flights, key)
+				}
+			}
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// forget removes f from the group, unless it has already been replaced by a later flight
+func (g *flightGroup) forget(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+func TestFlightCancelledCaller(t *testing.T) {
+	c := new(config.Config)
+	c.API.Timeout = 5 * time.Second
+	currentConfig.Store(c)
+	g := &flightGroup{flights: make(map[string]*flight)}
+	started, release := make(chan struct{}), make(chan struct{})
+	fn := func(ctx context.Context) (*batchResult, error) {
+		close(started)
+		<-release
+		// The first caller has given up, but the calls continue for the second
+		return &batchResult{oversize: true}, ctx.Err()
+	}
+
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, _, err := g.do(firstCtx, "key", 0, fn)
+		firstErr <- err
+	}()
+	<-started
+	type outcome struct {
+		result *batchResult
+		shared bool
+		err    error
+	}
+	second := make(chan outcome)
+	go func() {
+		result, shared, err := g.do(context.Background(), "key", 0, fn)
+		second <- outcome{result, shared, err}
+	}()
+	// Wait for the second caller to join the flight before the first gives up
+	for {
+		g.mu.Lock()
+		waiters := g.flights["key"].waiters
+		g.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("Unexpected error of the cancelled caller.  Expected=%v, Got=%v", context.Canceled, err)
+	}
+	close(release)
+	o := <-second
+	if o.err != nil || !o.shared || o.result == nil || !o.result.oversize {
+		t.Errorf("Unexpected result of the waiting caller: %+v", o)
+	}
+}
+
+func TestFlightAbandoned(t *testing.T) {
+	c := new(config.Config)
+	c.API.Timeout = 5 * time.Second
+	currentConfig.Store(c)
+	g := &flightGroup{flights: make(map[string]*flight)}
+	cancelled := make(chan error)
+	fn := func(ctx context.Context) (*batchResult, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := g.do(ctx, "key", 0, fn); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error.  Expected=%v, Got=%v", context.DeadlineExceeded, err)
+	}
+	// The calls are cancelled once their only caller has given up, rather than running until the API timeout
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("Unexpected flight error.  Expected=%v, Got=%v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Abandoned flight wasn't cancelled")
+	}
+}
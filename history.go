@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// probeRecord summarises a single probe
+type probeRecord struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// probeHistory holds the most recent probes of each target in a ring buffer
+type probeHistory struct {
+	mu      sync.Mutex
+	targets map[string][]probeRecord
+}
+
+var history = &probeHistory{targets: make(map[string][]probeRecord)}
+
+// add records a probe of target, discarding the oldest record once the configured history size is exceeded.
+func (h *probeHistory) add(target string, r probeRecord) {
+	size := cfg().Exporter.ProbeHistory
+	if size <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := append(h.targets[target], r)
+	if len(records) > size {
+		records = records[len(records)-size:]
+	}
+	h.targets[target] = records
+}
+
+// snapshot returns a copy of the history of every target, with the most recent probe first.
+func (h *probeHistory) snapshot() map[string][]probeRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := make(map[string][]probeRecord, len(h.targets))
+	for target, records := range h.targets {
+		reversed := make([]probeRecord, len(records))
+		for i, r := range records {
+			reversed[len(records)-1-i] = r
+		}
+		snap[target] = reversed
+	}
+	return snap
+}
+
+var historyTemplate = template.Must(template.New("probes").Parse(`<!DOCTYPE html>
+<html>
+<head><title>OpenOTP Exporter: Recent Probes</title></head>
+<body>
+<h1>Recent Probes</h1>
+{{range .}}
+<h2>{{.Target}}</h2>
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>Duration</th><th>Result</th><th>Error</th></tr>
+{{range .Records}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{printf "%.3fs" .Duration}}</td><td>{{if .Success}}success{{else}}failure{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No probes have been performed.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// historyHandler serves the recent probe history as HTML, or as JSON if format=json is requested.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	snap := history.snapshot()
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snap); err != nil {
+			httpLog.Warn("Unable to write probe history", "err", err)
+		}
+		return
+	}
+	type targetHistory struct {
+		Target  string
+		Records []probeRecord
+	}
+	targets := make([]targetHistory, 0, len(snap))
+	for target, records := range snap {
+		targets = append(targets, targetHistory{Target: target, Records: records})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Target < targets[j].Target })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := historyTemplate.Execute(w, targets); err != nil {
+		httpLog.Warn("Unable to write probe history", "err", err)
+	}
+}
@@ -0,0 +1,133 @@
+//go:build kerberos
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Kerberos authentication negotiates with a service ticket, as described in RFC 4559.  The client logs in with the
+// key in its keytab and obtains, caches and renews its tickets in memory, so no credentials cache is written.
+
+// kerberosClients holds a logged in client for each keytab, principal and krb5.conf, so that their tickets are shared
+// by all targets
+var kerberosClients = struct {
+	sync.Mutex
+	clients map[string]*client.Client
+}{clients: make(map[string]*client.Client)}
+
+// kerberosKey returns the key of the client for auth in kerberosClients
+func kerberosKey(auth config.Auth) string {
+	return auth.Keytab + "\x00" + auth.Principal + "\x00" + auth.Krb5Config
+}
+
+// kerberosClientFor returns the client for auth, logging in the first time it's used
+func kerberosClientFor(auth config.Auth) (*client.Client, error) {
+	kerberosClients.Lock()
+	defer kerberosClients.Unlock()
+	key := kerberosKey(auth)
+	if cl, ok := kerberosClients.clients[key]; ok {
+		return cl, nil
+	}
+	cl, err := newKerberosClient(auth)
+	if err != nil {
+		return nil, err
+	}
+	if err := cl.Login(); err != nil {
+		return nil, fmt.Errorf("kerberos login of %s failed: %v", auth.Principal, err)
+	}
+	rpcLog.Debug("Logged in to Kerberos", "principal", auth.Principal)
+	kerberosClients.clients[key] = cl
+	return cl, nil
+}
+
+// newKerberosClient returns a client for the principal of auth, using the key in its keytab.  The principal's realm
+// defaults to the default realm of the krb5.conf.
+func newKerberosClient(auth config.Auth) (*client.Client, error) {
+	kt, err := keytab.Load(auth.Keytab)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load keytab %s: %v", auth.Keytab, err)
+	}
+	krb5conf, err := krb5config.Load(auth.Krb5Config)
+	// Directives gokrb5 doesn't support, such as includedir, are ignored
+	var unsupported krb5config.UnsupportedDirective
+	if err != nil && !errors.As(err, &unsupported) {
+		return nil, fmt.Errorf("unable to load krb5 config %s: %v", auth.Krb5Config, err)
+	}
+	username, realm, found := strings.Cut(auth.Principal, "@")
+	if !found {
+		realm = krb5conf.LibDefaults.DefaultRealm
+	}
+	if realm == "" {
+		return nil, fmt.Errorf("principal %s has no realm and %s sets no default_realm", auth.Principal, auth.Krb5Config)
+	}
+	// Active Directory doesn't support FAST
+	return client.NewWithKeytab(username, realm, kt, krb5conf, client.DisablePAFXFAST(true)), nil
+}
+
+// checkKerberos returns an error if the keytab or krb5.conf of any Kerberos auth can't be loaded, so that they're
+// reported at startup rather than on every probe
+func checkKerberos(c *config.Config) error {
+	auths := []config.Auth{c.API.Auth}
+	for _, t := range c.Targets {
+		if t.Auth != nil {
+			auths = append(auths, *t.Auth)
+		}
+	}
+	for _, auth := range auths {
+		if auth.Type != "kerberos" {
+			continue
+		}
+		if _, err := newKerberosClient(auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kerberosSPN returns the service principal for target.  It defaults to the HTTP service of the target host.
+func kerberosSPN(spn, target string) string {
+	if spn != "" {
+		return spn
+	}
+	host := target
+	if u, err := url.Parse(target); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return "HTTP/" + host
+}
+
+// negotiateTransport authenticates requests with a Kerberos service ticket
+type negotiateTransport struct {
+	next http.RoundTripper
+	auth config.Auth
+	spn  string
+}
+
+// newNegotiateTransport returns a transport that authenticates requests to target using auth
+func newNegotiateTransport(next http.RoundTripper, auth config.Auth, target string) http.RoundTripper {
+	return &negotiateTransport{next: next, auth: auth, spn: kerberosSPN(auth.SPN, target)}
+}
+
+func (t *negotiateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cl, err := kerberosClientFor(t.auth)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	if err := spnego.SetSPNEGOHeader(cl, req, t.spn); err != nil {
+		return nil, fmt.Errorf("unable to obtain Kerberos ticket for %s: %v", t.spn, err)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,37 @@
+//go:build !kerberos
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// errNoKerberos is returned when Kerberos auth is configured but the exporter was built without Kerberos support
+var errNoKerberos = errors.New("auth type kerberos requires the exporter to be built with -tags kerberos")
+
+// checkKerberos returns an error if any target uses Kerberos auth
+func checkKerberos(c *config.Config) error {
+	if c.API.Auth.Type == "kerberos" {
+		return errNoKerberos
+	}
+	for _, t := range c.Targets {
+		if t.Auth != nil && t.Auth.Type == "kerberos" {
+			return errNoKerberos
+		}
+	}
+	return nil
+}
+
+// negotiateTransport fails every request, as checkKerberos prevents it from being configured
+type negotiateTransport struct{}
+
+func newNegotiateTransport(next http.RoundTripper, auth config.Auth, target string) http.RoundTripper {
+	return negotiateTransport{}
+}
+
+func (negotiateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errNoKerberos
+}
@@ -0,0 +1,124 @@
+//go:build kerberos
+
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/jcmturner/gokrb5/v8/client"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/test"
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
+)
+
+func TestKerberosSPN(t *testing.T) {
+	tests := []struct {
+		spn      string
+		target   string
+		expected string
+	}{
+		{"", "https://otp.example.com:8443/manag/", "HTTP/otp.example.com"},
+		{"HTTP/otp-vip.example.com", "https://otp1.example.com:8443/manag/", "HTTP/otp-vip.example.com"},
+		{"", "otp.example.com", "HTTP/otp.example.com"},
+	}
+	for _, tt := range tests {
+		if got := kerberosSPN(tt.spn, tt.target); got != tt.expected {
+			t.Errorf("Unexpected SPN for %s.  Expected=%s, Got=%s", tt.target, tt.expected, got)
+		}
+	}
+}
+
+// writeKerberosFixtures writes the gokrb5 test keytab and krb5.conf, returning their paths
+func writeKerberosFixtures(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	b, err := hex.DecodeString(testdata.KEYTAB_TESTUSER1_TEST_GOKRB5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt := filepath.Join(dir, "testuser1.keytab")
+	conf := filepath.Join(dir, "krb5.conf")
+	if err := os.WriteFile(kt, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conf, []byte(testdata.KRB5_CONF), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return kt, conf
+}
+
+func TestCheckKerberos(t *testing.T) {
+	kt, conf := writeKerberosFixtures(t)
+	tests := []struct {
+		name  string
+		auth  config.Auth
+		valid bool
+	}{
+		{"fixtures", config.Auth{Type: "kerberos", Keytab: kt, Principal: "testuser1@TEST.GOKRB5", Krb5Config: conf}, true},
+		{"default realm", config.Auth{Type: "kerberos", Keytab: kt, Principal: "testuser1", Krb5Config: conf}, true},
+		{"missing keytab", config.Auth{Type: "kerberos", Keytab: kt + ".missing", Principal: "testuser1", Krb5Config: conf}, false},
+		{"missing krb5.conf", config.Auth{Type: "kerberos", Keytab: kt, Principal: "testuser1", Krb5Config: conf + ".missing"}, false},
+		{"basic", config.Auth{Type: "basic"}, true},
+	}
+	for _, tt := range tests {
+		c := &config.Config{}
+		c.API.Auth = tt.auth
+		if err := checkKerberos(c); (err == nil) != tt.valid {
+			t.Errorf("Unexpected result for %s: %v", tt.name, err)
+		}
+	}
+}
+
+// TestNegotiateTransport logs in to the gokrb5 test KDC, which is run with INTEGRATION=1 and its address in
+// TEST_KDC_ADDR
+func TestNegotiateTransport(t *testing.T) {
+	test.Integration(t)
+	kt, conf := writeKerberosFixtures(t)
+	auth := config.Auth{Type: "kerberos", Keytab: kt, Principal: "testuser1@TEST.GOKRB5", Krb5Config: conf}
+
+	// The client is created with the KDC address of the test environment and added to the cache
+	krb5conf, err := krb5config.NewFromString(testdata.KRB5_CONF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := os.Getenv("TEST_KDC_ADDR")
+	if addr == "" {
+		addr = testdata.KDC_IP_TEST_GOKRB5
+	}
+	krb5conf.Realms[0].KDC = []string{addr + ":" + testdata.KDC_PORT_TEST_GOKRB5}
+	keys, err := keytab.Load(kt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := client.NewWithKeytab("testuser1", "TEST.GOKRB5", keys, krb5conf, client.DisablePAFXFAST(true))
+	if err := cl.Login(); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer cl.Destroy()
+	kerberosClients.Lock()
+	kerberosClients.clients[kerberosKey(auth)] = cl
+	kerberosClients.Unlock()
+
+	var header string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+	auth.SPN = "HTTP/host.test.gokrb5"
+	httpClient := &http.Client{Transport: newNegotiateTransport(http.DefaultTransport, auth, ts.URL)}
+	resp, err := httpClient.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if !strings.HasPrefix(header, "Negotiate ") {
+		t.Errorf("Unexpected Authorization header.  Expected=Negotiate ..., Got=%s", header)
+	}
+}
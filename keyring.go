@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// keyringDefaultAccount is the keyring account used for targets without an entry of their own
+	keyringDefaultAccount = "default"
+	// keyringTimeout limits how long a keyring lookup may take, e.g. if the keyring is waiting to be unlocked
+	keyringTimeout = 5 * time.Second
+)
+
+// keyringEntry is the result of retrieving a password from the keyring.  Failures are cached, as well as passwords,
+// so that an unavailable keyring isn't queried, and logged, on every probe.
+type keyringEntry struct {
+	// ready is closed once the lookup has completed, after which the other fields don't change
+	ready    chan struct{}
+	password string
+	err      error
+	expires  time.Time
+}
+
+// done returns true if the lookup has completed
+func (e *keyringEntry) done() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// keyringCache holds the results of keyring lookups, keyed by target hostname, so that the keyring isn't queried on
+// every probe.
+var keyringCache = struct {
+	sync.Mutex
+	entries map[string]*keyringEntry
+}{entries: make(map[string]*keyringEntry)}
+
+// keyringPassword returns the API password for target from the keyring, falling back to the default account.  If
+// neither entry can be read, the error from the default account is returned.  Concurrent probes of a target share a
+// single lookup, which is made without holding the cache lock.
+func keyringPassword(target string) (string, error) {
+	host := target
+	if u, err := url.Parse(target); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	keyringCache.Lock()
+	e := keyringCache.entries[host]
+	if e != nil && (!e.done() || time.Now().Before(e.expires)) {
+		keyringCache.Unlock()
+		<-e.ready
+		return e.password, e.err
+	}
+	e = &keyringEntry{ready: make(chan struct{})}
+	keyringCache.entries[host] = e
+	keyringCache.Unlock()
+
+	k := cfg().Secrets.Keyring
+	ctx, cancel := context.WithTimeout(context.Background(), keyringTimeout)
+	defer cancel()
+	e.password, e.err = readKeyring(ctx, k.Service, host)
+	if e.err != nil {
+		e.password, e.err = readKeyring(ctx, k.Service, keyringDefaultAccount)
+	}
+	if e.err != nil {
+		rpcLog.Warn("Unable to read the API password from the keyring", "target", target, "err", e.err)
+	}
+	e.expires = time.Now().Add(k.CacheTTL)
+	close(e.ready)
+	return e.password, e.err
+}
+
+// flushKeyring discards the cached passwords, e.g. when the config is reloaded
+func flushKeyring() {
+	keyringCache.Lock()
+	defer keyringCache.Unlock()
+	keyringCache.entries = make(map[string]*keyringEntry)
+}
+
+// keyringSecrets returns the cached keyring passwords for redaction from log output
+func keyringSecrets() []string {
+	keyringCache.Lock()
+	defer keyringCache.Unlock()
+	var secrets []string
+	for _, e := range keyringCache.entries {
+		if e.done() && e.password != "" {
+			secrets = append(secrets, e.password)
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// readKeyring looks up a generic password in the Keychain with the security command.  Entries are stored with:
+// security add-generic-password -s <service> -a <account> -w
+func readKeyring(ctx context.Context, service, account string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "security", "find-generic-password", "-s", service, "-a", account, "-w")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("keychain lookup of %s failed: %s", account, msg)
+		}
+		return "", fmt.Errorf("keychain lookup of %s failed: %v", account, err)
+	}
+	// The password is followed by a newline
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
@@ -0,0 +1,31 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// readKeyring looks up a password in the Secret Service with the secret-tool command.  Entries are stored with:
+// secret-tool store --label=... service <service> account <account>
+func readKeyring(ctx context.Context, service, account string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "secret-tool", "lookup", "service", service, "account", account)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("keyring lookup of %s failed: %s", account, msg)
+		}
+		return "", fmt.Errorf("keyring lookup of %s failed: %v", account, err)
+	}
+	if len(out) == 0 {
+		// secret-tool exits with an error when an entry isn't found, but not in all versions
+		return "", fmt.Errorf("no keyring entry for %s", account)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// serviceAccountDir contains the credentials Kubernetes mounts into each pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// discoveredTargets holds the targets most recently discovered from Kubernetes
+var discoveredTargets atomic.Pointer[[]config.Target]
+
+// allTargets returns the targets defined in the config, plus any discovered from Kubernetes.  A discovered target with
+// the URL of another target is ignored, as each target's metrics may only be registered once.
+func allTargets() []config.Target {
+	targets := cfg().Targets
+	if d := discoveredTargets.Load(); d != nil && cfg().Discovery.Kubernetes.Enabled() {
+		seen := make(map[string]bool)
+		for _, t := range targets {
+			seen[t.URL] = true
+		}
+		targets = append([]config.Target(nil), targets...)
+		for _, t := range *d {
+			if !seen[t.URL] {
+				seen[t.URL] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// kubeList contains the fields of interest from a Kubernetes pod or service list
+type kubeList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// discoverKubernetes lists the pods or services matching the configured label selector and returns them as targets.
+func discoverKubernetes(ctx context.Context, k config.Kubernetes) ([]config.Target, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %v", err)
+	}
+	pemCerts, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in service account CA")
+	}
+	namespace := k.Namespace
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine namespace: %v", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	resource := "pods"
+	if k.Role == "service" {
+		resource = "services"
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(host, port),
+		Path:     fmt.Sprintf("/api/v1/namespaces/%s/%s", namespace, resource),
+		RawQuery: url.Values{"labelSelector": {k.LabelSelector}}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	// The service account CA may be rotated, so the transport isn't retained between refreshes
+	tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes API returned %s", resp.Status)
+	}
+	list := new(kubeList)
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("unable to decode Kubernetes response: %v", err)
+	}
+
+	var targets []config.Target
+	for _, item := range list.Items {
+		t := config.Target{
+			Module: k.Module,
+			Labels: map[string]string{"namespace": item.Metadata.Namespace},
+		}
+		if k.Role == "service" {
+			t.URL = fmt.Sprintf("%s.%s.svc", item.Metadata.Name, item.Metadata.Namespace)
+			t.Labels["service"] = item.Metadata.Name
+		} else {
+			// Pods that aren't running, or haven't been assigned an address, can't be probed.
+			if item.Status.Phase != "Running" || item.Status.PodIP == "" {
+				continue
+			}
+			t.URL = item.Status.PodIP
+			t.Labels["pod"] = item.Metadata.Name
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// refreshKubernetesTargets discovers targets from Kubernetes and stores them for use by subsequent scrapes.
+func refreshKubernetesTargets(k config.Kubernetes) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	targets, err := discoverKubernetes(ctx, k)
+	if err != nil {
+		return err
+	}
+	discoveredTargets.Store(&targets)
+	return nil
+}
+
+// kubernetesDiscoverer periodically refreshes the targets discovered from Kubernetes.  Failures are logged and the
+// previously discovered targets remain in use.
+func kubernetesDiscoverer() {
+	for {
+		k := cfg().Discovery.Kubernetes
+		if !k.Enabled() {
+			// Discovery has been disabled by a config reload.  Check again later in case it's re-enabled.
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(k.RefreshInterval)
+		if err := refreshKubernetesTargets(k); err != nil {
+			discoveryLog.Warn("Unable to discover targets from Kubernetes", "err", err)
+			continue
+		}
+		discoveryLog.Debug("Discovered targets from Kubernetes", "count", len(*discoveredTargets.Load()))
+	}
+}
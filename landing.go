@@ -0,0 +1,57 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>OpenOTP Exporter</title></head>
+<body>
+<h1>OpenOTP Exporter</h1>
+<p>Version: {{.Version}}</p>
+<ul>
+<li><a href="metrics">Metrics</a></li>
+<li><a href="probes">Recent probes</a></li>
+</ul>
+{{if .Probes}}
+<h2>Targets</h2>
+<ul>
+{{range .Probes}}<li><a href="{{.}}">{{.}}</a></li>
+{{end}}</ul>
+{{end}}
+<h2>Configuration</h2>
+{{if .ReloadError}}<p>The last reload failed: {{.ReloadError}}</p>{{end}}
+<p>Last loaded successfully: {{.LastReload.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`))
+
+// landingHandler serves a page describing the exporter at the root URL.  Other unknown paths return 404.
+func landingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Version     string
+		Probes      []string
+		ReloadError error
+		LastReload  time.Time
+	}{Version: version}
+	for _, t := range allTargets() {
+		params := url.Values{"target": {t.URL}, "module": {t.Module}}
+		data.Probes = append(data.Probes, "probe?"+params.Encode())
+	}
+	reloadStatus.Lock()
+	data.ReloadError = reloadStatus.err
+	data.LastReload = reloadStatus.lastSuccess
+	reloadStatus.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, data); err != nil {
+		httpLog.Warn("Unable to write landing page", "err", err)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// BER tags of the LDAP messages used by the directory check (RFC 4511)
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berBoolean     = 0x01
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchResultItem = 0x64
+	ldapSearchResultDone = 0x65
+	ldapSearchReference  = 0x73
+	ldapSimpleAuth       = 0x80
+	ldapFilterEquality   = 0xa3
+	ldapFilterPresent    = 0x87
+
+	ldapSuccess           = 0
+	ldapSizeLimitExceeded = 4
+)
+
+// ldapFilterRE matches the filters supported by the directory check: equality, e.g. (uid=canary), or presence, e.g.
+// (objectClass=*)
+var ldapFilterRE = regexp.MustCompile(`^\(([A-Za-z][A-Za-z0-9.-]*)=([^()*]*|\*)\)$`)
+
+// collectLDAP binds to the directory and performs a search, independently of WebADM, to distinguish WebADM faults
+// from directory faults.
+func (m *prometheusMetrics) collectLDAP(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	start := time.Now()
+	err := checkLDAP(ctx)
+	m.ldapCheckDuration.Set(time.Since(start).Seconds())
+	m.ldapCheckSuccess.Set(boolToFloat(err == nil))
+	if err != nil {
+		return fmt.Errorf("ldap %s: %v", cfg().LDAP.URL, err)
+	}
+	return nil
+}
+
+// checkLDAP performs a simple bind followed by a search for a single entry matching the configured filter
+func checkLDAP(ctx context.Context) error {
+	conn, r, err := ldapBind(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	filter, err := ldapFilter(cfg().LDAP.Filter)
+	if err != nil {
+		return err
+	}
+	search := berTLV(ldapSearchRequest,
+		berString(cfg().LDAP.BaseDN),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 1),    // sizeLimit
+		berInt(berInteger, 0),    // timeLimit
+		[]byte{berBoolean, 1, 0}, // typesOnly
+		filter,
+		// "1.1" requests no attributes
+		berTLV(berSequence, berString("1.1")),
+	)
+	if _, err := conn.Write(ldapMessage(2, search)); err != nil {
+		return err
+	}
+	entries := 0
+	for {
+		tag, op, err := ldapReadMessage(r, 2)
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case ldapSearchResultItem:
+			entries++
+		case ldapSearchReference:
+		case ldapSearchResultDone:
+			conn.Write(ldapMessage(3, []byte{ldapUnbindRequest, 0}))
+			code, msg := ldapResult(op)
+			if code != ldapSuccess && code != ldapSizeLimitExceeded {
+				return fmt.Errorf("search failed (code %d): %s", code, msg)
+			}
+			if entries == 0 {
+				return fmt.Errorf("no entries match %s under %s", cfg().LDAP.Filter, cfg().LDAP.BaseDN)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected response to search: 0x%x", tag)
+		}
+	}
+}
+
+// ldapUserCertificates returns the values of the userCertificate attribute of every entry under the base DN.  An
+// error is returned if the server limits the results, as they'd be incomplete.
+func ldapUserCertificates(ctx context.Context) ([][]byte, error) {
+	conn, r, err := ldapBind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter, err := ldapFilter("(userCertificate=*)")
+	if err != nil {
+		return nil, err
+	}
+	search := berTLV(ldapSearchRequest,
+		berString(cfg().LDAP.BaseDN),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 0),    // sizeLimit
+		berInt(berInteger, 0),    // timeLimit
+		[]byte{berBoolean, 1, 0}, // typesOnly
+		filter,
+		berTLV(berSequence, berString("userCertificate")),
+	)
+	if _, err := conn.Write(ldapMessage(2, search)); err != nil {
+		return nil, err
+	}
+	var certs [][]byte
+	for {
+		tag, op, err := ldapReadMessage(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ldapSearchResultItem:
+			values, err := ldapAttributeValues(op)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, values...)
+		case ldapSearchReference:
+		case ldapSearchResultDone:
+			conn.Write(ldapMessage(3, []byte{ldapUnbindRequest, 0}))
+			if code, msg := ldapResult(op); code != ldapSuccess {
+				return nil, fmt.Errorf("search failed (code %d): %s", code, msg)
+			}
+			return certs, nil
+		default:
+			return nil, fmt.Errorf("unexpected response to search: 0x%x", tag)
+		}
+	}
+}
+
+// ldapAttributeValues returns the values of all the attributes of a SearchResultEntry
+func ldapAttributeValues(op []byte) ([][]byte, error) {
+	// Skip the entry's DN
+	_, _, rest, err := berNext(op)
+	if err != nil {
+		return nil, err
+	}
+	_, attrs, _, err := berNext(rest)
+	if err != nil {
+		return nil, err
+	}
+	var values [][]byte
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = berNext(attrs); err != nil {
+			return nil, err
+		}
+		// Skip the attribute's type
+		_, _, vals, err := berNext(attr)
+		if err != nil {
+			return nil, err
+		}
+		if _, vals, _, err = berNext(vals); err != nil {
+			return nil, err
+		}
+		for len(vals) > 0 {
+			var value []byte
+			if _, value, vals, err = berNext(vals); err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// ldapBind connects to the configured directory and performs a simple bind
+func ldapBind(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	u, err := url.Parse(cfg().LDAP.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme == "ldaps" {
+		tlsConfig, err := ldapTLSConfig(u.Hostname())
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	r := bufio.NewReader(conn)
+
+	bind := berTLV(ldapBindRequest, berInt(berInteger, 3), berString(cfg().LDAP.BindDN),
+		berTLV(ldapSimpleAuth, []byte(cfg().LDAP.BindPassword)))
+	if _, err := conn.Write(ldapMessage(1, bind)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	tag, op, err := ldapReadMessage(r, 1)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if tag != ldapBindResponse {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected response to bind: 0x%x", tag)
+	}
+	if code, msg := ldapResult(op); code != ldapSuccess {
+		conn.Close()
+		return nil, nil, fmt.Errorf("bind as %s failed (code %d): %s", cfg().LDAP.BindDN, code, msg)
+	}
+	return conn, r, nil
+}
+
+// ldapTLSConfig returns the TLS config for an ldaps connection to host
+func ldapTLSConfig(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: cfg().LDAP.InsecureSkipVerify}
+	if cfg().LDAP.CAFile != "" {
+		pemCerts, err := os.ReadFile(cfg().LDAP.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read LDAP CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in LDAP CA file %s", cfg().LDAP.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// ldapFilter encodes an equality or presence filter
+func ldapFilter(filter string) ([]byte, error) {
+	match := ldapFilterRE.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, fmt.Errorf("unsupported filter: %s", filter)
+	}
+	if match[2] == "*" {
+		return berTLV(ldapFilterPresent, []byte(match[1])), nil
+	}
+	return berTLV(ldapFilterEquality, berString(match[1]), berString(match[2])), nil
+}
+
+// ldapMessage wraps a protocol operation in an LDAPMessage envelope
+func ldapMessage(id int, op []byte) []byte {
+	return berTLV(berSequence, berInt(berInteger, id), op)
+}
+
+// ldapReadMessage reads an LDAPMessage with the given ID and returns the tag and content of its protocol operation
+func ldapReadMessage(r *bufio.Reader, id int) (byte, []byte, error) {
+	tag, msg, err := berRead(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != berSequence {
+		return 0, nil, errors.New("malformed LDAP message")
+	}
+	tag, msgID, msg, err := berNext(msg)
+	if err != nil || tag != berInteger || berParseInt(msgID) != id {
+		return 0, nil, errors.New("unexpected LDAP message ID")
+	}
+	tag, op, _, err := berNext(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return tag, op, nil
+}
+
+// ldapResult returns the result code and diagnostic message of an LDAPResult
+func ldapResult(op []byte) (int, string) {
+	_, code, rest, err := berNext(op)
+	if err != nil {
+		return -1, "malformed result"
+	}
+	// Skip the matched DN
+	_, _, rest, err = berNext(rest)
+	if err != nil {
+		return berParseInt(code), ""
+	}
+	_, msg, _, _ := berNext(rest)
+	return berParseInt(code), string(msg)
+}
+
+// berTLV encodes a BER element with the given tag and the concatenation of contents
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var value []byte
+	for _, c := range contents {
+		value = append(value, c...)
+	}
+	out := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+func berString(s string) []byte {
+	return berTLV(berOctetString, []byte(s))
+}
+
+// berInt encodes a non-negative integer or enumeration
+func berInt(tag byte, n int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	// A set high bit would make the value negative
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berParseInt(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+// berLength decodes a BER length from the start of b, returning it and the number of bytes it occupied
+func berLength(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	if b[0] < 0x80 {
+		return int(b[0]), 1, nil
+	}
+	octets := int(b[0] & 0x7f)
+	if octets == 0 || octets > 4 || len(b) < 1+octets {
+		return 0, 0, errors.New("unsupported BER length")
+	}
+	return berParseInt(b[1 : 1+octets]), 1 + octets, nil
+}
+
+// berNext splits the first element from b, returning its tag, its contents and the remainder of b
+func berNext(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	length, n, err := berLength(b[1:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	start := 1 + n
+	if len(b) < start+length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[0], b[start : start+length], b[start+length:], nil
+}
+
+// berRead reads a single element from r
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.Peek(2)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := 2
+	if header[1] >= 0x80 {
+		size += int(header[1] & 0x7f)
+	}
+	header, err = r.Peek(size)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, n, err := berLength(header[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, 1+n+length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1+n:], nil
+}
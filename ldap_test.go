@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBEREncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoded  []byte
+		expected string
+	}{
+		{"empty", berTLV(berOctetString), "0400"},
+		{"string", berString("uid"), "0403756964"},
+		{"zero", berInt(berInteger, 0), "020100"},
+		{"small int", berInt(berInteger, 127), "02017f"},
+		{"high bit", berInt(berInteger, 128), "02020080"},
+		{"two octets", berInt(berInteger, 256), "02020100"},
+		{"enumerated", berInt(berEnumerated, 3), "0a0103"},
+		{"long form", berTLV(berOctetString, make([]byte, 0x80))[:3], "048180"},
+		{"two octet length", berTLV(berOctetString, make([]byte, 0x100))[:4], "04820100"},
+		{"three octet length", berTLV(berOctetString, make([]byte, 0x10000))[:5], "0483010000"},
+		{"message", ldapMessage(1, berTLV(ldapUnbindRequest)), "3005020101" + "4200"},
+		{"equality filter", mustLDAPFilter(t, "(uid=canary)"), "a30d" + "0403756964" + "040663616e617279"},
+		{"presence filter", mustLDAPFilter(t, "(objectClass=*)"), "870b" + hex.EncodeToString([]byte("objectClass"))},
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.encoded); got != test.expected {
+			t.Errorf("%s: Expected=%s, Got=%s", test.name, test.expected, got)
+		}
+	}
+	for _, filter := range []string{"uid=canary", "(uid=can*)", "(&(uid=a)(cn=b))", "(=x)"} {
+		if _, err := ldapFilter(filter); err == nil {
+			t.Errorf("Expected an error for the unsupported filter %s", filter)
+		}
+	}
+}
+
+func mustLDAPFilter(t *testing.T, filter string) []byte {
+	t.Helper()
+	b, err := ldapFilter(filter)
+	if err != nil {
+		t.Fatalf("ldapFilter(%s) returned: %v", filter, err)
+	}
+	return b
+}
+
+func TestBERDecoding(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 20} {
+		tag, contents, rest, err := berNext(append(berInt(berInteger, n), 0xff))
+		if err != nil || tag != berInteger || berParseInt(contents) != n || !bytes.Equal(rest, []byte{0xff}) {
+			t.Errorf("Unable to decode %d: tag=%x, contents=%x, rest=%x, err=%v", n, tag, contents, rest, err)
+		}
+	}
+	for _, size := range []int{0, 0x7f, 0x80, 0x100, 0x10000} {
+		value := strings.Repeat("x", size)
+		tag, contents, err := berRead(bufio.NewReader(bytes.NewReader(berString(value))))
+		if err != nil || tag != berOctetString || string(contents) != value {
+			t.Errorf("Unable to read a %d byte string: tag=%x, err=%v", size, tag, err)
+		}
+	}
+	for _, b := range [][]byte{{}, {0x04}, {0x04, 0x05, 'x'}, {0x04, 0x80}, {0x04, 0x85, 1, 1, 1, 1, 1}} {
+		if _, _, _, err := berNext(b); err == nil {
+			t.Errorf("Expected an error decoding %x", b)
+		}
+	}
+}
+
+func TestLDAPResponse(t *testing.T) {
+	result := berTLV(ldapBindResponse,
+		berInt(berEnumerated, 49), berString(""), berString("invalid credentials"))
+	r := bufio.NewReader(bytes.NewReader(ldapMessage(2, result)))
+	if _, _, err := ldapReadMessage(bufio.NewReader(bytes.NewReader(ldapMessage(2, result))), 3); err == nil {
+		t.Error("Expected an error for an unexpected message ID")
+	}
+	tag, op, err := ldapReadMessage(r, 2)
+	if err != nil {
+		t.Fatalf("ldapReadMessage returned: %v", err)
+	}
+	if tag != ldapBindResponse {
+		t.Errorf("Unexpected tag.  Expected=%x, Got=%x", ldapBindResponse, tag)
+	}
+	if code, msg := ldapResult(op); code != 49 || msg != "invalid credentials" {
+		t.Errorf("Unexpected result.  Expected=49 invalid credentials, Got=%d %s", code, msg)
+	}
+	if code, _ := ldapResult(nil); code != -1 {
+		t.Errorf("Unexpected result code for a malformed result.  Expected=-1, Got=%d", code)
+	}
+}
+
+func TestLDAPAttributeValues(t *testing.T) {
+	attr := func(name string, values ...string) []byte {
+		var vals []byte
+		for _, v := range values {
+			vals = append(vals, berString(v)...)
+		}
+		return berTLV(berSequence, berString(name), berTLV(0x31, vals))
+	}
+	entry := func(attrs ...[]byte) []byte {
+		return berTLV(ldapSearchResultItem, berString("uid=a,dc=example,dc=com"), berTLV(berSequence, attrs...))
+	}
+	tests := []struct {
+		name   string
+		entry  []byte
+		values []string
+	}{
+		{"none", entry(), nil},
+		{"empty", entry(attr("userCertificate")), nil},
+		{"one", entry(attr("userCertificate", "a")), []string{"a"}},
+		{"several", entry(attr("userCertificate", "a", "b"), attr("userCertificate;binary", "c")), []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		_, op, _, err := berNext(test.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := ldapAttributeValues(op)
+		if err != nil {
+			t.Errorf("%s: ldapAttributeValues returned: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, v := range values {
+			got = append(got, string(v))
+		}
+		if strings.Join(got, ",") != strings.Join(test.values, ",") {
+			t.Errorf("%s: Expected=%v, Got=%v", test.name, test.values, got)
+		}
+	}
+	if _, err := ldapAttributeValues([]byte{berOctetString, 5, 'x'}); err == nil {
+		t.Error("Expected an error for a truncated entry")
+	}
+}
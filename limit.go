@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// errProbeLimit is returned when a probe can't start its RPC calls before its deadline because the maximum number of
+// concurrent probes are already in progress.
+var errProbeLimit = errors.New("too many concurrent probes")
+
+// probeSlots is a semaphore limiting the number of concurrent RPC batches.  It's nil when there's no limit.
+var probeSlots atomic.Pointer[chan struct{}]
+
+// setProbeLimit replaces the semaphore if the configured limit has changed.  Batches already holding a slot release it
+// to the semaphore they acquired it from.
+func setProbeLimit(limit int) {
+	current := probeSlots.Load()
+	switch {
+	case limit <= 0:
+		probeSlots.Store(nil)
+	case current == nil || cap(*current) != limit:
+		slots := make(chan struct{}, limit)
+		probeSlots.Store(&slots)
+	}
+}
+
+// acquireProbeSlot waits for a free slot, or for ctx to expire.  The returned function releases the slot.
+func acquireProbeSlot(ctx context.Context) (func(), error) {
+	slots := probeSlots.Load()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case *slots <- struct{}{}:
+		return func() { <-*slots }, nil
+	case <-ctx.Done():
+		return nil, errProbeLimit
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// Levels beyond those defined by slog, retained for compatibility with existing configs
+const (
+	levelTrace = slog.LevelDebug - 4
+	levelFatal = slog.LevelError + 4
+)
+
+// logComponents are the components whose log level may be overridden in the config
+var logComponents = []string{"main", "rpc", "http", "access", "config", "discovery", "vault", "otlp"}
+
+// Loggers for each component
+var (
+	mainLog      = componentLogger("main")
+	rpcLog       = componentLogger("rpc")
+	httpLog      = componentLogger("http")
+	accessLog    = componentLogger("access")
+	configLog    = componentLogger("config")
+	discoveryLog = componentLogger("discovery")
+	vaultLog     = componentLogger("vault")
+	otlpLog      = componentLogger("otlp")
+)
+
+// logLevels are the minimum levels logged by default and by each component
+type logLevels struct {
+	level      slog.Level
+	components map[string]slog.Level
+}
+
+// forComponent returns the minimum level logged by component
+func (l *logLevels) forComponent(component string) slog.Level {
+	if level, ok := l.components[component]; ok {
+		return level
+	}
+	return l.level
+}
+
+// handlerBox allows handlers of different types to be stored in an atomic.Value
+type handlerBox struct {
+	h slog.Handler
+}
+
+var (
+	// currentLevels are swapped when the config is reloaded
+	currentLevels atomic.Pointer[logLevels]
+	// logOutput is the handler that writes log records to the journal, a file or stderr
+	logOutput atomic.Value
+)
+
+func init() {
+	currentLevels.Store(&logLevels{level: slog.LevelInfo})
+	setLogOutput(newTextHandler(os.Stderr))
+	slog.SetDefault(mainLog)
+}
+
+// parseLevel converts a level name from the config into a slog.Level
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return levelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	case "panic", "fatal", "critical":
+		return levelFatal, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+// parseLevels returns the log levels defined in the logging config
+func parseLevels(c config.Logging) (*logLevels, error) {
+	level, err := parseLevel(c.LevelStr)
+	if err != nil {
+		return nil, err
+	}
+	levels := &logLevels{level: level, components: make(map[string]slog.Level)}
+	for component, s := range c.Components {
+		known := false
+		for _, c := range logComponents {
+			known = known || c == component
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown log component: %s", component)
+		}
+		if levels.components[component], err = parseLevel(s); err != nil {
+			return nil, fmt.Errorf("component %s: %v", component, err)
+		}
+	}
+	return levels, nil
+}
+
+// setLogOutput replaces the handler that log records are written to
+func setLogOutput(h slog.Handler) {
+	logOutput.Store(handlerBox{h})
+}
+
+// newTextHandler returns a handler that writes log records to w.  Filtering by level is performed by the component
+// handlers so the text handler accepts everything.
+func newTextHandler(w io.Writer) slog.Handler {
+	return slog.NewTextHandler(w, outputOptions)
+}
+
+// newOutputHandler returns a handler that writes log records to w in the configured format
+func newOutputHandler(w io.Writer, format string) slog.Handler {
+	if format == "json" {
+		return slog.NewJSONHandler(w, outputOptions)
+	}
+	return newTextHandler(w)
+}
+
+var outputOptions = &slog.HandlerOptions{
+	Level: levelTrace,
+	ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		// Name the additional levels, which would otherwise be shown relative to the slog levels.
+		if a.Key == slog.LevelKey && len(groups) == 0 {
+			switch a.Value.Any().(slog.Level) {
+			case levelTrace:
+				a.Value = slog.StringValue("TRACE")
+			case levelFatal:
+				a.Value = slog.StringValue("FATAL")
+			}
+		}
+		return a
+	},
+}
+
+// componentHandler filters log records by the level configured for its component and passes them to the current
+// output handler.
+type componentHandler struct {
+	component string
+	// with applies the attributes and groups added to the logger to the output handler
+	with func(slog.Handler) slog.Handler
+}
+
+func componentLogger(component string) *slog.Logger {
+	return slog.New(&componentHandler{
+		component: component,
+		with: func(h slog.Handler) slog.Handler {
+			return h.WithAttrs([]slog.Attr{slog.String("component", component)})
+		},
+	})
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= currentLevels.Load().forComponent(h.component)
+}
+
+// Handle passes the record to the output handler after removing any credentials from it.
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.with(logOutput.Load().(handlerBox).h).Handle(ctx, redactRecord(r))
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	attrs = redactedAttrs
+	with := h.with
+	return &componentHandler{
+		component: h.component,
+		with:      func(out slog.Handler) slog.Handler { return with(out).WithAttrs(attrs) },
+	}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	with := h.with
+	return &componentHandler{
+		component: h.component,
+		with:      func(out slog.Handler) slog.Handler { return with(out).WithGroup(name) },
+	}
+}
+
+// journalHandler writes log records to the systemd journal.  Attributes are sent as journal fields.
+type journalHandler struct {
+	prefix string
+	fields map[string]string
+}
+
+func newJournalHandler() *journalHandler {
+	return &journalHandler{fields: make(map[string]string)}
+}
+
+func (h *journalHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := make(map[string]string, len(h.fields)+r.NumAttrs())
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addJournalField(fields, h.prefix, a)
+		return true
+	})
+	return journal.Send(r.Message, journalPriority(r.Level), fields)
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := &journalHandler{prefix: h.prefix, fields: make(map[string]string, len(h.fields)+len(attrs))}
+	for k, v := range h.fields {
+		h2.fields[k] = v
+	}
+	for _, a := range attrs {
+		addJournalField(h2.fields, h.prefix, a)
+	}
+	return h2
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{prefix: h.prefix + name + "_", fields: h.fields}
+}
+
+// addJournalField adds an attribute to the journal fields.  Journal field names are restricted to upper case letters,
+// digits and underscores.
+func addJournalField(fields map[string]string, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			addJournalField(fields, prefix+a.Key+"_", ga)
+		}
+		return
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, prefix+a.Key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		return
+	}
+	fields[name] = v.String()
+}
+
+// journalPriority maps slog levels to syslog priorities
+func journalPriority(level slog.Level) journal.Priority {
+	switch {
+	case level >= levelFatal:
+		return journal.PriCrit
+	case level >= slog.LevelError:
+		return journal.PriErr
+	case level >= slog.LevelWarn:
+		return journal.PriWarning
+	case level >= slog.LevelInfo:
+		return journal.PriInfo
+	}
+	return journal.PriDebug
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	mainLog.Log(context.Background(), levelFatal, msg, args...)
+	os.Exit(1)
+}
@@ -1,21 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	stdlog "log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Masterminds/log-go"
-	"github.com/crooks/jlog"
-	loglevel "github.com/crooks/log-go-level"
+	"github.com/coreos/go-systemd/v22/journal"
 	"github.com/crooks/openotp_exporter/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -23,22 +22,36 @@ import (
 )
 
 var (
-	cfg   *config.Config
-	flags *config.Flags
+	flags    *config.Flags
+	exporter *exporterMetrics
 )
 
 // licenseDetailsFields contains an incompleted subset of items returned from the API by "get_license_details".
 type licenseDetailsFields struct {
-	CustomerID   string `json:"customer_id"`
-	ErrorMessage string `json:"error_message"`
-	InstanceID   string `json:"instance_id"`
-	Products     struct {
-		OpenOTP struct {
-			MaximumUsers string `json:"maximum_users"`
-		} `json:"OpenOTP"`
-	} `json:"products"`
-	ValidFrom string `json:"valid_from"`
-	ValidTo   string `json:"valid_to"`
+	CustomerID   string                          `json:"customer_id"`
+	ErrorMessage string                          `json:"error_message"`
+	InstanceID   string                          `json:"instance_id"`
+	Products     map[string]licenseProductFields `json:"products"`
+	Type         string                          `json:"type"`
+	ValidFrom    string                          `json:"valid_from"`
+	ValidTo      string                          `json:"valid_to"`
+	// SupportFrom and SupportTo are the dates of the support contract, where the license includes one
+	SupportFrom string `json:"support_from"`
+	SupportTo   string `json:"support_to"`
+}
+
+// componentStatus is the status of an individual web application or web service, as reported by Server_Status
+type componentStatus struct {
+	Status  bool   `json:"status"`
+	Version string `json:"version"`
+}
+
+// licenseProductFields contains the license details for an individual product, such as OpenOTP or SpanKey.
+type licenseProductFields struct {
+	MaximumUsers string `json:"maximum_users"`
+	// GraceUsers and BurstUsers are the allowances above the soft limit of maximum_users, where the license has them
+	GraceUsers string `json:"grace_users"`
+	BurstUsers string `json:"burst_users"`
 }
 
 type serverStatusFields struct {
@@ -51,8 +64,10 @@ type serverStatusFields struct {
 		Session bool `json:"session"`
 		Sql     bool `json:"sql"`
 	} `json:"servers"`
-	Status  bool   `json:"status"`
-	Version string `json:"version"`
+	Status  bool                       `json:"status"`
+	Version string                     `json:"version"`
+	Webapps map[string]componentStatus `json:"webapps"`
+	Websrvs map[string]componentStatus `json:"websrvs"`
 }
 
 // boolToFloat converts booleans to 1 or 0 for ingestion by Prometheus. 1=Yes, 0=No.
@@ -65,42 +80,85 @@ func boolToFloat(b bool) float64 {
 	return 1
 }
 
+// licenseDateLayouts are the date formats returned by the various WebADM versions.  Those without a zone are in the
+// configured license timezone.
+var licenseDateLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006/01/02 15:04:05",
+	"2006-01-02",
+	"2006/01/02",
+}
+
 // strToEpoch converts OpenOTPs date/time string format to Unix Epoch.
 func strToEpoch(s string) float64 {
-	t, err := time.Parse("2006-01-02 15:04:05", s)
-	if err != nil {
-		log.Warnf("Cannot convert %s to date/time")
-		return 0
+	s = strings.TrimSpace(s)
+	loc := cfg().Exporter.LicenseLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range licenseDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return float64(t.Unix())
+		}
+	}
+	// Some versions return the date as a Unix timestamp
+	if epoch, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return float64(epoch)
 	}
-	return float64(t.Unix())
+	mainLog.Warn("Cannot convert to date/time", "value", s, "layouts", strings.Join(licenseDateLayouts, ", "))
+	return 0
 }
 
-// apiBatchRequests performs a sequence of RPC requests to OpenOTP.  This is preferred to lots of individual requests
-// as OpenOTP uses (horrible) TLS renegotiation.
-func apiBatchRequests(target string) (jsonrpc.RPCResponses, error) {
-	var err error
-	ctx := context.Background()
-	rpcClient := newRPC(target)
-
-	responses, err := rpcClient.CallBatch(ctx, jsonrpc.RPCRequests{
-		jsonrpc.NewRequest("Count_Activated_Users"),
-		jsonrpc.NewRequest("Get_License_Details"),
-		jsonrpc.NewRequest("Server_status", map[string]bool{
+// rpcParams contains the parameters passed to RPC methods that require them.
+var rpcParams = map[string][]interface{}{
+	"Server_Status": {
+		map[string]bool{
 			"servers": true,
 			"webapps": true,
 			"websrvs": true,
-		}),
-	})
+		},
+	},
+}
+
+// rpcCall is an RPC request made by a probe.  Its key identifies the response: the method name for the built-in
+// methods, or the method and its parameters for custom metrics as they may call the same method with different
+// parameters.
+type rpcCall struct {
+	key    string
+	method string
+	params []interface{}
+}
+
+// methodCall returns the call of a built-in method
+func methodCall(method string) rpcCall {
+	return rpcCall{key: method, method: method, params: rpcParams[method]}
+}
+
+// apiBatchRequests performs a sequence of RPC requests to OpenOTP.  This is preferred to lots of individual requests
+// as OpenOTP uses (horrible) TLS renegotiation.  The responses are returned in a map, keyed by call key.  An error is
+// only returned if the batch as a whole failed; errors in individual responses are left for the caller to handle.
+func apiBatchRequests(ctx context.Context, rpcClient jsonrpc.RPCClient, target string, calls []rpcCall) (map[string]*jsonrpc.RPCResponse, error) {
+	requests := make(jsonrpc.RPCRequests, 0, len(calls))
+	for id, call := range calls {
+		requests = append(requests, jsonrpc.NewRequestWithID(id, call.method, call.params...))
+	}
+	responses, err := rpcClient.CallBatch(ctx, requests)
 	if err != nil {
-		return responses, err
+		return nil, err
 	}
-	if responses.HasError() {
-		err = errors.New("RPC request returned errors")
+	if len(responses) != len(calls) {
+		rpcLog.Warn("Unexpected batch response", "target", target, "expected", len(calls), "got", len(responses))
 	}
-	if len(responses) != 3 {
-		err = fmt.Errorf("unexpected batch response from %s.  expected=3, got=%d ", target, len(responses))
+	results := make(map[string]*jsonrpc.RPCResponse)
+	for id, call := range calls {
+		if response := responses.GetByID(id); response != nil {
+			results[call.key] = response
+		}
 	}
-	return responses, err
+	return results, nil
 }
 
 // activeUsers extracts the number of actived users from OpenOTP
@@ -132,139 +190,818 @@ func apiServerStatus(response *jsonrpc.RPCResponse) (*serverStatusFields, error)
 	return status, nil
 }
 
-func (m *prometheusMetrics) probeHandler(w http.ResponseWriter, r *http.Request, reg *prometheus.Registry) {
-	params := r.URL.Query()
-	targetHost := params.Get("target")
-	if targetHost == "" {
-		http.Error(w, "Target parameter missing or empty", http.StatusBadRequest)
-		return
-	}
-	log.Debugf("Probe request: From=%s, Target=%s", r.RemoteAddr, targetHost)
-	target := fmt.Sprintf("%s/%s", targetHost, strings.TrimPrefix(cfg.API.Path, "/"))
+// processors populate the prometheusMetrics from the response to each supported RPC method
+var processors = map[string]func(*prometheusMetrics, *jsonrpc.RPCResponse) error{
+	"Count_Activated_Users": (*prometheusMetrics).processActiveUsers,
+	"Get_License_Details":   (*prometheusMetrics).processLicense,
+	"Server_Status":         (*prometheusMetrics).processServerStatus,
+}
+
+// collectors handle the methods that require more than a single RPC call.  They are called after the main batch.
+var collectors = map[string]func(*prometheusMetrics, context.Context, jsonrpc.RPCClient, string) error{
+	"Count_Domain_Users": (*prometheusMetrics).collectDomainUsers,
+	"Check_Backends":     (*prometheusMetrics).collectBackends,
+	"Check_CA":           (*prometheusMetrics).collectCA,
+	"Check_Auth":         (*prometheusMetrics).collectAuthCanary,
+	"Check_Radius":       (*prometheusMetrics).collectRadius,
+	"Check_LDAP":         (*prometheusMetrics).collectLDAP,
+	"Check_SQL":          (*prometheusMetrics).collectSQL,
+}
+
+// apiCollectors call the target's API through the RPC client, so like the batch they're retried and their outcome is
+// recorded in the target's circuit.  The other collectors check services that may not be the target's.
+var apiCollectors = map[string]bool{
+	"Count_Domain_Users": true,
+}
+
+// probe queries the OpenOTP API at targetHost, using the RPC methods defined in module, and populates the
+// prometheusMetrics with the results.  Metrics are published for every call that succeeded, even if others failed.
+// Responses are served from the cache where a TTL has been configured for the method, unless skipCache is true.  The
+// return value indicates whether the probe was entirely successful.
+func (m *prometheusMetrics) probe(ctx context.Context, targetHost string, module config.Module, skipCache bool) bool {
+	target := apiURL(targetHost)
+	ctx, span := startSpan(ctx, "probe", spanKindInternal)
+	defer span.finish()
+	span.setAttr("target", target)
+	// The batch may be shared with concurrent probes so it traces its own connections, which are added to the probe's
+	// trace.  The collectors' connections are traced through collectCtx.
+	trace := new(probeTrace)
+	collectCtx, oversize := withOversizeFlag(trace.withTrace(ctx))
 	var success float64 = 1
+	// probeErr is the first error encountered, for the probe history
+	var probeErr error
 	start := time.Now()
-	responses, err := apiBatchRequests(target)
+	m.debugf("Probing %s with methods %s", target, strings.Join(module.Methods, ", "))
+	responses := make(map[string]*jsonrpc.RPCResponse)
+	var calls []rpcCall
+	for _, method := range module.Methods {
+		if _, ok := processors[method]; ok {
+			calls = append(calls, methodCall(method))
+		}
+	}
+	for _, name := range module.CustomMetrics {
+		if c, ok := customMetric(name); ok {
+			calls = append(calls, customCall(c))
+		}
+	}
+	var batchCalls []rpcCall
+	var batchMethods []string
+	for _, call := range calls {
+		if _, ok := responses[call.key]; ok {
+			// Custom metrics may share a call with each other
+			continue
+		}
+		if cached := rpcCache.get(profileKey(ctx, target), call.key); cached != nil && !skipCache {
+			rpcLog.Debug("Using cached response", "target", target, "method", call.method)
+			m.debugf("Using cached %s response", call.method)
+			responses[call.key] = cached
+			continue
+		}
+		responses[call.key] = nil
+		batchCalls = append(batchCalls, call)
+		batchMethods = append(batchMethods, call.method)
+	}
+	var collected bool
+	for _, method := range module.Methods {
+		if _, ok := collectors[method]; ok {
+			collected = true
+		}
+	}
+	// calledAPI records whether the target's API was called, and breakerErr the first failure calling it, for the
+	// circuit breaker.  A probe that's served entirely from the cache leaves the circuit unchanged.
+	var calledAPI bool
+	var breakerErr error
+	rpcClient, err := newRPC(target, credentialsProfile(ctx))
+	if err == nil && (len(batchCalls) > 0 || collected) {
+		err = breaker.allow(target)
+	}
+	if err == nil && len(batchCalls) > 0 {
+		if username, _ := apiCredentials(target, credentialsProfile(ctx)); username != "" {
+			m.debugf("Authenticating as %s with password <redacted>", username)
+		}
+		m.debugf("Calling %s", strings.Join(batchMethods, ", "))
+		err = m.callMethods(ctx, rpcClient, target, batchCalls, responses, trace, oversize)
+		// Probes that didn't get to call the API say nothing about the target's health.
+		if !errors.Is(err, errProbeLimit) {
+			calledAPI, breakerErr = true, err
+		}
+		for _, call := range batchCalls {
+			m.debugResponse(call.method, responses[call.key])
+		}
+	}
+	if err == nil && collected {
+		// The collectors make their own calls, which count towards the limit on concurrent probes like the batch's.
+		var release func()
+		if release, err = acquireProbeSlot(ctx); err == nil {
+			defer release()
+		}
+	}
+	if err != nil && oversize.Load() {
+		err = fmt.Errorf("%w: %v", errResponseTooLarge, err)
+	}
 	if err != nil {
+		// There's no point attempting any further calls so mark them all as failed.
 		success = 0
-		log.Warnf("Probe of %s failed with %v", target, err)
+		probeErr = err
+		m.limited = errors.Is(err, errProbeLimit)
+		rpcLog.Warn("Probe failed", "target", target, "err", err)
+		m.debugf("Probe failed: %v", err)
+		for _, method := range module.Methods {
+			m.callSuccess.WithLabelValues(method).Set(0)
+		}
+		for _, name := range module.CustomMetrics {
+			m.customSuccess.WithLabelValues(name).Set(0)
+		}
+		module.Methods = nil
+		module.CustomMetrics = nil
 	}
-	// If the apiBatchResponse was successful, there will be an array of responses to process.
-	if success == 1 {
-		// Activated User Count
-		au, err := apiActiveUsers(responses[0])
-		if err != nil {
-			log.Warn(err)
+	for _, method := range module.Methods {
+		var err error
+		if collect, ok := collectors[method]; ok {
+			callStart := time.Now()
+			if apiCollectors[method] {
+				_, err = withRetry(collectCtx, target, func() (struct{}, error) {
+					return struct{}{}, collect(m, collectCtx, rpcClient, target)
+				})
+				calledAPI = true
+				if breakerErr == nil {
+					breakerErr = err
+				}
+			} else {
+				err = collect(m, collectCtx, rpcClient, target)
+			}
+			m.rpcDuration.WithLabelValues(method).Set(time.Since(callStart).Seconds())
+			m.debugf("%s collected in %s", method, time.Since(callStart))
 		} else {
-			m.usersActive.Set(au)
+			err = m.processCall(method, responses[method])
 		}
-		// Licensed Users Count
-		license, err := apiGetLicenseDetails(responses[1])
 		if err != nil {
-			log.Warn(err)
-		} else {
-			mu, err := strconv.ParseFloat(license.Products.OpenOTP.MaximumUsers, 64)
-			if err != nil {
-				log.Warn(err)
-			} else {
-				m.licenseMaxUsers.WithLabelValues(license.CustomerID, license.InstanceID).Set(mu)
+			success = 0
+			if probeErr == nil {
+				probeErr = fmt.Errorf("%s: %v", method, err)
 			}
-			m.licenseValidFrom.WithLabelValues(license.CustomerID, license.InstanceID).Set(strToEpoch(license.ValidFrom))
-			m.licenseValidTo.WithLabelValues(license.CustomerID, license.InstanceID).Set(strToEpoch(license.ValidTo))
+			rpcLog.Warn("Probe call failed", "target", target, "method", method, "err", err)
+			m.debugf("%s failed: %v", method, err)
+			m.callSuccess.WithLabelValues(method).Set(0)
+			continue
 		}
-		// Server Status
-		ss, err := apiServerStatus(responses[2])
-		if err != nil {
-			log.Warn(err)
-		} else {
-			m.serverEnabled.WithLabelValues(ss.Version).Set(boolToFloat(ss.Enabled))
-			m.serverStatus.WithLabelValues(ss.Version).Set(boolToFloat(ss.Status))
-			m.serverServices.WithLabelValues("ldap").Set(boolToFloat(ss.Servers.Ldap))
-			m.serverServices.WithLabelValues("mail").Set(boolToFloat(ss.Servers.Mail))
-			m.serverServices.WithLabelValues("pki").Set(boolToFloat(ss.Servers.Pki))
-			m.serverServices.WithLabelValues("proxy").Set(boolToFloat(ss.Servers.Proxy))
-			m.serverServices.WithLabelValues("session").Set(boolToFloat(ss.Servers.Session))
-			m.serverServices.WithLabelValues("sql").Set(boolToFloat(ss.Servers.Sql))
+		m.callSuccess.WithLabelValues(method).Set(1)
+	}
+	for _, name := range module.CustomMetrics {
+		c, ok := customMetric(name)
+		if !ok {
+			continue
+		}
+		if err := m.processCustom(c, responses[customCall(c).key]); err != nil {
+			success = 0
+			if probeErr == nil {
+				probeErr = fmt.Errorf("%s: %v", name, err)
+			}
+			rpcLog.Warn("Custom metric failed", "target", target, "metric", name, "err", err)
+			m.debugf("Custom metric %s failed: %v", name, err)
+			m.customSuccess.WithLabelValues(name).Set(0)
+			continue
 		}
+		m.customSuccess.WithLabelValues(name).Set(1)
 	}
+	if calledAPI {
+		breaker.record(target, breakerErr)
+	}
+	trace.record(m)
+	m.recordServerInfo()
 	duration := time.Since(start).Seconds()
 	m.probeSuccess.Set(success)
 	m.probeDuration.Set(duration)
-	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+	m.responseTooLarge.Set(boolToFloat(oversize.Load()))
+	m.debugf("Probe completed in %.3fs, success=%v", duration, success == 1)
+	if exporter != nil {
+		exporter.recordProbe(targetHost, success == 1, duration)
+	}
+	record := probeRecord{Time: start, Duration: duration, Success: success == 1}
+	if probeErr != nil {
+		record.Error = probeErr.Error()
+		span.setError(probeErr)
+	}
+	history.add(targetHost, record)
+	touchTarget(targetHost)
+	return success == 1
+}
+
+// callMethods makes the given calls and adds their responses to the responses map.  Concurrent probes of the same
+// target with the same calls share a single set of requests, as WebADM copes badly with simultaneous TLS
+// renegotiations.  The connections made by the requests are added to trace, and oversize is set if a response was too
+// large, whichever probe made them.
+func (m *prometheusMetrics) callMethods(ctx context.Context, rpcClient jsonrpc.RPCClient, target string, calls []rpcCall, responses map[string]*jsonrpc.RPCResponse, trace *probeTrace, oversize *atomic.Bool) error {
+	keys := make([]string, 0, len(calls))
+	for _, call := range calls {
+		keys = append(keys, call.key)
+	}
+	sort.Strings(keys)
+	key := profileKey(ctx, target) + " " + strings.Join(keys, ",")
+	result, shared, err := inflight.do(ctx, key, cfg().Exporter.DedupWindow, func(ctx context.Context) (*batchResult, error) {
+		return fetchMethods(ctx, rpcClient, target, calls)
+	})
+	if shared && exporter != nil {
+		exporter.coalesced.WithLabelValues(target).Inc()
+	}
+	if result != nil {
+		trace.add(result.trace)
+		if result.oversize {
+			oversize.Store(true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if shared {
+		m.debugf("Sharing responses with a concurrent probe of %s", target)
+	}
+	if result.batchDuration > 0 {
+		m.rpcBatchDuration.Set(result.batchDuration)
+		m.debugf("Batch returned in %.3fs", result.batchDuration)
+	}
+	for _, call := range calls {
+		response, ok := result.responses[call.key]
+		if !ok {
+			continue
+		}
+		if duration, ok := result.durations[call.key]; ok {
+			m.rpcDuration.WithLabelValues(call.method).Set(duration)
+			m.debugf("%s returned in %.3fs", call.method, duration)
+		}
+		responses[call.key] = response
+	}
+	return nil
+}
+
+// fetchMethods makes the given calls to target.  Normally all the calls are made in a single batch, whose duration is
+// recorded.  If the API is configured to be unbatched, each call is made individually so that its own duration can be
+// recorded.
+func fetchMethods(ctx context.Context, rpcClient jsonrpc.RPCClient, target string, calls []rpcCall) (*batchResult, error) {
+	batches := [][]rpcCall{calls}
+	if cfg().API.Unbatched {
+		batches = nil
+		for _, call := range calls {
+			batches = append(batches, []rpcCall{call})
+		}
+	}
+	result := &batchResult{
+		responses: make(map[string]*jsonrpc.RPCResponse),
+		durations: make(map[string]float64),
+		trace:     new(probeTrace),
+	}
+	// The trace and oversize flag are returned even if the calls fail, so the failure can be explained
+	ctx, oversize := withOversizeFlag(result.trace.withTrace(ctx))
+	defer func() { result.oversize = oversize.Load() }()
+	release, err := acquireProbeSlot(ctx)
+	if err != nil {
+		return result, err
+	}
+	defer release()
+	for _, batch := range batches {
+		batchStart := time.Now()
+		batchCtx, span := startSpan(ctx, "rpc batch", spanKindClient)
+		span.setAttr("target", target)
+		methods := make([]string, 0, len(batch))
+		for _, call := range batch {
+			methods = append(methods, call.method)
+		}
+		span.setAttr("methods", strings.Join(methods, ","))
+		batchResponses, err := withRetry(batchCtx, target, func() (map[string]*jsonrpc.RPCResponse, error) {
+			return apiBatchRequests(batchCtx, rpcClient, target, batch)
+		})
+		if err != nil {
+			span.setError(err)
+		}
+		span.finish()
+		if err != nil {
+			return result, err
+		}
+		duration := time.Since(batchStart).Seconds()
+		if !cfg().API.Unbatched {
+			result.batchDuration = duration
+		}
+		for _, call := range batch {
+			response, ok := batchResponses[call.key]
+			if !ok {
+				continue
+			}
+			result.responses[call.key] = response
+			if cfg().API.Unbatched {
+				result.durations[call.key] = duration
+			}
+			if ttl := cfg().Cache.TTL[call.method]; ttl > 0 && response.Error == nil {
+				rpcCache.put(profileKey(ctx, target), call.key, response, ttl)
+			}
+		}
+	}
+	return result, nil
+}
+
+// processCall checks the response to an individual RPC call and, if it succeeded, passes it to the method's
+// processor.
+func (m *prometheusMetrics) processCall(method string, response *jsonrpc.RPCResponse) error {
+	if response == nil {
+		return errors.New("no response received")
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	return processors[method](m, response)
+}
+
+// collectDomainUsers enumerates the WebADM domains and populates the domain users metric with the number of activated
+// users in each of them.
+func (m *prometheusMetrics) collectDomainUsers(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	var domains []string
+	if err := rpcClient.CallFor(ctx, &domains, "List_Domains"); err != nil {
+		return fmt.Errorf("unable to list domains: %v", err)
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	requests := make(jsonrpc.RPCRequests, 0, len(domains))
+	for id, domain := range domains {
+		requests = append(requests, jsonrpc.NewRequestWithID(id, "Count_Domain_Users", domain, true))
+	}
+	responses, err := rpcClient.CallBatch(ctx, requests)
+	if err != nil {
+		return err
+	}
+	for id, domain := range domains {
+		response := responses.GetByID(id)
+		if response == nil || response.Error != nil {
+			rpcLog.Warn("Unable to count users in domain", "domain", domain)
+			continue
+		}
+		users, err := response.GetInt()
+		if err != nil {
+			rpcLog.Warn("Unable to count users in domain", "domain", domain, "err", err)
+			continue
+		}
+		m.domainUsers.WithLabelValues(domain).Set(float64(users))
+	}
+	return nil
+}
+
+// processActiveUsers populates the active users metric from a Count_Activated_Users response
+func (m *prometheusMetrics) processActiveUsers(response *jsonrpc.RPCResponse) error {
+	au, err := apiActiveUsers(response)
+	if err != nil {
+		return err
+	}
+	m.usersActive.Set(au)
+	return nil
+}
+
+// processLicense populates the license metrics from a Get_License_Details response
+func (m *prometheusMetrics) processLicense(response *jsonrpc.RPCResponse) error {
+	license, err := apiGetLicenseDetails(response)
+	if err != nil {
+		return err
+	}
+	m.info.customerID = license.CustomerID
+	m.info.instanceID = license.InstanceID
+	m.licenseInfo.WithLabelValues(license.CustomerID, license.InstanceID, license.Type).Set(1)
+	labels := []string{license.CustomerID, license.InstanceID}
+	if cfg().Exporter.OmitLicenseLabels {
+		labels = nil
+	}
+	m.licenseValidFrom.WithLabelValues(labels...).Set(strToEpoch(license.ValidFrom))
+	m.licenseValidTo.WithLabelValues(labels...).Set(strToEpoch(license.ValidTo))
+	if license.SupportFrom != "" {
+		m.licenseSupportFrom.WithLabelValues(labels...).Set(strToEpoch(license.SupportFrom))
+	}
+	if license.SupportTo != "" {
+		m.licenseSupportTo.WithLabelValues(labels...).Set(strToEpoch(license.SupportTo))
+	}
+	// The error message is free text so it's logged, and only its reason is exported
+	licenseErr := strings.TrimSpace(license.ErrorMessage)
+	reason := licenseErrorReason(licenseErr)
+	for _, r := range licenseErrorReasons {
+		m.licenseError.WithLabelValues(append(labels[:len(labels):len(labels)], r)...).Set(boolToFloat(r == reason))
+	}
+	if licenseErr != "" {
+		rpcLog.Warn("License error", "customer_id", license.CustomerID, "reason", reason, "message", licenseErr)
+	}
+	var productErr error
+	for product, details := range license.Products {
+		productLabels := append(labels[:len(labels):len(labels)], product)
+		for _, allowance := range []struct {
+			value string
+			gauge *prometheus.GaugeVec
+		}{{details.GraceUsers, m.licenseGraceUsers}, {details.BurstUsers, m.licenseBurstUsers}} {
+			if allowance.value == "" {
+				continue
+			}
+			if users, err := strconv.ParseFloat(allowance.value, 64); err == nil {
+				allowance.gauge.WithLabelValues(productLabels...).Set(users)
+			}
+		}
+		unlimited := unlimitedUsers(details.MaximumUsers)
+		m.licenseUnlimited.WithLabelValues(productLabels...).Set(boolToFloat(unlimited))
+		if unlimited {
+			m.licenseMaxUsers.WithLabelValues(productLabels...).Set(*cfg().Exporter.UnlimitedUsers)
+			continue
+		}
+		mu, err := strconv.ParseFloat(details.MaximumUsers, 64)
+		if err != nil {
+			productErr = fmt.Errorf("invalid maximum_users for %s: %v", product, err)
+			continue
+		}
+		m.licenseMaxUsers.WithLabelValues(productLabels...).Set(mu)
+	}
+	return productErr
+}
+
+// licenseErrorReasons are the values of the license error metric's reason label
+var licenseErrorReasons = []string{"expired", "revoked", "exceeded", "invalid", "other"}
+
+// licenseErrorReason classifies a license error message.  It returns an empty string if there's no error.
+func licenseErrorReason(message string) string {
+	if message == "" {
+		return ""
+	}
+	message = strings.ToLower(message)
+	for _, reason := range []struct {
+		reason   string
+		keywords []string
+	}{
+		{"expired", []string{"expired"}},
+		{"revoked", []string{"revoked"}},
+		{"exceeded", []string{"exceeded", "too many", "limit"}},
+		{"invalid", []string{"invalid"}},
+	} {
+		for _, k := range reason.keywords {
+			if strings.Contains(message, k) {
+				return reason.reason
+			}
+		}
+	}
+	return "other"
+}
+
+// unlimitedUsers returns true if a product's maximum_users indicates that the license has no user cap
+func unlimitedUsers(maxUsers string) bool {
+	switch strings.ToLower(strings.TrimSpace(maxUsers)) {
+	case "", "unlimited", "infinite", "none":
+		return true
+	}
+	return false
+}
+
+// processServerStatus populates the server metrics from a Server_Status response
+func (m *prometheusMetrics) processServerStatus(response *jsonrpc.RPCResponse) error {
+	ss, err := apiServerStatus(response)
+	if err != nil {
+		return err
+	}
+	m.info.webadmVersion = ss.Version
+	m.serverEnabled.Set(boolToFloat(ss.Enabled))
+	m.serverStatus.Set(boolToFloat(ss.Status))
+	m.serverServices.WithLabelValues("ldap").Set(boolToFloat(ss.Servers.Ldap))
+	m.serverServices.WithLabelValues("mail").Set(boolToFloat(ss.Servers.Mail))
+	m.serverServices.WithLabelValues("pki").Set(boolToFloat(ss.Servers.Pki))
+	m.serverServices.WithLabelValues("proxy").Set(boolToFloat(ss.Servers.Proxy))
+	m.serverServices.WithLabelValues("session").Set(boolToFloat(ss.Servers.Session))
+	m.serverServices.WithLabelValues("sql").Set(boolToFloat(ss.Servers.Sql))
+	for name, app := range ss.Webapps {
+		m.webappStatus.WithLabelValues(name, app.Version).Set(boolToFloat(app.Status))
+	}
+	for name, srv := range ss.Websrvs {
+		m.websrvStatus.WithLabelValues(name, srv.Version).Set(boolToFloat(srv.Status))
+		if strings.EqualFold(name, "openotp") {
+			m.info.version = srv.Version
+		}
+	}
+	return nil
+}
+
+// recordServerInfo populates the server info metric from the details gathered by the processors.  It's omitted if
+// neither Server_Status nor Get_License_Details were called successfully.
+func (m *prometheusMetrics) recordServerInfo() {
+	if m.info == (serverInfo{}) {
+		return
+	}
+	m.serverInfo.WithLabelValues(m.info.version, m.info.webadmVersion, m.info.instanceID, m.info.customerID).Set(1)
+}
+
+// probeTimeout returns the time available for a probe.  Prometheus advertises its scrape timeout in a header; the
+// configured offset is subtracted from it to allow time for the response to be returned.  If the header is absent,
+// the configured API timeout is used instead.
+func probeTimeout(r *http.Request) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return cfg().API.Timeout
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		httpLog.Warn("Invalid X-Prometheus-Scrape-Timeout-Seconds header", "value", header)
+		return cfg().API.Timeout
+	}
+	scrapeTimeout := time.Duration(seconds * float64(time.Second))
+	timeout := scrapeTimeout - cfg().Exporter.TimeoutOffset
+	if timeout <= 0 {
+		// The offset is larger than the scrape timeout so ignore it.
+		timeout = scrapeTimeout
+	}
+	return timeout
+}
+
+// probeHandler probes a single target.  A new registry is created for every request so that concurrent probes of
+// different targets cannot interfere with each other's results.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	targetHost := params.Get("target")
+	if targetHost == "" {
+		http.Error(w, "Target parameter missing or empty", http.StatusBadRequest)
+		return
+	}
+	targetHost = expandTarget(targetHost)
+	if err := targetAllowed(r.Context(), targetHost); err != nil {
+		httpLog.Warn("Rejected probe request", "from", r.RemoteAddr, "target", targetHost, "err", err)
+		http.Error(w, "Target is not permitted", http.StatusForbidden)
+		return
+	}
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		moduleName = config.DefaultModule
+	}
+	module, ok := cfg().Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+	profile := params.Get("auth")
+	if _, ok := cfg().Credentials[profile]; profile != "" && !ok {
+		http.Error(w, fmt.Sprintf("Unknown credentials profile %q", profile), http.StatusBadRequest)
+		return
+	}
+	httpLog.Debug("Probe request", "from", r.RemoteAddr, "target", targetHost, "module", moduleName, "auth", profile)
+	skipCache := params.Get("cache") == "skip"
+	ctx, span := startSpan(withTraceparent(r.Context(), r.Header.Get("traceparent")), "probe request", spanKindServer)
+	defer span.finish()
+	span.setAttr("target", targetHost)
+	span.setAttr("module", moduleName)
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout(r))
+	defer cancel()
+	if profile != "" {
+		ctx = withCredentialsProfile(ctx, profile)
+	}
+	reg := prometheus.NewRegistry()
+	m := initCollectors(reg)
+	if params.Get("debug") == "true" {
+		// Return a log of the probe, followed by the metrics, as plain text.
+		debugLog := new(bytes.Buffer)
+		m.debugLog = debugLog
+		m.probe(ctx, targetHost, module, skipCache)
+		fmt.Fprintln(debugLog, "\nMetrics that would have been returned:")
+		if err := writeMetrics(reg, debugLog); err != nil {
+			fmt.Fprintf(debugLog, "Unable to gather metrics: %v\n", err)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		debugLog.WriteTo(w)
+		return
+	}
+	m.probe(ctx, targetHost, module, skipCache)
+	if m.limited {
+		http.Error(w, "Too many concurrent probes", http.StatusServiceUnavailable)
+		return
+	}
+	opts := handlerOpts()
+	opts.Registry = reg
+	h := promhttp.HandlerFor(withMetricFilters(reg), opts)
 	h.ServeHTTP(w, r)
 }
 
-func newRPC(url string) jsonrpc.RPCClient {
-	auth := fmt.Sprintf("%s:%s", cfg.API.Username, cfg.API.Password)
-	authb64 := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			Renegotiation: tls.RenegotiateOnceAsClient,
-		},
+// handlerOpts returns the options common to the exporter's metrics handlers.  The OpenMetrics format is only
+// negotiated if it's enabled in the config.
+func handlerOpts() promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{EnableOpenMetrics: cfg().Exporter.OpenMetrics}
+}
+
+// probeTargets concurrently probes each of the targets and returns a registry containing the resulting metrics, labelled
+// with the target's URL.
+func probeTargets(ctx context.Context, targets []config.Target, skipCache bool) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		m := initCollectors(prometheus.WrapRegistererWith(targetLabels(t.URL), reg))
+		wg.Add(1)
+		go func(t config.Target, m *prometheusMetrics) {
+			defer wg.Done()
+			m.probe(ctx, expandTarget(t.URL), cfg().Modules[t.Module], skipCache)
+		}(t, m)
 	}
-	rpcClient := jsonrpc.NewClientWithOpts(url,
-		&jsonrpc.RPCClientOpts{
-			HTTPClient: &http.Client{
-				Transport: tr,
-			},
-			CustomHeaders: map[string]string{
-				"Authorization": authb64,
-			},
-		},
-	)
-	return rpcClient
+	wg.Wait()
+	return reg
+}
+
+// metricsHandler serves the exporter's own metrics.  If static targets are defined in the config file, they are all
+// probed concurrently and their metrics are served alongside.  Each scrape uses a new registry, within which every
+// target's metrics are registered with a constant "target" label.  In poll mode, the targets aren't probed and the
+// results of the most recent background polls are served instead.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg().Exporter.Mode != "poll" && len(allTargets()) == 0 {
+		if cfg().Exporter.TelemetryAddress != "" {
+			http.Error(w, "Exporter metrics are served on the telemetry address", http.StatusNotFound)
+			return
+		}
+		// As promhttp.Handler, but honouring the configured handler options
+		h := promhttp.HandlerFor(withMetricFilters(prometheus.DefaultGatherer), handlerOpts())
+		promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, h).ServeHTTP(w, r)
+		return
+	}
+	skipCache := r.URL.Query().Get("cache") == "skip"
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout(r))
+	defer cancel()
+	h := promhttp.HandlerFor(withMetricFilters(targetGatherers(ctx, skipCache)), handlerOpts())
+	h.ServeHTTP(w, r)
+}
+
+// targetGatherers returns the exporter's own metrics along with those of the configured targets.  The targets are
+// probed unless the exporter is in poll mode, in which case the results of the most recent polls are used.  The
+// exporter's metrics are omitted when they're served on a separate telemetry listener.
+func targetGatherers(ctx context.Context, skipCache bool) prometheus.Gatherers {
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer}
+	if cfg().Exporter.TelemetryAddress != "" {
+		gatherers = prometheus.Gatherers{}
+	}
+	if cfg().Exporter.Mode == "poll" {
+		return append(gatherers, fleetGatherer{polls.gatherers()})
+	}
+	if targets := allTargets(); len(targets) > 0 {
+		gatherers = append(gatherers, fleetGatherer{prometheus.Gatherers{probeTargets(ctx, targets, skipCache)}})
+	}
+	return gatherers
+}
+
+// checkConfig validates the config file, reports any problems and exits with a status reflecting the outcome.
+func checkConfig(filename string) {
+	errs := config.CheckConfig(filename)
+	if filename == "" {
+		// The config is taken entirely from the environment
+		filename = "environment"
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", filename)
+	os.Exit(0)
 }
 
 func main() {
 	var err error
 	flags = config.ParseFlags()
-	cfg, err = config.ParseConfig(flags.Config)
+	if flags.Version {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	switch flags.Command {
+	case "", "probe", "gen-scrape-config":
+	case "check-config":
+		checkConfig(flags.Config)
+	case "init-config":
+		os.Exit(initConfigCommand())
+	case "install-service", "uninstall-service":
+		serviceCommand(flags.Command, flags.Config)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flags.Command)
+		os.Exit(2)
+	}
+	parsed, err := config.ParseConfig(flags.Config)
 	if err != nil {
-		log.Fatalf("Cannot parse config: %v", err)
+		fatal("Cannot parse config", "err", err)
+	}
+	currentConfig.Store(parsed)
+	if flags.Command == "gen-scrape-config" {
+		os.Exit(genScrapeConfigCommand())
+	}
+	if err := checkTargetLabels(cfg()); err != nil {
+		fatal("Invalid target labels", "err", err)
+	}
+	if err := checkCustomMetrics(cfg()); err != nil {
+		fatal("Invalid custom metrics", "err", err)
+	}
+	if err := checkKerberos(cfg()); err != nil {
+		fatal("Invalid Kerberos auth", "err", err)
 	}
-	loglev, err := loglevel.ParseLevel(cfg.Logging.LevelStr)
+	levels, err := parseLevels(cfg().Logging)
 	if err != nil {
-		log.Fatalf("Unable to set log level: %v", err)
+		fatal("Unable to set log level", "err", err)
 	}
-	if cfg.Logging.Journal && jlog.Enabled() {
-		log.Current = jlog.NewJournal(loglev)
-		log.Infof("Logging to journal has been initialised at level: %s", cfg.Logging.LevelStr)
+	currentLevels.Store(levels)
+	setRedactedSecrets(cfg())
+	setProbeLimit(cfg().Exporter.MaxConcurrentProbes)
+	exporter = initExporterCollectors(prometheus.DefaultRegisterer)
+	runtimeCollectors(prometheus.DefaultRegisterer)
+	if flags.Command == "probe" {
+		// Log to stderr so that log messages don't mix with the metrics written to stdout.
+		setLogOutput(newOutputHandler(os.Stderr, cfg().Logging.Format))
+	} else if cfg().Logging.EventLog {
+		h, err := newEventLogHandler()
+		if err != nil {
+			fatal("Unable to open event log", "err", err)
+		}
+		setLogOutput(h)
+	} else if cfg().Logging.Journal && journal.Enabled() {
+		setLogOutput(newJournalHandler())
+		mainLog.Info("Logging to journal has been initialised", "level", cfg().Logging.LevelStr)
 	} else {
 		// Journal is not available
-		if cfg.Logging.Journal {
-			log.Warn("Configured for journal logging but journal is not available.  Logging to file instead.")
+		if cfg().Logging.Journal {
+			mainLog.Warn("Configured for journal logging but journal is not available.  Logging to file or stdout instead.")
 		}
-		var logWriter *os.File
-		if cfg.Logging.Filename == "" {
-			// Create a temporary file for logging
-			logWriter, err = os.CreateTemp("", "openotp_exporter.log")
-			if err != nil {
-				log.Fatalf("Cannot log to temp file: %v", err)
-			}
-			fmt.Printf("Logging to: %s\n", logWriter.Name())
+		if cfg().Logging.Filename == "" {
+			setLogOutput(newOutputHandler(os.Stdout, cfg().Logging.Format))
 		} else {
 			// Log to the configured file
-			logWriter, err = os.OpenFile(cfg.Logging.Filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+			lc := cfg().Logging
+			logWriter, err := newRotatingWriter(lc.Filename, int64(lc.MaxSize)*1024*1024, lc.MaxAge, lc.MaxBackups, lc.Compress)
 			if err != nil {
-				log.Fatalf("Unable to open logfile: %s", err)
+				fatal("Unable to open logfile", "err", err)
 			}
+			defer logWriter.Close()
+			setLogOutput(newOutputHandler(logWriter, cfg().Logging.Format))
+			mainLog.Debug("Logging to file has been initialised", "filename", lc.Filename, "level", lc.LevelStr)
 		}
-		defer logWriter.Close()
-		stdlog.SetOutput(logWriter)
-		log.Current = log.StdLogger{Level: loglev}
-		log.Debugf("Logging to file %s has been initialised at level: %s", logWriter.Name(), cfg.Logging.LevelStr)
 	}
 
-	registry := prometheus.NewRegistry()
-	metrics := initCollectors(registry)
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
-		metrics.probeHandler(w, r, registry)
+	mainLog.Info("Starting " + versionString())
+	if cfg().API.InsecureSkipVerify {
+		mainLog.Warn("TLS certificate verification of the OpenOTP API is disabled")
+	}
+
+	if cfg().Secrets.Vault.Enabled() {
+		if err := refreshVaultCredentials(cfg().Secrets.Vault); err != nil {
+			fatal("Unable to retrieve credentials from Vault", "err", err)
+		}
+		vaultLog.Info("Retrieved API credentials from Vault", "address", cfg().Secrets.Vault.Address)
+		go vaultRefresher()
+	}
+
+	if k := cfg().Discovery.Kubernetes; k.Enabled() {
+		if err := refreshKubernetesTargets(k); err != nil {
+			discoveryLog.Warn("Unable to discover targets from Kubernetes", "err", err)
+		} else {
+			discoveryLog.Info("Discovered targets from Kubernetes", "count", len(*discoveredTargets.Load()))
+		}
+	}
+	go kubernetesDiscoverer()
+
+	if flags.Command == "probe" {
+		os.Exit(probeCommand())
+	}
+
+	if len(cfg().Targets) > 0 {
+		// Static targets are defined in the config so scrapes of /metrics will probe all of them.
+		mainLog.Info("Polling static targets on /metrics", "count", len(cfg().Targets))
+	}
+	if err := startService(); err != nil {
+		fatal("Unable to start Windows service", "err", err)
+	}
+	defer stopService()
+	recordReload(exporter, nil)
+	go reloadOnSIGHUP(exporter)
+	go watchTargetsFile(exporter)
+	if cfg().Textfile.Filename != "" {
+		// In textfile mode the exporter doesn't listen for scrapes; the results are written to a file instead.
+		runTextfile()
+		mainLog.Info("Shutdown complete")
+		return
+	}
+	go polls.run()
+	go watchCertificates(exporter)
+	go otlpExporter()
+	go traceExporter()
+	// The handlers are registered on a mux of their own so that net/http/pprof, which registers itself on the
+	// default mux, isn't exposed unless profiling is enabled.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/probe", withRateLimit(probeHandler))
+	mux.HandleFunc("/sd", sdHandler)
+	mux.HandleFunc("/probes", historyHandler)
+	mux.HandleFunc("/", landingHandler)
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		reloadHandler(w, r, exporter)
 	})
-	hostport := fmt.Sprintf("%s:%d", cfg.Exporter.Hostname, cfg.Exporter.Port)
-	if cfg.Exporter.Hostname == "" {
-		log.Infof("Listening on all interfaces on port %d", cfg.Exporter.Port)
+	if cfg().Exporter.TelemetryAddress != "" {
+		go serveTelemetry(cfg().Exporter.TelemetryAddress)
+	} else if cfg().Exporter.Pprof {
+		registerPprof(mux)
+	}
+	network, address := listenAddress()
+	if network == "tcp" && cfg().Exporter.Listen == "" && cfg().Exporter.Hostname == "" {
+		httpLog.Info("Listening on all interfaces", "port", cfg().Exporter.Port)
 	} else {
-		log.Infof("Listening on %s", hostport)
+		httpLog.Info("Listening", "network", network, "address", address)
+	}
+	err = listenAndServe(network, address, withAccessLog(withAllowedCIDRs(withAuth(mux))))
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("HTTP server failed", "err", err)
 	}
-	http.ListenAndServe(hostport, nil)
+	mainLog.Info("Shutdown complete")
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMethodDispatch(t *testing.T) {
+	// Methods are called in the batch and cached, so each needs a processor, whereas pseudo-methods are collected
+	for _, method := range config.Methods {
+		if _, ok := processors[method]; !ok {
+			t.Errorf("Method %s has no processor", method)
+		}
+	}
+	for _, method := range config.PseudoMethods {
+		if _, ok := collectors[method]; !ok {
+			t.Errorf("Pseudo-method %s has no collector", method)
+		}
+	}
+	if len(processors)+len(collectors) != len(config.Methods)+len(config.PseudoMethods) {
+		t.Errorf("Unexpected number of dispatched methods.  Expected=%d, Got=%d",
+			len(config.Methods)+len(config.PseudoMethods), len(processors)+len(collectors))
+	}
+}
+
+func TestProbeOpenCircuit(t *testing.T) {
+	c := new(config.Config)
+	c.API.Path = "/manag/"
+	c.API.Timeout = time.Second
+	c.Exporter.CircuitBreaker.Failures = 1
+	c.Exporter.CircuitBreaker.Cooldown = time.Hour
+	currentConfig.Store(c)
+	host := "https://circuit.example.com"
+	defer forgetTarget(host)
+	breaker.record(apiURL(host), errors.New("failed"))
+
+	// Check_Backends makes no calls when no backends are configured, so only the circuit can fail the probe
+	m := initCollectors(prometheus.NewRegistry())
+	if m.probe(context.Background(), host, config.Module{Methods: []string{"Check_Backends"}}, false) {
+		t.Error("Probe of a target with an open circuit succeeded")
+	}
+	breaker.record(apiURL(host), nil)
+	m = initCollectors(prometheus.NewRegistry())
+	if !m.probe(context.Background(), host, config.Module{Methods: []string{"Check_Backends"}}, false) {
+		t.Error("Probe of a target with a closed circuit failed")
+	}
+}
@@ -2,32 +2,100 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"runtime"
 
 	"github.com/prometheus/client_golang/prometheus"
+	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 const (
+	// prefix is the default namespace of the exported metrics
 	prefix string = "openotp"
 )
 
 type prometheusMetrics struct {
-	probeDuration    prometheus.Gauge
-	probeSuccess     prometheus.Gauge
-	licenseMaxUsers  *prometheus.GaugeVec
-	licenseValidFrom *prometheus.GaugeVec
-	licenseValidTo   *prometheus.GaugeVec
-	usersActive      prometheus.Gauge
-	serverEnabled    *prometheus.GaugeVec
-	serverStatus     *prometheus.GaugeVec
-	serverServices   *prometheus.GaugeVec
+	// debugLog receives a log of the probe when debug output has been requested
+	debugLog io.Writer
+	// limited is set if the probe couldn't run because too many probes were in progress
+	limited bool
+	// info accumulates the labels of the server info metric from several RPC responses
+	info serverInfo
+
+	probeDuration        prometheus.Gauge
+	probeSuccess         prometheus.Gauge
+	responseTooLarge     prometheus.Gauge
+	callSuccess          *prometheus.GaugeVec
+	customSuccess        *prometheus.GaugeVec
+	rpcDuration          *prometheus.GaugeVec
+	rpcBatchDuration     prometheus.Gauge
+	dnsDuration          prometheus.Gauge
+	connectDuration      prometheus.Gauge
+	tlsDuration          prometheus.Gauge
+	serverDuration       prometheus.Gauge
+	tlsCertExpiry        *prometheus.GaugeVec
+	tlsVersion           *prometheus.GaugeVec
+	licenseInfo          *prometheus.GaugeVec
+	licenseMaxUsers      *prometheus.GaugeVec
+	licenseUnlimited     *prometheus.GaugeVec
+	licenseError         *prometheus.GaugeVec
+	licenseGraceUsers    *prometheus.GaugeVec
+	licenseBurstUsers    *prometheus.GaugeVec
+	licenseSupportFrom   *prometheus.GaugeVec
+	licenseSupportTo     *prometheus.GaugeVec
+	licenseValidFrom     *prometheus.GaugeVec
+	licenseValidTo       *prometheus.GaugeVec
+	usersActive          prometheus.Gauge
+	mailBackendUp        prometheus.Gauge
+	caCertExpiry         prometheus.Gauge
+	caCertsRevoked       prometheus.Gauge
+	caCertsIssued        prometheus.Gauge
+	canaryAuthSuccess    prometheus.Gauge
+	canaryAuthDuration   prometheus.Gauge
+	radiusAuthSuccess    prometheus.Gauge
+	radiusAuthDuration   prometheus.Gauge
+	ldapCheckSuccess     prometheus.Gauge
+	ldapCheckDuration    prometheus.Gauge
+	sqlReachable         prometheus.Gauge
+	sqlHandshakeDuration prometheus.Gauge
+	domainUsers          *prometheus.GaugeVec
+	serverEnabled        prometheus.Gauge
+	serverStatus         prometheus.Gauge
+	serverInfo           *prometheus.GaugeVec
+	serverServices       *prometheus.GaugeVec
+	webappStatus         *prometheus.GaugeVec
+	websrvStatus         *prometheus.GaugeVec
+	custom               *customMetrics
+}
+
+// serverInfo contains the labels of the server info metric
+type serverInfo struct {
+	version       string
+	webadmVersion string
+	instanceID    string
+	customerID    string
 }
 
+// addPrefix prepends the configured namespace to a metric name
 func addPrefix(s string) string {
-	return fmt.Sprintf("%s_%s", prefix, s)
+	namespace := prefix
+	if cfg() != nil && cfg().Exporter.Namespace != "" {
+		namespace = cfg().Exporter.Namespace
+	}
+	return fmt.Sprintf("%s_%s", namespace, s)
 }
 
-func initCollectors(reg *prometheus.Registry) *prometheusMetrics {
+// withConstLabels wraps reg so that the constant labels defined in the config are added to every metric
+func withConstLabels(reg prometheus.Registerer) prometheus.Registerer {
+	if cfg() == nil || len(cfg().Exporter.Labels) == 0 {
+		return reg
+	}
+	return prometheus.WrapRegistererWith(cfg().Exporter.Labels, reg)
+}
+
+func initCollectors(reg prometheus.Registerer) *prometheusMetrics {
 	m := new(prometheusMetrics)
+	reg = withConstLabels(reg)
 	m.probeDuration = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "probe_duration",
@@ -44,21 +112,185 @@ func initCollectors(reg *prometheus.Registry) *prometheusMetrics {
 	)
 	reg.MustRegister(m.probeSuccess)
 
+	m.responseTooLarge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_response_too_large"),
+			Help: "Whether or not the probe failed because an API response exceeded the maximum size",
+		},
+	)
+	reg.MustRegister(m.responseTooLarge)
+
+	m.callSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_call_success"),
+			Help: "Whether or not each RPC call within the probe succeeded",
+		},
+		[]string{"method"},
+	)
+	reg.MustRegister(m.callSuccess)
+
+	m.customSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_custom_metric_success"),
+			Help: "Whether or not each custom metric within the probe was collected",
+		},
+		[]string{"metric"},
+	)
+	reg.MustRegister(m.customSuccess)
+
+	m.rpcDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_rpc_duration_seconds"),
+			Help: "How many seconds each RPC call made individually took.  Batched calls are only reported in the batch duration.",
+		},
+		[]string{"method"},
+	)
+	reg.MustRegister(m.rpcDuration)
+
+	m.rpcBatchDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_rpc_batch_duration_seconds"),
+			Help: "How many seconds the batch of RPC calls took",
+		},
+	)
+	reg.MustRegister(m.rpcBatchDuration)
+
+	m.dnsDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_dns_seconds"),
+			Help: "How many seconds the probe spent resolving the target's address",
+		},
+	)
+	reg.MustRegister(m.dnsDuration)
+
+	m.connectDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_connect_seconds"),
+			Help: "How many seconds the probe spent establishing TCP connections to the target",
+		},
+	)
+	reg.MustRegister(m.connectDuration)
+
+	m.tlsDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_tls_seconds"),
+			Help: "How many seconds the probe spent performing TLS handshakes with the target",
+		},
+	)
+	reg.MustRegister(m.tlsDuration)
+
+	m.serverDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_rpc_seconds"),
+			Help: "How many seconds the target took to start responding to RPC requests",
+		},
+	)
+	reg.MustRegister(m.serverDuration)
+
+	// A label-less vector is used so that the metric is omitted, rather than zero, when no handshake took place.
+	m.tlsCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_tls_cert_expiry_timestamp_seconds"),
+			Help: "Epoch timestamp at which the certificate presented by the target expires",
+		},
+		nil,
+	)
+	reg.MustRegister(m.tlsCertExpiry)
+
+	m.tlsVersion = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("probe_tls_version"),
+			Help: "The TLS version negotiated with the target",
+		},
+		[]string{"version"},
+	)
+	reg.MustRegister(m.tlsVersion)
+
+	m.licenseInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_info"),
+			Help: "A metric with a constant '1' value labelled by the license's customer ID, instance ID and type",
+		},
+		[]string{"customer", "instance", "type"},
+	)
+	reg.MustRegister(m.licenseInfo)
+
+	// The license IDs change when a license is renewed, creating new series.  They can be omitted from the numeric
+	// license metrics and joined from the info metric instead.
+	licenseLabels := []string{"customer", "license"}
+	if cfg() != nil && cfg().Exporter.OmitLicenseLabels {
+		licenseLabels = nil
+	}
+
 	m.licenseMaxUsers = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: addPrefix("license_users_max"),
-			Help: "Maximum number of users the current OpenOTP license permits",
+			Help: "Maximum number of users the current license permits for each product",
 		},
-		[]string{"customer", "license"},
+		append(licenseLabels, "product"),
 	)
 	reg.MustRegister(m.licenseMaxUsers)
 
+	m.licenseUnlimited = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_unlimited"),
+			Help: "Whether or not the current license permits an unlimited number of users for each product",
+		},
+		append(licenseLabels, "product"),
+	)
+	reg.MustRegister(m.licenseUnlimited)
+
+	m.licenseError = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_error"),
+			Help: "Whether or not WebADM reports an error with the license, such as it being expired or revoked, by reason",
+		},
+		append(licenseLabels, "reason"),
+	)
+	reg.MustRegister(m.licenseError)
+
+	m.licenseGraceUsers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_users_grace"),
+			Help: "Number of users each product permits beyond the maximum during the license's grace period",
+		},
+		append(licenseLabels, "product"),
+	)
+	reg.MustRegister(m.licenseGraceUsers)
+
+	m.licenseBurstUsers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_users_burst"),
+			Help: "Number of users each product permits beyond the maximum before logins are blocked",
+		},
+		append(licenseLabels, "product"),
+	)
+	reg.MustRegister(m.licenseBurstUsers)
+
+	m.licenseSupportFrom = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_support_valid_from"),
+			Help: "Epoch timestamp of the license's support contract start date",
+		},
+		licenseLabels,
+	)
+	reg.MustRegister(m.licenseSupportFrom)
+
+	m.licenseSupportTo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("license_support_valid_to"),
+			Help: "Epoch timestamp of the license's support contract end date",
+		},
+		licenseLabels,
+	)
+	reg.MustRegister(m.licenseSupportTo)
+
 	m.licenseValidFrom = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: addPrefix("license_valid_from"),
 			Help: "Epoch timestamp of license start date",
 		},
-		[]string{"customer", "license"},
+		licenseLabels,
 	)
 	reg.MustRegister(m.licenseValidFrom)
 
@@ -67,7 +299,7 @@ func initCollectors(reg *prometheus.Registry) *prometheusMetrics {
 			Name: addPrefix("license_valid_to"),
 			Help: "Epoch timestamp of license end date",
 		},
-		[]string{"customer", "license"},
+		licenseLabels,
 	)
 	reg.MustRegister(m.licenseValidTo)
 
@@ -79,24 +311,136 @@ func initCollectors(reg *prometheus.Registry) *prometheusMetrics {
 	)
 	reg.MustRegister(m.usersActive)
 
-	m.serverEnabled = prometheus.NewGaugeVec(
+	m.mailBackendUp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("mail_backend_up"),
+			Help: "Whether or not the SMTP server used to deliver OTPs is reachable",
+		},
+	)
+	reg.MustRegister(m.mailBackendUp)
+
+	m.caCertExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("ca_cert_expiry_timestamp_seconds"),
+			Help: "Epoch timestamp at which the WebADM CA certificate expires",
+		},
+	)
+	reg.MustRegister(m.caCertExpiry)
+
+	m.caCertsRevoked = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("ca_certs_revoked"),
+			Help: "Number of certificates listed in the WebADM CA's revocation list",
+		},
+	)
+	reg.MustRegister(m.caCertsRevoked)
+
+	m.caCertsIssued = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("ca_certs_issued"),
+			Help: "Number of certificates issued by the WebADM CA that are held in the userCertificate attribute of LDAP entries",
+		},
+	)
+	reg.MustRegister(m.caCertsIssued)
+
+	m.canaryAuthSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("canary_auth_success"),
+			Help: "Whether or not the canary account successfully authenticated to OpenOTP",
+		},
+	)
+	reg.MustRegister(m.canaryAuthSuccess)
+
+	m.canaryAuthDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("canary_auth_duration_seconds"),
+			Help: "How many seconds the canary authentication took",
+		},
+	)
+	reg.MustRegister(m.canaryAuthDuration)
+
+	m.radiusAuthSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("radius_auth_success"),
+			Help: "Whether or not the canary account successfully authenticated through the Radius Bridge",
+		},
+	)
+	reg.MustRegister(m.radiusAuthSuccess)
+
+	m.radiusAuthDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("radius_auth_duration_seconds"),
+			Help: "How many seconds the Radius Bridge authentication took",
+		},
+	)
+	reg.MustRegister(m.radiusAuthDuration)
+
+	m.ldapCheckSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("ldap_check_success"),
+			Help: "Whether or not the exporter could bind to the directory and find the configured entry",
+		},
+	)
+	reg.MustRegister(m.ldapCheckSuccess)
+
+	m.ldapCheckDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("ldap_check_duration_seconds"),
+			Help: "How many seconds the directory bind and search took",
+		},
+	)
+	reg.MustRegister(m.ldapCheckDuration)
+
+	m.sqlReachable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("sql_reachable"),
+			Help: "Whether or not the SQL server answered a connection handshake.  Credentials aren't checked.",
+		},
+	)
+	reg.MustRegister(m.sqlReachable)
+
+	m.sqlHandshakeDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("sql_handshake_duration_seconds"),
+			Help: "How many seconds the SQL server took to answer the connection handshake",
+		},
+	)
+	reg.MustRegister(m.sqlHandshakeDuration)
+
+	m.domainUsers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("domain_users"),
+			Help: "Current number of activated users in each WebADM domain",
+		},
+		[]string{"domain"},
+	)
+	reg.MustRegister(m.domainUsers)
+
+	m.serverEnabled = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: addPrefix("server_enabled"),
 			Help: "Is the OpenOTP server enabled",
 		},
-		[]string{"version"},
 	)
 	reg.MustRegister(m.serverEnabled)
 
-	m.serverStatus = prometheus.NewGaugeVec(
+	m.serverStatus = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: addPrefix("server_status"),
 			Help: "Status of the OpenOTP server",
 		},
-		[]string{"version"},
 	)
 	reg.MustRegister(m.serverStatus)
 
+	m.serverInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("server_info"),
+			Help: "A metric with a constant '1' value labelled by the OpenOTP and WebADM versions and license IDs",
+		},
+		[]string{"version", "webadm_version", "instance_id", "customer_id"},
+	)
+	reg.MustRegister(m.serverInfo)
+
 	m.serverServices = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: addPrefix("server_services"),
@@ -106,5 +450,228 @@ func initCollectors(reg *prometheus.Registry) *prometheusMetrics {
 	)
 	reg.MustRegister(m.serverServices)
 
+	m.webappStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("webapp_status"),
+			Help: "Status of the WebADM web applications",
+		},
+		[]string{"name", "version"},
+	)
+	reg.MustRegister(m.webappStatus)
+
+	m.websrvStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("websrv_status"),
+			Help: "Status of the WebADM web services, such as OpenOTP, SpanKey and SMSHub",
+		},
+		[]string{"name", "version"},
+	)
+	reg.MustRegister(m.websrvStatus)
+
+	m.custom = new(customMetrics)
+	reg.MustRegister(m.custom)
+
 	return m
 }
+
+// exporterMetrics are the exporter's own metrics.  Unlike prometheusMetrics, they persist for the lifetime of the
+// process and are served on /metrics.
+type exporterMetrics struct {
+	configReloadSuccess prometheus.Gauge
+	configReloadTime    prometheus.Gauge
+	probesTotal         *prometheus.CounterVec
+	probeDuration       *prometheus.HistogramVec
+	lastSuccess         *prometheus.GaugeVec
+	rpcPool             *prometheus.CounterVec
+	retries             *prometheus.CounterVec
+	circuitOpen         *prometheus.GaugeVec
+	deniedRequests      prometheus.Counter
+	rateLimited         *prometheus.CounterVec
+	certExpiry          *prometheus.GaugeVec
+	rpcRequests         *prometheus.CounterVec
+	rpcBytes            *prometheus.CounterVec
+	rpcConnections      prometheus.Gauge
+	tlsHandshakes       *prometheus.CounterVec
+	coalesced           *prometheus.CounterVec
+}
+
+func initExporterCollectors(reg prometheus.Registerer) *exporterMetrics {
+	m := new(exporterMetrics)
+	reg = withConstLabels(reg)
+	m.configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_config_last_reload_successful"),
+			Help: "Whether or not the last configuration reload attempt was successful",
+		},
+	)
+	reg.MustRegister(m.configReloadSuccess)
+
+	m.configReloadTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_config_last_reload_success_timestamp_seconds"),
+			Help: "Epoch timestamp of the last successful configuration reload",
+		},
+	)
+	reg.MustRegister(m.configReloadTime)
+
+	m.probesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_probes_total"),
+			Help: "Total number of probes performed, by target and result",
+		},
+		[]string{"target", "result"},
+	)
+	reg.MustRegister(m.probesTotal)
+
+	m.probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    addPrefix("exporter_probe_duration_seconds"),
+			Help:    "Duration of probes, by target",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		},
+		[]string{"target"},
+	)
+	reg.MustRegister(m.probeDuration)
+
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_build_info"),
+			Help: "A metric with a constant '1' value labelled by the exporter's version, revision and Go version",
+		},
+		[]string{"version", "revision", "goversion"},
+	)
+	buildInfo.WithLabelValues(version, revision, runtime.Version()).Set(1)
+	reg.MustRegister(buildInfo)
+
+	m.lastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_last_success_timestamp_seconds"),
+			Help: "Epoch timestamp of the last successful probe of each target",
+		},
+		[]string{"target"},
+	)
+	reg.MustRegister(m.lastSuccess)
+
+	m.rpcPool = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_rpc_client_pool_total"),
+			Help: "Total number of RPC client lookups, by whether a pooled client was reused (hit) or created (miss)",
+		},
+		[]string{"result"},
+	)
+	reg.MustRegister(m.rpcPool)
+
+	m.retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("probe_retries_total"),
+			Help: "Total number of RPC batches retried after a transient failure, by target",
+		},
+		[]string{"target"},
+	)
+	reg.MustRegister(m.retries)
+
+	m.circuitOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_circuit_open"),
+			Help: "Whether probes of the target are being skipped after consecutive failures",
+		},
+		[]string{"target"},
+	)
+	reg.MustRegister(m.circuitOpen)
+
+	m.deniedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_denied_requests_total"),
+			Help: "Total number of requests rejected because the client address isn't in allowed_cidrs",
+		},
+	)
+	reg.MustRegister(m.deniedRequests)
+
+	m.rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_rate_limited_requests_total"),
+			Help: "Total number of probe requests rejected by the rate limiter, by the limit exceeded",
+		},
+		[]string{"limit"},
+	)
+	reg.MustRegister(m.rateLimited)
+
+	m.certExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_tls_cert_expiry_timestamp_seconds"),
+			Help: "Epoch timestamp at which the exporter's listener or API client certificate expires",
+		},
+		[]string{"cert"},
+	)
+	reg.MustRegister(m.certExpiry)
+
+	m.rpcRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_rpc_requests_total"),
+			Help: "Total number of HTTP requests made to the API, by status code",
+		},
+		[]string{"code"},
+	)
+	reg.MustRegister(m.rpcRequests)
+
+	m.rpcBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_rpc_bytes_total"),
+			Help: "Total number of bytes read from and written to API connections, including TLS overhead",
+		},
+		[]string{"direction"},
+	)
+	reg.MustRegister(m.rpcBytes)
+
+	m.rpcConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: addPrefix("exporter_rpc_open_connections"),
+			Help: "Number of connections to the API currently open",
+		},
+	)
+	reg.MustRegister(m.rpcConnections)
+
+	m.tlsHandshakes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_rpc_tls_handshakes_total"),
+			Help: "Total number of TLS handshakes with the API, by whether the session was resumed",
+		},
+		[]string{"resumed"},
+	)
+	reg.MustRegister(m.tlsHandshakes)
+
+	m.coalesced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: addPrefix("exporter_probes_coalesced_total"),
+			Help: "Total number of probes that shared the responses of an identical probe instead of calling the API, by target",
+		},
+		[]string{"target"},
+	)
+	reg.MustRegister(m.coalesced)
+
+	return m
+}
+
+// runtimeCollectors registers the Go runtime and process collectors according to the config.  The default registry
+// includes both so they're replaced, which keeps their registration in one place.  Changes take effect on restart.
+func runtimeCollectors(reg prometheus.Registerer) {
+	reg.Unregister(promcollectors.NewGoCollector())
+	reg.Unregister(promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{}))
+	if *cfg().Exporter.GoCollector {
+		reg.MustRegister(promcollectors.NewGoCollector())
+	}
+	if *cfg().Exporter.ProcessCollector {
+		reg.MustRegister(promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{}))
+	}
+}
+
+// recordProbe updates the exporter's lifetime metrics with the outcome of a probe
+func (m *exporterMetrics) recordProbe(target string, success bool, duration float64) {
+	result := "failure"
+	if success {
+		result = "success"
+		m.lastSuccess.WithLabelValues(target).SetToCurrentTime()
+	}
+	m.probesTotal.WithLabelValues(target, result).Inc()
+	m.probeDuration.WithLabelValues(target).Observe(duration)
+}
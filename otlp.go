@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OTLP aggregation temporality.  Prometheus counters, histograms and summaries are cumulative.
+const otlpCumulative = 2
+
+// otlpDouble is a float64 that's encoded as the OTLP JSON encoding requires, with non-finite values as strings
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	f := float64(d)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(f)
+}
+
+// otlpUint64 is encoded as a decimal string, as OTLP JSON requires for 64 bit integers
+type otlpUint64 uint64
+
+func (u otlpUint64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(u), 10))
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpQuantile struct {
+	Quantile otlpDouble `json:"quantile"`
+	Value    otlpDouble `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64      `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64      `json:"timeUnixNano"`
+	AsDouble          *otlpDouble     `json:"asDouble,omitempty"`
+	Count             *otlpUint64     `json:"count,omitempty"`
+	Sum               *otlpDouble     `json:"sum,omitempty"`
+	BucketCounts      []otlpUint64    `json:"bucketCounts,omitempty"`
+	ExplicitBounds    []otlpDouble    `json:"explicitBounds,omitempty"`
+	QuantileValues    []otlpQuantile  `json:"quantileValues,omitempty"`
+}
+
+type otlpData struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool            `json:"isMonotonic,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Gauge       *otlpData `json:"gauge,omitempty"`
+	Sum         *otlpData `json:"sum,omitempty"`
+	Histogram   *otlpData `json:"histogram,omitempty"`
+	Summary     *otlpData `json:"summary,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+// otlpRequest is an OTLP ExportMetricsServiceRequest
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+func otlpAttr(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+// otlpStartTime is the start of the period over which the cumulative metrics have accumulated.  The exporter's
+// counters, histograms and summaries all start when it does.
+var otlpStartTime = time.Now()
+
+// otlpMetrics converts Prometheus metric families to their OTLP equivalents.  Cumulative data points start at start,
+// as collectors need it to detect resets and calculate rates.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) []otlpMetric {
+	var metrics []otlpMetric
+	for _, mf := range families {
+		om := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		data := new(otlpData)
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			data.AggregationTemporality = otlpCumulative
+			data.IsMonotonic = true
+			om.Sum = data
+		case dto.MetricType_HISTOGRAM:
+			data.AggregationTemporality = otlpCumulative
+			om.Histogram = data
+		case dto.MetricType_SUMMARY:
+			om.Summary = data
+		default:
+			om.Gauge = data
+		}
+		for _, m := range mf.GetMetric() {
+			dp := otlpDataPoint{TimeUnixNano: otlpUint64(now.UnixNano())}
+			if ts := m.GetTimestampMs(); ts != 0 {
+				dp.TimeUnixNano = otlpUint64(time.UnixMilli(ts).UnixNano())
+			}
+			if om.Gauge == nil {
+				dp.StartTimeUnixNano = otlpUint64(start.UnixNano())
+			}
+			for _, l := range m.GetLabel() {
+				dp.Attributes = append(dp.Attributes, otlpAttr(l.GetName(), l.GetValue()))
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				v := otlpDouble(m.GetCounter().GetValue())
+				dp.AsDouble = &v
+			case dto.MetricType_GAUGE:
+				v := otlpDouble(m.GetGauge().GetValue())
+				dp.AsDouble = &v
+			case dto.MetricType_UNTYPED:
+				v := otlpDouble(m.GetUntyped().GetValue())
+				dp.AsDouble = &v
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				count, sum := otlpUint64(h.GetSampleCount()), otlpDouble(h.GetSampleSum())
+				dp.Count, dp.Sum = &count, &sum
+				// Prometheus buckets are cumulative whereas OTLP counts each bucket separately, with a final
+				// bucket for values above the highest bound.
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					dp.ExplicitBounds = append(dp.ExplicitBounds, otlpDouble(b.GetUpperBound()))
+					dp.BucketCounts = append(dp.BucketCounts, otlpUint64(b.GetCumulativeCount()-prev))
+					prev = b.GetCumulativeCount()
+				}
+				dp.BucketCounts = append(dp.BucketCounts, otlpUint64(h.GetSampleCount()-prev))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				count, sum := otlpUint64(s.GetSampleCount()), otlpDouble(s.GetSampleSum())
+				dp.Count, dp.Sum = &count, &sum
+				for _, q := range s.GetQuantile() {
+					dp.QuantileValues = append(dp.QuantileValues, otlpQuantile{
+						Quantile: otlpDouble(q.GetQuantile()),
+						Value:    otlpDouble(q.GetValue()),
+					})
+				}
+			}
+			data.DataPoints = append(data.DataPoints, dp)
+		}
+		metrics = append(metrics, om)
+	}
+	return metrics
+}
+
+// otlpResource returns the attributes identifying the exporter to the collector
+func otlpResource() []otlpAttribute {
+	attrs := []otlpAttribute{otlpAttr("service.name", "openotp_exporter"), otlpAttr("service.version", version)}
+	for k, v := range cfg().OTLP.ResourceAttributes {
+		attrs = append(attrs, otlpAttr(k, v))
+	}
+	return attrs
+}
+
+// otlpClient is the HTTP client used to send metrics and spans to the OTLP collector.  It's retained so that
+// connections are reused between exports, and replaced when the collector's TLS settings change.
+var otlpClient struct {
+	sync.Mutex
+	client    *http.Client
+	transport *http.Transport
+	caFile    string
+	insecure  bool
+}
+
+// otlpHTTPClient returns the HTTP client used to send metrics and spans to the OTLP collector
+func otlpHTTPClient() (*http.Client, error) {
+	otlpClient.Lock()
+	defer otlpClient.Unlock()
+	o := cfg().OTLP
+	if otlpClient.client != nil && otlpClient.caFile == o.CAFile && otlpClient.insecure == o.InsecureSkipVerify {
+		return otlpClient.client, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		pemCerts, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read OTLP CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in OTLP CA file %s", o.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if otlpClient.transport != nil {
+		otlpClient.transport.CloseIdleConnections()
+	}
+	otlpClient.transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	otlpClient.client = &http.Client{Transport: otlpClient.transport}
+	otlpClient.caFile, otlpClient.insecure = o.CAFile, o.InsecureSkipVerify
+	return otlpClient.client, nil
+}
+
+// exportOTLP gathers the metrics served by /metrics and sends them to the OTLP collector.  The request is limited by
+// the configured OTLP timeout, separately from any probes made by g.
+func exportOTLP(g prometheus.Gatherer) error {
+	families, err := g.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect along with the error
+		otlpLog.Warn("Some metrics could not be gathered", "err", err)
+	}
+	var sm otlpScopeMetrics
+	sm.Scope.Name = "github.com/crooks/openotp_exporter"
+	sm.Scope.Version = version
+	sm.Metrics = otlpMetrics(families, otlpStartTime, time.Now())
+	var rm otlpResourceMetrics
+	rm.Resource.Attributes = otlpResource()
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().OTLP.Timeout)
+	defer cancel()
+	return otlpPost(ctx, "/v1/metrics", otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}})
+}
+
+// otlpPost sends an OTLP export request to the collector
+func otlpPost(ctx context.Context, path string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client, err := otlpHTTPClient()
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(cfg().OTLP.Endpoint, "/") + path
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg().OTLP.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// otlpExporter periodically sends the metrics to the OTLP collector while one is configured
+func otlpExporter() {
+	for {
+		c := cfg()
+		if c.OTLP.Exports("metrics") {
+			// The probes made while gathering are limited by the API timeout, and the export by its own.
+			ctx, cancel := context.WithTimeout(context.Background(), c.API.Timeout)
+			if err := exportOTLP(withMetricFilters(targetGatherers(ctx, false))); err != nil {
+				otlpLog.Warn("Unable to export metrics", "endpoint", c.OTLP.Endpoint, "err", err)
+			} else {
+				otlpLog.Debug("Exported metrics", "endpoint", c.OTLP.Endpoint)
+			}
+			cancel()
+		}
+		time.Sleep(c.OTLP.Interval)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTLPStartTime(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "Test"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test", Help: "Test"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "Test"})
+	reg.MustRegister(counter, gauge, histogram)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, now := time.Unix(1000, 0), time.Unix(2000, 0)
+	for _, m := range otlpMetrics(families, start, now) {
+		var expected otlpUint64
+		data := m.Gauge
+		switch {
+		case m.Sum != nil:
+			data, expected = m.Sum, otlpUint64(start.UnixNano())
+		case m.Histogram != nil:
+			data, expected = m.Histogram, otlpUint64(start.UnixNano())
+		}
+		for _, dp := range data.DataPoints {
+			if dp.StartTimeUnixNano != expected {
+				t.Errorf("Unexpected start time of %s.  Expected=%d, Got=%d", m.Name, expected, dp.StartTimeUnixNano)
+			}
+			if dp.TimeUnixNano != otlpUint64(now.UnixNano()) {
+				t.Errorf("Unexpected time of %s.  Expected=%d, Got=%d", m.Name, now.UnixNano(), dp.TimeUnixNano)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// collectCA populates the CA metrics from the certificate and revocation list that WebADM publishes when its PKI
+// service is enabled.  These are plain HTTP resources rather than RPC methods so rpcClient isn't used.  WebADM stores
+// the certificates it issues to users in their userCertificate attribute, so they're counted in the directory when
+// one is configured.
+func (m *prometheusMetrics) collectCA(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	caCert, err := fetchPKIResource(ctx, target, "/cacert")
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(caCert)
+	if err != nil {
+		return fmt.Errorf("unable to parse CA certificate: %v", err)
+	}
+	m.caCertExpiry.Set(float64(cert.NotAfter.Unix()))
+
+	crlDER, err := fetchPKIResource(ctx, target, "/crl")
+	if err != nil {
+		return err
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		return fmt.Errorf("unable to parse CRL: %v", err)
+	}
+	m.caCertsRevoked.Set(float64(len(crl.RevokedCertificates)))
+
+	if cfg().LDAP.URL == "" {
+		return nil
+	}
+	userCerts, err := ldapUserCertificates(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to count issued certificates in ldap %s: %v", cfg().LDAP.URL, err)
+	}
+	issued := 0
+	for _, der := range userCerts {
+		// Certificates issued by other CAs aren't counted
+		if c, err := x509.ParseCertificate(der); err == nil && bytes.Equal(c.RawIssuer, cert.RawSubject) {
+			issued++
+		}
+	}
+	m.caCertsIssued.Set(float64(issued))
+	return nil
+}
+
+// fetchPKIResource retrieves a certificate or CRL from the WebADM server hosting the API at target.  PEM encoded
+// resources are decoded to DER.
+func fetchPKIResource(ctx context.Context, target, path string) ([]byte, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	u.RawQuery = ""
+	client, err := rpcPool.getHTTP(target)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u.Path, resp.Status)
+	}
+	// The client limits the size of the response
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	return data, nil
+}
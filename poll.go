@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pollReconcileInterval is how often the set of polled targets is compared with the configured targets
+const pollReconcileInterval = 10 * time.Second
+
+// pollKey identifies a polled target.  A change of module restarts the target's poller.
+type pollKey struct {
+	url    string
+	module string
+}
+
+// snapshot holds the results of a target's most recent poll and of its most recent successful one
+type snapshot struct {
+	current     *prometheus.Registry
+	currentTime time.Time
+	lastGood    *prometheus.Registry
+	goodTime    time.Time
+}
+
+// Gather returns the current results.  While the last good results are retained, they're served in place of all but
+// the probe metrics, which always describe the most recent poll.  If configured, each sample is timestamped with the
+// time of the poll that produced it.
+func (s *snapshot) Gather() ([]*dto.MetricFamily, error) {
+	current, err := s.current.Gather()
+	if err == nil && cfg().Exporter.ProbeTimestamps {
+		setTimestamps(current, s.currentTime)
+	}
+	if s.lastGood == nil || s.lastGood == s.current || err != nil {
+		return current, err
+	}
+	lastGood, err := s.lastGood.Gather()
+	if err != nil {
+		return current, nil
+	}
+	if cfg().Exporter.ProbeTimestamps {
+		setTimestamps(lastGood, s.goodTime)
+	}
+	families := lastGood[:0]
+	for _, mf := range lastGood {
+		if !isProbeMetric(mf.GetName()) {
+			families = append(families, mf)
+		}
+	}
+	for _, mf := range current {
+		if isProbeMetric(mf.GetName()) {
+			families = append(families, mf)
+		}
+	}
+	return families, nil
+}
+
+// setTimestamps sets the timestamp of every sample in families to t
+func setTimestamps(families []*dto.MetricFamily, t time.Time) {
+	ms := t.UnixMilli()
+	for _, mf := range families {
+		for _, metric := range mf.Metric {
+			metric.TimestampMs = &ms
+		}
+	}
+}
+
+// isProbeMetric returns true if name is one of the metrics describing the probe itself, rather than the target
+func isProbeMetric(name string) bool {
+	return strings.HasPrefix(name, "probe_") || strings.HasPrefix(name, addPrefix("probe_"))
+}
+
+// poller runs a background goroutine for each target, probing it at the poll interval and retaining the results
+// for /metrics to serve.
+type poller struct {
+	mu        sync.Mutex
+	cancels   map[pollKey]context.CancelFunc
+	snapshots map[pollKey]*snapshot
+}
+
+var polls = &poller{
+	cancels:   make(map[pollKey]context.CancelFunc),
+	snapshots: make(map[pollKey]*snapshot),
+}
+
+// run keeps a poller running for each of the configured targets while the exporter is in poll mode.  Targets may
+// change at any time through a config reload, the targets file or discovery.
+func (p *poller) run() {
+	for {
+		var targets []config.Target
+		if cfg().Exporter.Mode == "poll" {
+			targets = allTargets()
+		}
+		p.reconcile(targets)
+		time.Sleep(pollReconcileInterval)
+	}
+}
+
+// reconcile starts pollers for new targets and stops those of targets that are no longer configured
+func (p *poller) reconcile(targets []config.Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wanted := make(map[pollKey]bool)
+	for _, t := range targets {
+		key := pollKey{url: t.URL, module: t.Module}
+		wanted[key] = true
+		if _, ok := p.cancels[key]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.cancels[key] = cancel
+		mainLog.Debug("Starting poller", "target", t.URL, "module", t.Module)
+		go p.poll(ctx, key)
+	}
+	for key, cancel := range p.cancels {
+		if wanted[key] {
+			continue
+		}
+		mainLog.Debug("Stopping poller", "target", key.url, "module", key.module)
+		cancel()
+		delete(p.cancels, key)
+		delete(p.snapshots, key)
+	}
+}
+
+// poll probes a single target at the poll interval until ctx is cancelled
+func (p *poller) poll(ctx context.Context, key pollKey) {
+	for {
+		c := cfg()
+		reg := prometheus.NewRegistry()
+		m := initCollectors(prometheus.WrapRegistererWith(targetLabels(key.url), reg))
+		probeCtx, cancel := context.WithTimeout(ctx, c.API.Timeout)
+		success := m.probe(probeCtx, expandTarget(key.url), c.Modules[key.module], false)
+		cancel()
+		p.store(ctx, key, reg, success, c.Exporter.StaleAfter)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.Exporter.PollInterval):
+		}
+	}
+}
+
+// store records the results of a poll.  After a failure, the target's last good results continue to be served until
+// they're older than staleAfter, at which point they're dropped so that dashboards don't show stale values.
+func (p *poller) store(ctx context.Context, key pollKey, reg *prometheus.Registry, success bool, staleAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A cancelled poller's target has been removed and its snapshot mustn't be restored.
+	if ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	if success {
+		p.snapshots[key] = &snapshot{current: reg, currentTime: now, lastGood: reg, goodTime: now}
+		return
+	}
+	s, ok := p.snapshots[key]
+	if !ok || s.lastGood == nil || time.Since(s.goodTime) >= staleAfter {
+		if ok && s.lastGood != nil {
+			mainLog.Info("Dropping stale metrics", "target", key.url, "last_success", s.goodTime.Format(time.RFC3339))
+		}
+		p.snapshots[key] = &snapshot{current: reg, currentTime: now}
+		return
+	}
+	s.current = reg
+	s.currentTime = now
+}
+
+// gatherers returns the most recent snapshot of each target that has been polled at least once
+func (p *poller) gatherers() prometheus.Gatherers {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var g prometheus.Gatherers
+	for _, s := range p.snapshots {
+		// Snapshots are updated in place so a copy is gathered.
+		s := *s
+		g = append(g, &s)
+	}
+	return g
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// pooledClient is an RPC client, or a plain HTTP client, retained for reuse by later probes of the same target
+type pooledClient struct {
+	client     jsonrpc.RPCClient
+	httpClient *http.Client
+	transport  *http.Transport
+	lastUsed   time.Time
+}
+
+// clientPool retains an RPC client for each target so that connections, and their negotiated TLS sessions, are reused
+// between probes.  Clients that haven't been used within the idle timeout are evicted.
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+}
+
+var rpcPool = &clientPool{clients: make(map[string]*pooledClient)}
+
+// poolKey identifies a client by its URL and credentials, so that a change of credentials results in a new client.
+func poolKey(url, profile string) string {
+	username, password := apiCredentials(url, profile)
+	h := sha256.Sum256([]byte(username + "\x00" + password))
+	return url + " " + hex.EncodeToString(h[:])
+}
+
+// get returns a pooled RPC client for url, creating one if necessary
+func (p *clientPool) get(url, profile string) (jsonrpc.RPCClient, error) {
+	pc, err := p.lookup(poolKey(url, profile), func() (*pooledClient, error) {
+		client, tr, err := newRPCClient(url, profile)
+		if err != nil {
+			return nil, err
+		}
+		return &pooledClient{client: client, transport: tr}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pc.client, nil
+}
+
+// getHTTP returns a pooled HTTP client for plain requests to the WebADM server hosting the API at url, such as those
+// for its PKI resources.  It shares the TLS, proxy and response size settings of the RPC client, but doesn't send
+// the API credentials.
+func (p *clientPool) getHTTP(url string) (*http.Client, error) {
+	pc, err := p.lookup(url+" http", func() (*pooledClient, error) {
+		tr, err := newAPITransport(url)
+		if err != nil {
+			return nil, err
+		}
+		transport := tracingTransport{metricsTransport{limitTransport{next: tr, max: cfg().API.MaxResponseSize}}}
+		return &pooledClient{httpClient: &http.Client{Transport: transport}, transport: tr}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pc.httpClient, nil
+}
+
+// lookup returns the pooled client with the given key, calling create to add one if necessary
+func (p *clientPool) lookup(key string, create func() (*pooledClient, error)) (*pooledClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evictIdle()
+	if pc, ok := p.clients[key]; ok {
+		pc.lastUsed = time.Now()
+		if exporter != nil {
+			exporter.rpcPool.WithLabelValues("hit").Inc()
+		}
+		return pc, nil
+	}
+	if exporter != nil {
+		exporter.rpcPool.WithLabelValues("miss").Inc()
+	}
+	pc, err := create()
+	if err != nil {
+		return nil, err
+	}
+	pc.lastUsed = time.Now()
+	p.clients[key] = pc
+	return pc, nil
+}
+
+// evictIdle removes clients that haven't been used within the idle timeout.  The caller must hold p.mu.
+func (p *clientPool) evictIdle() {
+	for key, pc := range p.clients {
+		if time.Since(pc.lastUsed) > cfg().API.IdleTimeout {
+			pc.transport.CloseIdleConnections()
+			delete(p.clients, key)
+		}
+	}
+}
+
+// flush removes all the pooled clients.  It's called when the config is reloaded as the TLS settings may have
+// changed.
+func (p *clientPool) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pc := range p.clients {
+		pc.transport.CloseIdleConnections()
+		delete(p.clients, key)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// RADIUS packet codes and attribute types used by the Radius Bridge check (RFC 2865, RFC 3579)
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusState                = 24
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+)
+
+// radiusDefaultPort is used when the Radius Bridge address doesn't specify one
+const radiusDefaultPort = "1812"
+
+// radiusRetransmitInterval is how long to wait for a response before the first retransmission of a request.  RADIUS
+// runs over UDP so a lost packet is only recovered by sending it again.  The interval doubles after each
+// retransmission, as RFC 5080 section 2.2.1 recommends, until the probe's deadline.
+var radiusRetransmitInterval = 2 * time.Second
+
+// collectRadius sends an Access-Request for the canary account to the Radius Bridge.  The RADIUS front-end can be
+// broken while OpenOTP itself reports healthy.
+func (m *prometheusMetrics) collectRadius(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	address := cfg().Radius.Address
+	if address == "" {
+		// The Radius Bridge is assumed to run on the WebADM server
+		u, err := url.Parse(target)
+		if err != nil {
+			return err
+		}
+		address = u.Hostname()
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, radiusDefaultPort)
+	}
+	start := time.Now()
+	err := radiusLogin(ctx, address)
+	m.radiusAuthDuration.Set(time.Since(start).Seconds())
+	m.radiusAuthSuccess.Set(boolToFloat(err == nil))
+	if err != nil {
+		return fmt.Errorf("radius bridge %s: %v", address, err)
+	}
+	return nil
+}
+
+// radiusLogin authenticates the canary account through the RADIUS server at address.  If it responds with a challenge,
+// the canary's static OTP is submitted.
+func radiusLogin(ctx context.Context, address string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	code, state, err := radiusExchange(ctx, conn, 0, cfg().Canary.Password, nil)
+	if err != nil {
+		return err
+	}
+	if code == radiusAccessChallenge {
+		if cfg().Canary.OTP == "" {
+			return fmt.Errorf("challenged for an OTP but none is configured")
+		}
+		code, _, err = radiusExchange(ctx, conn, 1, cfg().Canary.OTP, state)
+		if err != nil {
+			return err
+		}
+	}
+	switch code {
+	case radiusAccessAccept:
+		return nil
+	case radiusAccessReject:
+		return errors.New("access rejected")
+	}
+	return fmt.Errorf("unexpected response code %d", code)
+}
+
+// radiusExchange sends an Access-Request and returns the code and State attribute of the verified response.  The
+// request is retransmitted, unchanged, until a response arrives or ctx expires.
+func radiusExchange(ctx context.Context, conn net.Conn, id byte, password string, state []byte) (byte, []byte, error) {
+	secret := []byte(cfg().Radius.Secret)
+	authenticator := make([]byte, 16)
+	if _, err := rand.Read(authenticator); err != nil {
+		return 0, nil, err
+	}
+	var attrs bytes.Buffer
+	radiusAttr(&attrs, radiusUserName, []byte(cfg().Canary.Username))
+	radiusAttr(&attrs, radiusUserPassword, radiusHidePassword([]byte(password), secret, authenticator))
+	radiusAttr(&attrs, radiusNASIdentifier, []byte(cfg().Radius.NASIdentifier))
+	if state != nil {
+		radiusAttr(&attrs, radiusState, state)
+	}
+	// The Message-Authenticator is calculated over the packet with the attribute's value zeroed.
+	radiusAttr(&attrs, radiusMessageAuthenticator, make([]byte, 16))
+	packet := radiusPacket(radiusAccessRequest, id, authenticator, attrs.Bytes())
+	mac := hmac.New(md5.New, secret)
+	mac.Write(packet)
+	copy(packet[len(packet)-16:], mac.Sum(nil))
+
+	interval := radiusRetransmitInterval
+	for {
+		if _, err := conn.Write(packet); err != nil {
+			return 0, nil, err
+		}
+		deadline := time.Now().Add(interval)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		code, state, err := radiusRead(conn, id, authenticator, secret)
+		var netErr net.Error
+		if err == nil || !errors.As(err, &netErr) || !netErr.Timeout() || ctx.Err() != nil {
+			return code, state, err
+		}
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return 0, nil, err
+		}
+		interval *= 2
+	}
+}
+
+// radiusRead waits for the response to the request with the given ID and authenticator, returning its code and
+// State attribute once verified
+func radiusRead(conn net.Conn, id byte, authenticator, secret []byte) (byte, []byte, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		resp := buf[:n]
+		if n < 20 || resp[1] != id {
+			// Ignore stray responses, such as a late reply to an earlier request
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(resp[2:4]))
+		if length < 20 || length > n {
+			return 0, nil, fmt.Errorf("malformed response")
+		}
+		resp = resp[:length]
+		// The response authenticator is MD5(Code+ID+Length+RequestAuth+Attributes+Secret)
+		h := md5.New()
+		h.Write(resp[:4])
+		h.Write(authenticator)
+		h.Write(resp[20:])
+		h.Write(secret)
+		if !hmac.Equal(h.Sum(nil), resp[4:20]) {
+			return 0, nil, fmt.Errorf("response authenticator mismatch, check the shared secret")
+		}
+		return resp[0], radiusFindAttr(resp[20:], radiusState), nil
+	}
+}
+
+// radiusPacket assembles a RADIUS packet
+func radiusPacket(code, id byte, authenticator, attrs []byte) []byte {
+	packet := make([]byte, 20, 20+len(attrs))
+	packet[0] = code
+	packet[1] = id
+	binary.BigEndian.PutUint16(packet[2:4], uint16(20+len(attrs)))
+	copy(packet[4:20], authenticator)
+	return append(packet, attrs...)
+}
+
+// radiusAttr appends an attribute to buf
+func radiusAttr(buf *bytes.Buffer, attrType byte, value []byte) {
+	buf.WriteByte(attrType)
+	buf.WriteByte(byte(len(value) + 2))
+	buf.Write(value)
+}
+
+// radiusFindAttr returns the value of the first attribute of the given type, or nil
+func radiusFindAttr(attrs []byte, attrType byte) []byte {
+	for len(attrs) >= 2 {
+		length := int(attrs[1])
+		if length < 2 || length > len(attrs) {
+			return nil
+		}
+		if attrs[0] == attrType {
+			return attrs[2:length]
+		}
+		attrs = attrs[length:]
+	}
+	return nil
+}
+
+// radiusHidePassword obfuscates a User-Password attribute as described in RFC 2865 section 5.2
+func radiusHidePassword(password, secret, authenticator []byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	prev := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= b[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+func TestRadiusHidePassword(t *testing.T) {
+	// The example of RFC 2865 section 7.1
+	authenticator, _ := hex.DecodeString("0f403f9473978057bd83d5cb98f4227a")
+	hidden := radiusHidePassword([]byte("arctangent"), []byte("xyzzy5461"), authenticator)
+	if got := hex.EncodeToString(hidden); got != "0dbe708d93d413ce3196e43f782a0aee" {
+		t.Errorf("Unexpected hidden password.  Expected=0dbe708d93d413ce3196e43f782a0aee, Got=%s", got)
+	}
+	tests := []struct {
+		password string
+		length   int
+	}{
+		{"", 16},
+		{"0123456789abcdef", 16},
+		{"0123456789abcdefg", 32},
+	}
+	for _, test := range tests {
+		if n := len(radiusHidePassword([]byte(test.password), []byte("secret"), authenticator)); n != test.length {
+			t.Errorf("Unexpected length for %q.  Expected=%d, Got=%d", test.password, test.length, n)
+		}
+	}
+}
+
+func TestRadiusPacket(t *testing.T) {
+	var attrs bytes.Buffer
+	radiusAttr(&attrs, radiusUserName, []byte("canary"))
+	radiusAttr(&attrs, radiusState, []byte{1, 2, 3})
+	packet := radiusPacket(radiusAccessRequest, 7, make([]byte, 16), attrs.Bytes())
+	expected := "01070021" + "00000000000000000000000000000000" + "0108" + hex.EncodeToString([]byte("canary")) +
+		"1805010203"
+	if got := hex.EncodeToString(packet); got != expected {
+		t.Errorf("Unexpected packet.  Expected=%s, Got=%s", expected, got)
+	}
+
+	tests := []struct {
+		attrs    []byte
+		attrType byte
+		value    []byte
+	}{
+		{attrs.Bytes(), radiusUserName, []byte("canary")},
+		{attrs.Bytes(), radiusState, []byte{1, 2, 3}},
+		{attrs.Bytes(), radiusNASIdentifier, nil},
+		{[]byte{radiusState, 1, 0}, radiusState, nil},
+		{[]byte{radiusState, 9, 0}, radiusState, nil},
+	}
+	for _, test := range tests {
+		if value := radiusFindAttr(test.attrs, test.attrType); !bytes.Equal(value, test.value) {
+			t.Errorf("Unexpected value of attribute %d in %x.  Expected=%x, Got=%x", test.attrType, test.attrs, test.value,
+				value)
+		}
+	}
+}
+
+func TestRadiusRetransmit(t *testing.T) {
+	c := new(config.Config)
+	c.Radius.Secret = "secret"
+	c.Canary.Username = "canary"
+	c.Canary.Password = "password"
+	currentConfig.Store(c)
+	defer func(interval time.Duration) { radiusRetransmitInterval = interval }(radiusRetransmitInterval)
+	radiusRetransmitInterval = 50 * time.Millisecond
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	requests := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 4096)
+		for received := 0; ; received++ {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := append([]byte(nil), buf[:n]...)
+			requests <- request
+			if received == 0 {
+				// Drop the first request
+				continue
+			}
+			resp := radiusPacket(radiusAccessAccept, request[1], make([]byte, 16), nil)
+			h := md5.New()
+			h.Write(resp[:4])
+			h.Write(request[4:20])
+			h.Write([]byte("secret"))
+			copy(resp[4:20], h.Sum(nil))
+			server.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := radiusLogin(ctx, server.LocalAddr().String()); err != nil {
+		t.Fatalf("radiusLogin returned: %v", err)
+	}
+	if n := len(requests); n != 2 {
+		t.Fatalf("Unexpected number of requests.  Expected=2, Got=%d", n)
+	}
+	if first, second := <-requests, <-requests; !bytes.Equal(first, second) {
+		t.Error("Retransmitted request differs from the original")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// tokenBucket permits requests at rate per second, with bursts of up to burst requests.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// wait refills the bucket and returns how long the caller must wait for a token, or zero if one is available.  The
+// token isn't removed so that a request can be checked against several buckets before any of them are charged.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full returns true if the bucket has refilled completely, in which case it's equivalent to a new bucket.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// rateLimiter applies the global and per-client token buckets to probe requests.  It's reset when the configured
+// limits change.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  config.RateLimit
+	global  *tokenBucket
+	clients map[string]*tokenBucket
+	pruned  time.Time
+}
+
+var probeLimiter = &rateLimiter{clients: make(map[string]*tokenBucket)}
+
+// allow returns true if a request from client is within the limits, taking a token from each bucket.  Otherwise it
+// returns the time until it would be permitted and the limit that was exceeded, and no tokens are taken, so that
+// requests rejected by one limit don't consume the other.
+func (l *rateLimiter) allow(limits config.RateLimit, client string) (bool, time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if limits != l.limits {
+		l.limits = limits
+		l.global = nil
+		if limits.Rate > 0 {
+			l.global = newTokenBucket(limits.Rate, limits.Burst, now)
+		}
+		l.clients = make(map[string]*tokenBucket)
+	}
+	if l.global != nil {
+		if wait := l.global.wait(now); wait > 0 {
+			return false, wait, "global"
+		}
+	}
+	if limits.PerClientRate > 0 {
+		// Buckets that have refilled are discarded so clients that have gone away don't accumulate.
+		if now.Sub(l.pruned) > time.Minute {
+			for c, b := range l.clients {
+				if b.full(now) {
+					delete(l.clients, c)
+				}
+			}
+			l.pruned = now
+		}
+		b, ok := l.clients[client]
+		if !ok {
+			b = newTokenBucket(limits.PerClientRate, limits.PerClientBurst, now)
+			l.clients[client] = b
+		}
+		if wait := b.wait(now); wait > 0 {
+			return false, wait, "client"
+		}
+		b.tokens--
+	}
+	if l.global != nil {
+		l.global.tokens--
+	}
+	return true, 0, ""
+}
+
+// withRateLimit wraps a handler so that requests exceeding the configured rates are rejected with 429 Too Many
+// Requests.
+func withRateLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		ok, wait, scope := probeLimiter.allow(cfg().Exporter.RateLimit, client)
+		if !ok {
+			exporter.rateLimited.WithLabelValues(scope).Inc()
+			httpLog.Debug("Request rate limited", "remote", r.RemoteAddr, "limit", scope)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// redacted replaces sensitive values in log output
+const redacted = "<redacted>"
+
+// minSecretLength is the length below which configured secrets aren't redacted, as replacing every occurrence of a
+// very short string would make the logs unreadable.
+const minSecretLength = 3
+
+var (
+	// authHeaderRE matches the credentials in Authorization headers
+	authHeaderRE = regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*["']?(?:basic|bearer|digest|negotiate)\s+)[^\s"',]+`)
+	// querySecretRE matches sensitive query string and form parameters
+	querySecretRE = regexp.MustCompile(`(?i)([?&](?:password|passwd|pass|secret|secret_id|token|api_key|apikey)=)[^&\s"']+`)
+	// userinfoRE matches passwords embedded in URLs
+	userinfoRE = regexp.MustCompile(`(://[^/:@\s]+:)[^/@\s]+@`)
+)
+
+// redactedSecrets are the configured secrets that are removed from log output
+var redactedSecrets atomic.Pointer[[]string]
+
+// setRedactedSecrets records the secrets in c for removal from log output.  It must be called whenever the config
+// changes.
+func setRedactedSecrets(c *config.Config) {
+	candidates := []string{
+		c.API.Password,
+		c.API.ClientKeyPassphrase,
+		c.Exporter.BearerToken,
+		c.Secrets.Vault.Token,
+		c.Secrets.Vault.SecretID,
+		c.Canary.Password,
+		c.Canary.OTP,
+		c.Radius.Secret,
+		c.LDAP.BindPassword,
+		c.Pushgateway.Password,
+		c.API.ProxyPassword,
+		c.API.Auth.Token,
+	}
+	for _, p := range c.Credentials {
+		candidates = append(candidates, p.Password)
+	}
+	for _, p := range c.Exporter.BasicAuthUsers {
+		candidates = append(candidates, p)
+	}
+	// OTLP headers typically carry an API key, and API headers may carry tokens for a WAF
+	for _, h := range c.OTLP.Headers {
+		candidates = append(candidates, h)
+	}
+	for _, h := range c.API.Headers {
+		candidates = append(candidates, h)
+	}
+	for _, t := range c.Targets {
+		for _, h := range t.Headers {
+			candidates = append(candidates, h)
+		}
+		if t.Auth != nil {
+			candidates = append(candidates, t.Auth.Token)
+		}
+	}
+	var secrets []string
+	for _, s := range candidates {
+		if len(s) >= minSecretLength {
+			secrets = append(secrets, s)
+		}
+	}
+	redactedSecrets.Store(&secrets)
+}
+
+// redactString removes credentials from s
+func redactString(s string) string {
+	if secrets := redactedSecrets.Load(); secrets != nil {
+		for _, secret := range *secrets {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	if v := vaultCreds.Load(); v != nil && len(v.password) >= minSecretLength {
+		s = strings.ReplaceAll(s, v.password, redacted)
+	}
+	for _, password := range keyringSecrets() {
+		if len(password) >= minSecretLength {
+			s = strings.ReplaceAll(s, password, redacted)
+		}
+	}
+	s = authHeaderRE.ReplaceAllString(s, "${1}"+redacted)
+	s = querySecretRE.ReplaceAllString(s, "${1}"+redacted)
+	s = userinfoRE.ReplaceAllString(s, "${1}"+redacted+"@")
+	return s
+}
+
+// redactAttr removes credentials from the value of a log attribute.  Strings, errors and other values that are
+// formatted as strings are redacted; numeric values are left unchanged.
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		attrs := v.Group()
+		redactedAttrs := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redactedAttrs[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redactedAttrs...)}
+	case slog.KindString, slog.KindAny:
+		s := v.String()
+		if r := redactString(s); r != s {
+			return slog.String(a.Key, r)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactRecord returns a copy of r with credentials removed from the message and attributes
+func redactRecord(r slog.Record) slog.Record {
+	out := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return out
+}
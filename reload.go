@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// targetsFileInterval is how often the targets file is checked for changes
+const targetsFileInterval = 30 * time.Second
+
+// currentConfig holds the running config.  A reload replaces the config rather than modifying it, so that it needn't
+// wait for the requests and probes in progress, which may continue to read the previous config.
+var currentConfig atomic.Pointer[config.Config]
+
+// reloadMutex serialises config reloads
+var reloadMutex sync.Mutex
+
+// cfg returns the running config
+func cfg() *config.Config {
+	return currentConfig.Load()
+}
+
+// reloadConfig parses the config file and, if it's valid, replaces the running config with it.  Changes to the
+// listening address, or to enabling/disabling TLS on the listener, require a restart.
+func reloadConfig() error {
+	newCfg, err := config.ParseConfig(flags.Config)
+	if err != nil {
+		return err
+	}
+	if err := checkTargetLabels(newCfg); err != nil {
+		return err
+	}
+	if err := checkCustomMetrics(newCfg); err != nil {
+		return err
+	}
+	if err := checkKerberos(newCfg); err != nil {
+		return err
+	}
+	levels, err := parseLevels(newCfg.Logging)
+	if err != nil {
+		return fmt.Errorf("unable to set log level: %v", err)
+	}
+	// Listener TLS material is only reloaded if the listener is already serving TLS.
+	var tlsConfig *tls.Config
+	if newCfg.Exporter.TLS.Enabled() && listenerTLS.Load() != nil {
+		tlsConfig, err = serverTLSConfig(newCfg.Exporter.TLS)
+		if err != nil {
+			return err
+		}
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	if newCfg.Exporter.Hostname != cfg().Exporter.Hostname || newCfg.Exporter.Port != cfg().Exporter.Port ||
+		newCfg.Exporter.Listen != cfg().Exporter.Listen {
+		configLog.Warn("Changes to the exporter's listening address require a restart")
+	}
+	if newCfg.Exporter.HTTPServer != cfg().Exporter.HTTPServer {
+		configLog.Warn("Changes to the exporter's HTTP server limits require a restart")
+	}
+	if newCfg.Exporter.TLS.Enabled() != cfg().Exporter.TLS.Enabled() {
+		configLog.Warn("Enabling or disabling TLS on the exporter's listener requires a restart")
+	}
+	if newCfg.Logging.Journal != cfg().Logging.Journal || newCfg.Logging.Filename != cfg().Logging.Filename ||
+		newCfg.Logging.Format != cfg().Logging.Format {
+		configLog.Warn("Changes to the log destination or format require a restart")
+	}
+	currentLevels.Store(levels)
+	setRedactedSecrets(newCfg)
+	setProbeLimit(newCfg.Exporter.MaxConcurrentProbes)
+	if tlsConfig != nil {
+		listenerTLS.Store(tlsConfig)
+	}
+	currentConfig.Store(newCfg)
+	flushKeyring()
+	rpcPool.flush()
+	return nil
+}
+
+// reloadStatus records the outcome of the most recent config load for the landing page
+var reloadStatus struct {
+	sync.Mutex
+	err         error
+	lastSuccess time.Time
+}
+
+// recordReload records the outcome of a config load in the exporter's metrics and the reload status.
+func recordReload(m *exporterMetrics, err error) {
+	reloadStatus.Lock()
+	defer reloadStatus.Unlock()
+	reloadStatus.err = err
+	if err != nil {
+		m.configReloadSuccess.Set(0)
+		return
+	}
+	reloadStatus.lastSuccess = time.Now()
+	m.configReloadSuccess.Set(1)
+	m.configReloadTime.SetToCurrentTime()
+}
+
+// reload performs a config reload and records the outcome.
+func reload(m *exporterMetrics) error {
+	err := reloadConfig()
+	recordReload(m, err)
+	if err != nil {
+		configLog.Warn("Config reload failed", "err", err)
+		return err
+	}
+	configLog.Info("Config reloaded", "filename", flags.Config)
+	return nil
+}
+
+// reloadHandler triggers a config reload in response to a POST request to /-/reload.
+func reloadHandler(w http.ResponseWriter, r *http.Request, m *exporterMetrics) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reload(m); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Config reloaded")
+}
+
+// reloadOnSIGHUP reloads the config whenever the process receives a SIGHUP.
+func reloadOnSIGHUP(m *exporterMetrics) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		configLog.Info("Received SIGHUP, reloading config")
+		reload(m)
+	}
+}
+
+// watchTargetsFile polls the targets file and reloads the config whenever the file is modified.
+func watchTargetsFile(m *exporterMetrics) {
+	var lastMod time.Time
+	for {
+		filename := cfg().TargetsFile
+		if filename != "" {
+			info, err := os.Stat(filename)
+			if err != nil {
+				configLog.Warn("Unable to stat targets file", "err", err)
+			} else if lastMod.IsZero() {
+				// The file was read when the config was parsed
+				lastMod = info.ModTime()
+			} else if !info.ModTime().Equal(lastMod) {
+				lastMod = info.ModTime()
+				configLog.Info("Targets file has changed, reloading config", "filename", filename)
+				reload(m)
+			}
+		}
+		time.Sleep(targetsFileInterval)
+	}
+}
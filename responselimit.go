@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// errResponseTooLarge is returned when reading an API response that exceeds the configured maximum size
+var errResponseTooLarge = errors.New("response too large")
+
+// oversizeKey is the context key of the flag set when a probe's response exceeds the maximum size
+type oversizeKey struct{}
+
+// withOversizeFlag returns a context that records whether any response to requests made with it was too large.
+// The error returned by the RPC client doesn't wrap the one from the response body, so the flag is the only reliable
+// way to tell why the call failed.
+func withOversizeFlag(ctx context.Context) (context.Context, *atomic.Bool) {
+	flag := new(atomic.Bool)
+	return context.WithValue(ctx, oversizeKey{}, flag), flag
+}
+
+// limitTransport fails the reading of responses larger than max bytes, so that a misbehaving endpoint can't exhaust
+// the exporter's memory.
+type limitTransport struct {
+	next http.RoundTripper
+	max  int64
+}
+
+func (t limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || t.max <= 0 {
+		return resp, err
+	}
+	flag, _ := req.Context().Value(oversizeKey{}).(*atomic.Bool)
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.max, max: t.max, flag: flag}
+	return resp, nil
+}
+
+// limitedBody is a response body that returns errResponseTooLarge once more than max bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	max       int64
+	flag      *atomic.Bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Check whether the body ended exactly at the limit
+		var one [1]byte
+		if n, err := b.ReadCloser.Read(one[:]); n == 0 {
+			return 0, err
+		}
+		if b.flag != nil {
+			b.flag.Store(true)
+		}
+		return 0, fmt.Errorf("%w: exceeds %d bytes", errResponseTooLarge, b.max)
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// retryClass returns the class of a failed RPC batch, as used in the retry_on config, or an empty string if the
+// failure isn't one that can be retried.
+func retryClass(err error) string {
+	var httpErr *jsonrpc.HTTPError
+	var soapErr *soapHTTPError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &httpErr):
+		return strconv.Itoa(httpErr.Code)
+	case errors.As(err, &soapErr):
+		return strconv.Itoa(soapErr.code)
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return ""
+}
+
+// retryable returns true if err is one of the classes of failure that the config permits to be retried
+func retryable(r config.Retry, err error) bool {
+	class := retryClass(err)
+	for _, c := range r.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, starting from zero
+func backoff(r config.Retry, retry int) time.Duration {
+	d := r.Backoff << retry
+	if d > r.MaxBackoff || d <= 0 {
+		d = r.MaxBackoff
+	}
+	// Spread the delay by up to the jitter fraction either side.
+	jitter := (rand.Float64()*2 - 1) * r.Jitter * float64(d)
+	return d + time.Duration(jitter)
+}
+
+// withRetry calls fn, retrying transient failures as configured until the retries are exhausted or ctx expires.
+func withRetry[T any](ctx context.Context, target string, fn func() (T, error)) (T, error) {
+	r := cfg().API.Retry
+	for retry := 0; ; retry++ {
+		result, err := fn()
+		if err == nil || retry >= r.Count || ctx.Err() != nil || !retryable(r, err) {
+			return result, err
+		}
+		delay := backoff(r, retry)
+		rpcLog.Debug("Retrying failed RPC batch", "target", target, "err", err, "delay", delay)
+		if exporter != nil {
+			exporter.retries.WithLabelValues(target).Inc()
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, err
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat is appended to the names of rotated log files.  It sorts chronologically.
+const rotateTimeFormat = "20060102T150405.000"
+
+// rotatingWriter is a log file that's rotated when it exceeds a maximum size or age.  Rotated files are renamed with
+// a timestamp suffix, optionally compressed, and the oldest are removed once there are more than maxBackups.
+type rotatingWriter struct {
+	mu         sync.Mutex
+	filename   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	file       *os.File
+	size       int64
+	opened     time.Time
+	// cleanup serialises the background compression and removal of rotated files, which Close waits for
+	cleanup   sync.Mutex
+	cleanupWG sync.WaitGroup
+}
+
+// newRotatingWriter opens filename for appending.  A maxSize or maxAge of zero disables rotation on that basis and a
+// maxBackups of zero retains all rotated files.
+func newRotatingWriter(filename string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingWriter, error) {
+	w := &rotatingWriter{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the log file, creating it if necessary
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	tooBig := w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize
+	tooOld := w.maxAge > 0 && time.Since(w.opened) > w.maxAge
+	if tooBig || tooOld {
+		if err := w.rotate(); err != nil {
+			// Keep logging to the current file rather than losing messages.
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %s: %v\n", w.filename, err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file once any background compression and removal of rotated files has finished
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cleanupWG.Wait()
+	return w.file.Close()
+}
+
+// rotate renames the current log file and opens a new one
+func (w *rotatingWriter) rotate() error {
+	stem := w.filename + "." + time.Now().Format(rotateTimeFormat)
+	rotated := stem
+	// Rotations within the same millisecond are distinguished by a sequence number, which sorts after the first.
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s-%d", stem, i)
+	}
+	if err := os.Rename(w.filename, rotated); err != nil {
+		return err
+	}
+	w.file.Close()
+	if err := w.open(); err != nil {
+		return err
+	}
+	// Compression and removal of old files happen in the background so that logging isn't held up.  Old files are
+	// only removed once compression has finished, so that a file isn't counted, or removed, part way through.
+	w.cleanupWG.Add(1)
+	go func() {
+		defer w.cleanupWG.Done()
+		w.cleanup.Lock()
+		defer w.cleanup.Unlock()
+		if w.compress {
+			if err := compressFile(rotated); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to compress log file %s: %v\n", rotated, err)
+			}
+		}
+		w.removeOldBackups()
+	}()
+	return nil
+}
+
+// removeOldBackups removes the oldest rotated files once there are more than maxBackups.  A backup is identified by
+// its timestamp suffix, so a file and its compressed copy, left by an interrupted compression, count once.
+func (w *rotatingWriter) removeOldBackups() {
+	if w.maxBackups <= 0 {
+		return
+	}
+	files, err := filepath.Glob(w.filename + ".*")
+	if err != nil {
+		return
+	}
+	backups := make(map[string][]string)
+	for _, f := range files {
+		stem := strings.TrimSuffix(f, ".gz")
+		backups[stem] = append(backups[stem], f)
+	}
+	if len(backups) <= w.maxBackups {
+		return
+	}
+	stems := make([]string, 0, len(backups))
+	for stem := range backups {
+		stems = append(stems, stem)
+	}
+	// The timestamp suffixes sort from oldest to newest
+	sort.Strings(stems)
+	for _, stem := range stems[:len(stems)-w.maxBackups] {
+		for _, f := range backups[stem] {
+			os.Remove(f)
+		}
+	}
+}
+
+// exists returns true if filename exists
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// compressFile gzips filename and removes the original
+func compressFile(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filename+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
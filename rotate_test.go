@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingWriter(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "test.log")
+		w, err := newRotatingWriter(filename, 10, 0, 2, compress)
+		if err != nil {
+			t.Fatalf("newRotatingWriter returned: %v", err)
+		}
+		// The rotations happen within the same millisecond, so the rotated files must be named uniquely.
+		for i := 0; i < 5; i++ {
+			if _, err := w.Write([]byte("12345678\n")); err != nil {
+				t.Fatalf("Write returned: %v", err)
+			}
+		}
+		// Close waits for the background compression and removal of old backups
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close returned: %v", err)
+		}
+		backups, _ := filepath.Glob(filename + ".*")
+		if len(backups) != 2 {
+			t.Errorf("Unexpected number of backups with compress=%v. Expected=2, Got=%v", compress, backups)
+		}
+		for _, b := range backups {
+			if strings.HasSuffix(b, ".gz") != compress {
+				t.Errorf("Unexpected backup with compress=%v: %s", compress, b)
+			}
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatalf("Stat returned: %v", err)
+		}
+		if info.Size() != 9 {
+			t.Errorf("Unexpected log file size. Expected=9, Got=%d", info.Size())
+		}
+	}
+}
+
+func TestRemoveOldBackups(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.log")
+	// An interrupted compression leaves both a file and its compressed copy, which count as one backup.
+	files := []string{
+		".20240101T000000.000.gz",
+		".20240102T000000.000",
+		".20240102T000000.000.gz",
+		".20240103T000000.000",
+		".20240103T000000.000-1.gz",
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filename+f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &rotatingWriter{filename: filename, maxBackups: 2}
+	w.removeOldBackups()
+	backups, _ := filepath.Glob(filename + ".*")
+	expected := []string{filename + files[3], filename + files[4]}
+	if strings.Join(backups, " ") != strings.Join(expected, " ") {
+		t.Errorf("Unexpected backups. Expected=%v, Got=%v", expected, backups)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/crooks/openotp_exporter/config"
+	"gopkg.in/yaml.v3"
+)
+
+// scrapeConfig is a Prometheus scrape_config job for the multi-target pattern, where each target is probed through
+// the exporter's /probe endpoint.
+type scrapeConfig struct {
+	JobName        string          `yaml:"job_name"`
+	MetricsPath    string          `yaml:"metrics_path"`
+	Scheme         string          `yaml:"scheme,omitempty"`
+	StaticConfigs  []staticConfig  `yaml:"static_configs"`
+	RelabelConfigs []relabelConfig `yaml:"relabel_configs"`
+}
+
+type staticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,omitempty"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+}
+
+// exporterAddress returns the address at which Prometheus can reach the exporter, assuming it runs on the same host
+// when the exporter listens on all interfaces.
+func exporterAddress(c *config.Config) string {
+	host := c.Exporter.Hostname
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Exporter.Port))
+}
+
+// genScrapeConfigCommand prints a Prometheus scrape config that probes the configured targets through the exporter,
+// so that the two configs can be kept in sync.
+func genScrapeConfigCommand() int {
+	if len(cfg().Targets) == 0 {
+		fmt.Fprintln(os.Stderr, "No targets are configured")
+		return 1
+	}
+	address := flags.ExporterAddress
+	if address == "" {
+		address = exporterAddress(cfg())
+	}
+	data, err := scrapeConfigYAML(flags.Job, address, cfg().Exporter.TLS.Enabled(), cfg().Targets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to generate scrape config: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
+// scrapeConfigYAML returns a scrape_configs section that probes targets through the exporter at address.  Each
+// target's module and labels are passed on with it.
+func scrapeConfigYAML(job, address string, tls bool, targets []config.Target) ([]byte, error) {
+	sc := scrapeConfig{
+		JobName:     job,
+		MetricsPath: "/probe",
+		RelabelConfigs: []relabelConfig{
+			{SourceLabels: []string{"__address__"}, TargetLabel: "__param_target"},
+			{SourceLabels: []string{"__param_target"}, TargetLabel: "instance"},
+			{TargetLabel: "__address__", Replacement: address},
+		},
+	}
+	if tls {
+		sc.Scheme = "https"
+	}
+	for _, t := range targets {
+		labels := map[string]string{"__param_module": t.Module}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		sc.StaticConfigs = append(sc.StaticConfigs, staticConfig{Targets: []string{t.URL}, Labels: labels})
+	}
+	return yaml.Marshal(map[string][]scrapeConfig{"scrape_configs": {sc}})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// sdTargetGroup is a group of targets in the format expected by Prometheus' http_sd_config
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler publishes the configured targets for Prometheus HTTP service discovery.  Each target is labelled with its
+// module and any labels defined against it in the config.
+func sdHandler(w http.ResponseWriter, r *http.Request) {
+	targets := allTargets()
+	groups := make([]sdTargetGroup, 0, len(targets))
+	for _, t := range targets {
+		labels := map[string]string{"module": t.Module}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		groups = append(groups, sdTargetGroup{Targets: []string{t.URL}, Labels: labels})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		httpLog.Warn("Unable to write service discovery response", "err", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// stopSignals receives the signals that shut the exporter down.  The Windows service control handler also sends to
+// it when the service is stopped.
+var stopSignals = make(chan os.Signal, 1)
+
+// listenerTLS holds the current tls.Config for the exporter's listener.  It's replaced when the config is reloaded.
+var listenerTLS atomic.Pointer[tls.Config]
+
+// serverTLSConfig returns a tls.Config for the exporter's listener, constructed from the tls_server_config section
+// of the config file.
+func serverTLSConfig(c config.TLSServerConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load listener certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   c.ClientAuth(),
+	}
+	if c.MinVersion != 0 {
+		tlsConfig.MinVersion = uint16(c.MinVersion)
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// listenAddress returns the network and address the exporter listens on
+func listenAddress() (network, address string) {
+	if path, ok := strings.CutPrefix(cfg().Exporter.Listen, "unix://"); ok {
+		return "unix", path
+	}
+	if cfg().Exporter.Listen != "" {
+		return "tcp", cfg().Exporter.Listen
+	}
+	return "tcp", fmt.Sprintf("%s:%d", cfg().Exporter.Hostname, cfg().Exporter.Port)
+}
+
+// listen opens the exporter's listener.  Unix domain sockets left behind by a previous run are removed, and new
+// sockets are given the configured permissions and ownership.
+func listen(network, address string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket: %v", err)
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := chownSocket(address); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// chownSocket applies the configured permissions and ownership to a Unix domain socket
+func chownSocket(path string) error {
+	if err := os.Chmod(path, cfg().Exporter.SocketPerm); err != nil {
+		return fmt.Errorf("unable to set socket mode: %v", err)
+	}
+	uid, gid := -1, -1
+	if cfg().Exporter.SocketOwner != "" {
+		u, err := user.Lookup(cfg().Exporter.SocketOwner)
+		if err != nil {
+			return fmt.Errorf("unable to look up socket owner: %v", err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid for socket owner %s: %v", u.Username, err)
+		}
+	}
+	if cfg().Exporter.SocketGroup != "" {
+		g, err := user.LookupGroup(cfg().Exporter.SocketGroup)
+		if err != nil {
+			return fmt.Errorf("unable to look up socket group: %v", err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid for socket group %s: %v", g.Name, err)
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("unable to set socket ownership: %v", err)
+	}
+	return nil
+}
+
+// newServer returns an http.Server for handler with the configured timeouts and limits
+func newServer(handler http.Handler) *http.Server {
+	c := cfg().Exporter.HTTPServer
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
+// listenAndServe starts the exporter's HTTP server, using TLS if it has been configured.  It blocks until the server
+// fails or the process receives SIGINT/SIGTERM, at which point in-flight requests are given the configured drain
+// timeout to complete before their outstanding RPC calls are cancelled.  A socket passed by systemd socket activation
+// takes precedence over the configured address.
+func listenAndServe(network, address string, handler http.Handler) error {
+	// All request contexts derive from baseCtx so cancelling it aborts any outstanding probes.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	srv := newServer(handler)
+	srv.BaseContext = func(net.Listener) context.Context {
+		return baseCtx
+	}
+	if cfg().Exporter.TLS.Enabled() {
+		tlsConfig, err := serverTLSConfig(cfg().Exporter.TLS)
+		if err != nil {
+			return err
+		}
+		listenerTLS.Store(tlsConfig)
+		// Fetching the TLS config on every handshake allows certificates to be replaced by a config reload.
+		srv.TLSConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return listenerTLS.Load(), nil
+			},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &listenerTLS.Load().Certificates[0], nil
+			},
+		}
+		httpLog.Info("TLS is enabled on the exporter listener")
+	}
+
+	ln, err := systemdListener()
+	if err != nil {
+		return fmt.Errorf("unable to use systemd socket: %v", err)
+	}
+	if ln != nil {
+		httpLog.Info("Using socket passed by systemd", "address", ln.Addr())
+	} else if ln, err = listen(network, address); err != nil {
+		return err
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ServeTLS(ln, "", "")
+		} else {
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	sdNotify(daemon.SdNotifyReady)
+	go watchdog()
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stopSignals:
+		mainLog.Info("Shutting down", "signal", sig)
+	}
+	sdNotify(daemon.SdNotifyStopping)
+
+	drainTimeout := cfg().Exporter.DrainTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		httpLog.Warn("In-flight requests did not complete in time, cancelling them", "drain_timeout", drainTimeout)
+		cancelBase()
+		return srv.Close()
+	}
+	return err
+}
+
+// registerPprof mounts the profiling handlers on mux.  They're registered explicitly, rather than by importing
+// net/http/pprof for its side effects, so they're only served when enabled.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	httpLog.Warn("Profiling is enabled on /debug/pprof/")
+}
+
+// telemetryMux holds the handlers served on the telemetry listener
+var telemetryMux = http.NewServeMux()
+
+// serveTelemetry serves the exporter's own metrics on a listener separate from the probe endpoints, allowing them
+// to be bound to a different interface.  TLS isn't used as the listener is intended for localhost.
+func serveTelemetry(hostport string) {
+	telemetryMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// As promhttp.Handler, but honouring the configured handler options and metric filters
+		h := promhttp.HandlerFor(withMetricFilters(prometheus.DefaultGatherer), handlerOpts())
+		promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, h).ServeHTTP(w, r)
+	})
+	if cfg().Exporter.Pprof {
+		registerPprof(telemetryMux)
+	}
+	httpLog.Info("Serving exporter metrics on telemetry listener", "address", hostport)
+	srv := newServer(withAccessLog(withAllowedCIDRs(withAuth(telemetryMux))))
+	srv.Addr = hostport
+	err := srv.ListenAndServe()
+	fatal("Telemetry listener failed", "err", err)
+}
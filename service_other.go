@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// serviceCommand is only supported on Windows
+func serviceCommand(command, _ string) {
+	fmt.Fprintf(os.Stderr, "The %s command is only supported on Windows\n", command)
+	os.Exit(2)
+}
+
+// startService does nothing as the exporter only runs as a service on Windows
+func startService() error {
+	return nil
+}
+
+func stopService() {}
+
+func newEventLogHandler() (slog.Handler, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
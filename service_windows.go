@@ -0,0 +1,196 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service and its event log source
+const serviceName = "openotp_exporter"
+
+// serviceCommand installs or removes the Windows service and exits.  The installed service runs the current
+// executable with the given config file.
+func serviceCommand(command, configFile string) {
+	var err error
+	if command == "install-service" {
+		err = installService(configFile)
+	} else {
+		err = uninstallService()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", command)
+	os.Exit(0)
+}
+
+func installService(configFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// Services start in the system directory so the config file must be given as an absolute path.
+	if configFile, err = filepath.Abs(configFile); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "OpenOTP Exporter",
+		Description: "Prometheus exporter for OpenOTP and WebADM",
+		StartType:   mgr.StartAutomatic,
+	}, "--config", configFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("unable to create event log source: %v", err)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// serviceHandler responds to requests from the service control manager
+type serviceHandler struct {
+	// done is closed when the exporter has shut down
+	done chan struct{}
+	// stopped is closed when the service control manager has been told the service has stopped
+	stopped chan struct{}
+}
+
+var service *serviceHandler
+
+func (h *serviceHandler) Execute(_ []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	s <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-h.done:
+			// The exporter stopped of its own accord
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				mainLog.Info("Stop requested by the service control manager")
+				s <- svc.Status{State: svc.StopPending}
+				stopSignals <- os.Interrupt
+				<-h.done
+				return false, 0
+			}
+		}
+	}
+}
+
+// startService registers with the service control manager if the exporter has been started as a Windows service.
+func startService() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return err
+	}
+	service = &serviceHandler{done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(service.stopped)
+		if err := svc.Run(serviceName, service); err != nil {
+			mainLog.Error("Windows service failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// stopService reports the exporter's shutdown to the service control manager and waits for it to be acknowledged.
+func stopService() {
+	if service == nil {
+		return
+	}
+	close(service.done)
+	select {
+	case <-service.stopped:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// eventLogHandler writes log records to the Windows event log.  Records are formatted by a text handler, with the
+// level determining the event type.
+type eventLogHandler struct {
+	log *eventlog.Log
+	// with applies the attributes and groups added to the logger to the text handler
+	with func(slog.Handler) slog.Handler
+}
+
+func newEventLogHandler() (slog.Handler, error) {
+	el, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogHandler{log: el, with: func(h slog.Handler) slog.Handler { return h }}, nil
+}
+
+func (h *eventLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if err := h.with(newTextHandler(&buf)).Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSpace(buf.String())
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.log.Error(1, msg)
+	case r.Level >= slog.LevelWarn:
+		return h.log.Warning(1, msg)
+	}
+	return h.log.Info(1, msg)
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	with := h.with
+	return &eventLogHandler{log: h.log, with: func(out slog.Handler) slog.Handler { return with(out).WithAttrs(attrs) }}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	with := h.with
+	return &eventLogHandler{log: h.log, with: func(out slog.Handler) slog.Handler { return with(out).WithGroup(name) }}
+}
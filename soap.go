@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// soapNamespace is the namespace of WebADM's SOAP management interface
+const soapNamespace = "urn:Manag"
+
+// soapHTTPError is returned when the SOAP endpoint responds with an HTTP error that isn't a SOAP fault
+type soapHTTPError struct {
+	code   int
+	status string
+}
+
+func (e *soapHTTPError) Error() string {
+	return fmt.Sprintf("SOAP request failed: %s", e.status)
+}
+
+// soapClient implements jsonrpc.RPCClient over WebADM's SOAP API, for deployments where the JSON-RPC interface is
+// disabled.  SOAP has no batches so the calls in a batch are made in turn.
+type soapClient struct {
+	url     string
+	client  *http.Client
+	headers map[string]string
+}
+
+func newSOAPClient(url string, client *http.Client, headers map[string]string) *soapClient {
+	return &soapClient{url: url, client: client, headers: headers}
+}
+
+// soapParams mimics the jsonrpc package's handling of params: a single list, map or struct is passed as is.
+func soapParams(params []interface{}) interface{} {
+	if len(params) == 1 && params[0] != nil {
+		switch reflect.Indirect(reflect.ValueOf(params[0])).Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+			return params[0]
+		}
+	}
+	return params
+}
+
+func (c *soapClient) Call(ctx context.Context, method string, params ...interface{}) (*jsonrpc.RPCResponse, error) {
+	return c.CallRaw(ctx, &jsonrpc.RPCRequest{Method: method, Params: soapParams(params)})
+}
+
+func (c *soapClient) CallFor(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	response, err := c.Call(ctx, method, params...)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	return response.GetObject(out)
+}
+
+func (c *soapClient) CallBatch(ctx context.Context, requests jsonrpc.RPCRequests) (jsonrpc.RPCResponses, error) {
+	return c.CallBatchRaw(ctx, requests)
+}
+
+func (c *soapClient) CallBatchRaw(ctx context.Context, requests jsonrpc.RPCRequests) (jsonrpc.RPCResponses, error) {
+	responses := make(jsonrpc.RPCResponses, 0, len(requests))
+	for _, request := range requests {
+		response, err := c.CallRaw(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// CallRaw makes a single SOAP call.  A SOAP fault is returned as an RPC error in the response, as it would be by
+// JSON-RPC.
+func (c *soapClient) CallRaw(ctx context.Context, request *jsonrpc.RPCRequest) (*jsonrpc.RPCResponse, error) {
+	body, err := soapEnvelope(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", fmt.Sprintf("%s#%s", soapNamespace, request.Method))
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	root, err := parseSOAP(resp.Body)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, &soapHTTPError{code: resp.StatusCode, status: resp.Status}
+		}
+		return nil, fmt.Errorf("unable to decode SOAP response: %v", err)
+	}
+	response := &jsonrpc.RPCResponse{JSONRPC: "2.0", ID: request.ID}
+	soapBody := root.child("Body")
+	if soapBody == nil || len(soapBody.children) == 0 {
+		return nil, fmt.Errorf("SOAP response has no body")
+	}
+	content := soapBody.children[0]
+	if content.name.Local == "Fault" {
+		message := "SOAP fault"
+		if s := content.child("faultstring"); s != nil {
+			message = strings.TrimSpace(s.text)
+		}
+		response.Error = &jsonrpc.RPCError{Code: -32000, Message: message}
+		return response, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &soapHTTPError{code: resp.StatusCode, status: resp.Status}
+	}
+	if len(content.children) > 0 {
+		response.Result = content.children[0].value()
+	}
+	return response, nil
+}
+
+// soapEnvelope encodes a request as a SOAP RPC call.  A map of params provides named parameters, otherwise the
+// parameters are positional.
+func soapEnvelope(request *jsonrpc.RPCRequest) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	buf.WriteString(`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/"` +
+		` xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` +
+		` xmlns:SOAP-ENC="http://schemas.xmlsoap.org/soap/encoding/" xmlns:ns2="http://xml.apache.org/xml-soap"` +
+		` xmlns:ns1="` + soapNamespace + `"><SOAP-ENV:Body>`)
+	fmt.Fprintf(&buf, "<ns1:%s>", request.Method)
+	switch params := request.Params.(type) {
+	case nil:
+	case map[string]interface{}, map[string]bool, map[string]string:
+		v := reflect.ValueOf(params)
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := soapEncode(&buf, k, v.MapIndex(reflect.ValueOf(k)).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		v := reflect.ValueOf(params)
+		if v.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("unsupported SOAP params: %T", params)
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := soapEncode(&buf, fmt.Sprintf("param%d", i), v.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	fmt.Fprintf(&buf, "</ns1:%s></SOAP-ENV:Body></SOAP-ENV:Envelope>", request.Method)
+	return buf.Bytes(), nil
+}
+
+// soapEncode writes a value as a SOAP encoded element.  Maps use the Apache map encoding understood by PHP.
+func soapEncode(buf *bytes.Buffer, name string, value interface{}) error {
+	if value == nil {
+		fmt.Fprintf(buf, `<%s xsi:nil="true"/>`, name)
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	var xsiType string
+	var text string
+	switch v.Kind() {
+	case reflect.Bool:
+		xsiType, text = "xsd:boolean", strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		xsiType, text = "xsd:int", strconv.FormatInt(v.Int(), 10)
+	case reflect.Float32, reflect.Float64:
+		xsiType, text = "xsd:double", strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.String:
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(v.String()))
+		xsiType, text = "xsd:string", escaped.String()
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(buf, `<%s xsi:type="SOAP-ENC:Array">`, name)
+		for i := 0; i < v.Len(); i++ {
+			if err := soapEncode(buf, "item", v.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(buf, "</%s>", name)
+		return nil
+	case reflect.Map:
+		fmt.Fprintf(buf, `<%s xsi:type="ns2:Map">`, name)
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			buf.WriteString("<item>")
+			if err := soapEncode(buf, "key", fmt.Sprint(k)); err != nil {
+				return err
+			}
+			if err := soapEncode(buf, "value", v.MapIndex(k).Interface()); err != nil {
+				return err
+			}
+			buf.WriteString("</item>")
+		}
+		fmt.Fprintf(buf, "</%s>", name)
+		return nil
+	default:
+		return fmt.Errorf("unsupported SOAP parameter type: %T", value)
+	}
+	fmt.Fprintf(buf, `<%s xsi:type="%s">%s</%s>`, name, xsiType, text, name)
+	return nil
+}
+
+// soapNode is an element of a decoded SOAP message
+type soapNode struct {
+	name     xml.Name
+	xsiType  string
+	isNil    bool
+	text     string
+	children []*soapNode
+}
+
+// child returns the first child element with the given local name
+func (n *soapNode) child(local string) *soapNode {
+	for _, c := range n.children {
+		if c.name.Local == local {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseSOAP decodes a SOAP message into a tree of elements
+func parseSOAP(r io.Reader) (*soapNode, error) {
+	decoder := xml.NewDecoder(r)
+	var stack []*soapNode
+	var root *soapNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &soapNode{name: t.Name}
+			for _, attr := range t.Attr {
+				switch attr.Name.Local {
+				case "type":
+					// Only the local part of the type matters, e.g. "xsd:int" or "ns2:Map".
+					_, n.xsiType, _ = strings.Cut(attr.Value, ":")
+					if n.xsiType == "" {
+						n.xsiType = attr.Value
+					}
+				case "nil":
+					n.isNil = attr.Value == "true" || attr.Value == "1"
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil || root.name.Local != "Envelope" {
+		return nil, fmt.Errorf("not a SOAP envelope")
+	}
+	return root, nil
+}
+
+// value converts an element to the types produced by decoding a JSON-RPC response, so that the responses of both
+// protocols are processed identically.
+func (n *soapNode) value() interface{} {
+	if n.isNil {
+		return nil
+	}
+	text := strings.TrimSpace(n.text)
+	switch strings.ToLower(n.xsiType) {
+	case "int", "integer", "long", "short", "byte", "unsignedint", "unsignedlong", "unsignedshort", "unsignedbyte",
+		"float", "double", "decimal":
+		return json.Number(text)
+	case "boolean":
+		return text == "true" || text == "1"
+	case "string":
+		return n.text
+	case "map":
+		m := make(map[string]interface{})
+		for _, item := range n.children {
+			key, value := item.child("key"), item.child("value")
+			if key != nil && value != nil {
+				m[strings.TrimSpace(key.text)] = value.value()
+			}
+		}
+		return m
+	case "array":
+		l := make([]interface{}, 0, len(n.children))
+		for _, c := range n.children {
+			l = append(l, c.value())
+		}
+		return l
+	}
+	if len(n.children) == 0 {
+		return n.text
+	}
+	m := make(map[string]interface{})
+	for _, c := range n.children {
+		m[c.name.Local] = c.value()
+	}
+	return m
+}
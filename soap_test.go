@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+func TestSOAPEnvelope(t *testing.T) {
+	tests := []struct {
+		params interface{}
+		body   string
+	}{
+		{nil, `<ns1:Test></ns1:Test>`},
+		{
+			[]interface{}{"Default", true, 3},
+			`<ns1:Test><param0 xsi:type="xsd:string">Default</param0><param1 xsi:type="xsd:boolean">true</param1>` +
+				`<param2 xsi:type="xsd:int">3</param2></ns1:Test>`,
+		},
+		{
+			map[string]bool{"webapps": true, "servers": false},
+			`<ns1:Test><servers xsi:type="xsd:boolean">false</servers><webapps xsi:type="xsd:boolean">true</webapps>` +
+				`</ns1:Test>`,
+		},
+		{
+			[]interface{}{"<a&b>", nil},
+			`<ns1:Test><param0 xsi:type="xsd:string">&lt;a&amp;b&gt;</param0><param1 xsi:nil="true"/></ns1:Test>`,
+		},
+		{
+			[]interface{}{[]string{"x", "y"}},
+			`<ns1:Test><param0 xsi:type="SOAP-ENC:Array"><item xsi:type="xsd:string">x</item>` +
+				`<item xsi:type="xsd:string">y</item></param0></ns1:Test>`,
+		},
+		{
+			[]interface{}{map[string]int{"b": 2, "a": 1}},
+			`<ns1:Test><param0 xsi:type="ns2:Map"><item><key xsi:type="xsd:string">a</key>` +
+				`<value xsi:type="xsd:int">1</value></item><item><key xsi:type="xsd:string">b</key>` +
+				`<value xsi:type="xsd:int">2</value></item></param0></ns1:Test>`,
+		},
+	}
+	for _, test := range tests {
+		envelope, err := soapEnvelope(&jsonrpc.RPCRequest{Method: "Test", Params: test.params})
+		if err != nil {
+			t.Errorf("Unable to encode %v: %v", test.params, err)
+			continue
+		}
+		_, body, _ := strings.Cut(string(envelope), "<SOAP-ENV:Body>")
+		body = strings.TrimSuffix(body, "</SOAP-ENV:Body></SOAP-ENV:Envelope>")
+		if body != test.body {
+			t.Errorf("Unexpected body for %v.  Expected=%s, Got=%s", test.params, test.body, body)
+		}
+	}
+	if _, err := soapEnvelope(&jsonrpc.RPCRequest{Method: "Test", Params: []interface{}{struct{}{}}}); err == nil {
+		t.Error("Expected an error encoding an unsupported type")
+	}
+}
+
+func TestParseSOAP(t *testing.T) {
+	const envelope = `<?xml version="1.0" encoding="UTF-8"?><SOAP-ENV:Envelope ` +
+		`xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsd="http://www.w3.org/2001/XMLSchema" ` +
+		`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:ns2="http://xml.apache.org/xml-soap">` +
+		`<SOAP-ENV:Body><ns1:TestResponse xmlns:ns1="urn:Manag">%s</ns1:TestResponse></SOAP-ENV:Body>` +
+		`</SOAP-ENV:Envelope>`
+	tests := []struct {
+		result string
+		value  interface{}
+	}{
+		{`<return xsi:type="xsd:int">42</return>`, json.Number("42")},
+		{`<return xsi:type="xsd:boolean">true</return>`, true},
+		{`<return xsi:type="xsd:boolean">0</return>`, false},
+		{`<return xsi:type="xsd:string"> padded </return>`, " padded "},
+		{`<return xsi:nil="true"/>`, nil},
+		{
+			`<return xsi:type="SOAP-ENC:Array"><item xsi:type="xsd:string">a</item>` +
+				`<item xsi:type="xsd:int">1</item></return>`,
+			[]interface{}{"a", json.Number("1")},
+		},
+		{
+			`<return xsi:type="ns2:Map"><item><key xsi:type="xsd:string">users</key>` +
+				`<value xsi:type="xsd:int">7</value></item></return>`,
+			map[string]interface{}{"users": json.Number("7")},
+		},
+		{
+			`<return><name>OpenOTP</name><status xsi:type="xsd:boolean">true</status></return>`,
+			map[string]interface{}{"name": "OpenOTP", "status": true},
+		},
+	}
+	for _, test := range tests {
+		root, err := parseSOAP(strings.NewReader(strings.Replace(envelope, "%s", test.result, 1)))
+		if err != nil {
+			t.Errorf("Unable to parse %s: %v", test.result, err)
+			continue
+		}
+		value := root.child("Body").children[0].children[0].value()
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("Unexpected value for %s.  Expected=%#v, Got=%#v", test.result, test.value, value)
+		}
+	}
+	if _, err := parseSOAP(strings.NewReader(`<html><body>Not found</body></html>`)); err == nil {
+		t.Error("Expected an error parsing a document that isn't a SOAP envelope")
+	}
+}
+
+func TestSOAPFault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if action := r.Header.Get("SOAPAction"); action != "urn:Manag#Count_Activated_Users" {
+			t.Errorf("Unexpected SOAPAction: %s", action)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/"><SOAP-ENV:Body>` +
+			`<SOAP-ENV:Fault><faultcode>SOAP-ENV:Server</faultcode><faultstring>Invalid credentials</faultstring>` +
+			`</SOAP-ENV:Fault></SOAP-ENV:Body></SOAP-ENV:Envelope>`))
+	}))
+	defer server.Close()
+	client := newSOAPClient(server.URL, server.Client(), nil)
+	response, err := client.Call(context.Background(), "Count_Activated_Users")
+	if err != nil {
+		t.Fatalf("Call returned: %v", err)
+	}
+	if response.Error == nil || response.Error.Message != "Invalid credentials" {
+		t.Errorf("Unexpected error.  Expected=Invalid credentials, Got=%v", response.Error)
+	}
+}
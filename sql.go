@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+// sqlMaxMessage limits the size of the handshake messages read from the server, so that a misbehaving server can't
+// exhaust the exporter's memory.  Genuine greetings and errors are far smaller.
+const sqlMaxMessage = 64 * 1024
+
+// sqlDefaultPorts are used when the SQL DSN doesn't specify a port
+var sqlDefaultPorts = map[string]string{
+	"mysql":    "3306",
+	"postgres": "5432",
+}
+
+// collectSQL checks that the SQL server used by WebADM is reachable, independently of WebADM.  It's a reachability
+// check only: it stops at the server's handshake, so it doesn't need credentials and doesn't show that WebADM's can
+// log in.
+func (m *prometheusMetrics) collectSQL(ctx context.Context, rpcClient jsonrpc.RPCClient, target string) error {
+	start := time.Now()
+	err := sqlHandshake(ctx, cfg().SQL.DSN)
+	m.sqlHandshakeDuration.Set(time.Since(start).Seconds())
+	m.sqlReachable.Set(boolToFloat(err == nil))
+	if err != nil {
+		return fmt.Errorf("sql %s: %v", redactString(cfg().SQL.DSN), err)
+	}
+	return nil
+}
+
+// sqlHandshake connects to the server identified by a mysql:// or postgres:// DSN and waits for it to answer the
+// connection handshake, without authenticating
+func sqlHandshake(ctx context.Context, dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return err
+	}
+	scheme := u.Scheme
+	if scheme == "postgresql" {
+		scheme = "postgres"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), sqlDefaultPorts[scheme])
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if scheme == "mysql" {
+		return mysqlHandshake(conn)
+	}
+	return postgresHandshake(conn, u)
+}
+
+// mysqlHandshake reads the server's initial handshake.  MySQL refuses connections it can't serve, for example when
+// there are too many, with an error packet instead.
+func mysqlHandshake(conn net.Conn) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length > sqlMaxMessage {
+		return fmt.Errorf("handshake of %d bytes is too large", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return err
+	}
+	switch {
+	case len(payload) > 3 && payload[0] == 0xff:
+		// Error packets contain a 2 byte code followed by the message
+		return fmt.Errorf("server refused connection: %s", payload[3:])
+	case len(payload) > 0 && payload[0] == 10:
+		// Protocol 10 greetings have a NUL terminated server version, then a 4 byte connection ID, 8 bytes of auth
+		// data, a filler byte and 2 bytes of capability flags.
+		version := bytes.IndexByte(payload[1:], 0)
+		if version < 0 || len(payload) < 1+version+1+4+8+1+2 {
+			return fmt.Errorf("truncated handshake")
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected handshake")
+}
+
+// postgresHandshake sends a startup message and waits for the server to request authentication.  An error response
+// concerning authentication or the database still shows that the server is up, but one saying that it can't accept
+// connections doesn't.
+func postgresHandshake(conn net.Conn, u *url.URL) error {
+	user := u.User.Username()
+	if user == "" {
+		user = "openotp_exporter"
+	}
+	var params bytes.Buffer
+	binary.Write(&params, binary.BigEndian, int32(196608)) // protocol version 3.0
+	for _, p := range []string{"user", user, "database", strings.TrimPrefix(u.Path, "/")} {
+		if p == "" {
+			break
+		}
+		params.WriteString(p)
+		params.WriteByte(0)
+	}
+	params.WriteByte(0)
+	msg := binary.BigEndian.AppendUint32(nil, uint32(params.Len()+4))
+	if _, err := conn.Write(append(msg, params.Bytes()...)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	msgType, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	var length int32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	switch msgType {
+	case 'R':
+		conn.Write([]byte{'X', 0, 0, 0, 4})
+		return nil
+	case 'E':
+		if length < 4 || length-4 > sqlMaxMessage {
+			return fmt.Errorf("invalid error response length %d", length)
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		code, message := postgresError(body)
+		// Class 28 is an authorization failure and 3D an unknown database, so the server is answering.
+		if strings.HasPrefix(code, "28") || strings.HasPrefix(code, "3D") {
+			return nil
+		}
+		return fmt.Errorf("server refused connection (%s): %s", code, message)
+	}
+	return fmt.Errorf("unexpected message type %q", msgType)
+}
+
+// postgresError returns the SQLSTATE code and message of an error response
+func postgresError(body []byte) (string, string) {
+	var code, message string
+	for _, field := range bytes.Split(body, []byte{0}) {
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case 'C':
+			code = string(field[1:])
+		case 'M':
+			message = string(field[1:])
+		}
+	}
+	return code, message
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mysqlPacket frames a payload as a MySQL packet with sequence number 0
+func mysqlPacket(payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), 0}, payload...)
+}
+
+// mysqlGreeting returns a protocol 10 handshake payload
+func mysqlGreeting() []byte {
+	payload := append([]byte{10}, "8.0.36\x00"...)
+	payload = append(payload, 1, 0, 0, 0)                      // connection ID
+	payload = append(payload, bytes.Repeat([]byte{'a'}, 8)...) // auth data
+	return append(payload, 0, 0xff, 0xf7)                      // filler and capability flags
+}
+
+// postgresMessage frames a body as a Postgres backend message
+func postgresMessage(msgType byte, body []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{msgType}, uint32(len(body)+4)), body...)
+}
+
+// postgresErrorBody returns the fields of an error response with the given SQLSTATE code
+func postgresErrorBody(code string) []byte {
+	return []byte("SFATAL\x00C" + code + "\x00Mrefused\x00\x00")
+}
+
+// sqlServer replays response on the server side of a pipe, after reading the client's startup message if startup is
+// true, and then closes the connection.
+func sqlServer(response []byte, startup bool) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		if startup {
+			length := make([]byte, 4)
+			if _, err := io.ReadFull(server, length); err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, server, int64(binary.BigEndian.Uint32(length))-4); err != nil {
+				return
+			}
+		}
+		server.Write(response)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func TestMySQLHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		valid    bool
+	}{
+		{"greeting", mysqlPacket(mysqlGreeting()), true},
+		{"error", mysqlPacket(append([]byte{0xff, 0x10, 0x04}, "Too many connections"...)), false},
+		{"truncated greeting", mysqlPacket(mysqlGreeting()[:10]), false},
+		{"unterminated version", mysqlPacket(append([]byte{10}, "8.0.36"...)), false},
+		{"unknown protocol", mysqlPacket([]byte{9, 0}), false},
+		{"oversize", []byte{0xff, 0xff, 0xff, 0}, false},
+		{"closed", nil, false},
+	}
+	for _, test := range tests {
+		conn := sqlServer(test.response, false)
+		err := mysqlHandshake(conn)
+		conn.Close()
+		if (err == nil) != test.valid {
+			t.Errorf("Unexpected result for %s: %v", test.name, err)
+		}
+	}
+}
+
+func TestPostgresHandshake(t *testing.T) {
+	u, _ := url.Parse("postgres://webadm@db.example.com/webadm")
+	tests := []struct {
+		name     string
+		response []byte
+		valid    bool
+	}{
+		{"authentication request", postgresMessage('R', []byte{0, 0, 0, 5, 1, 2, 3, 4}), true},
+		{"bad password", postgresMessage('E', postgresErrorBody("28P01")), true},
+		{"unknown database", postgresMessage('E', postgresErrorBody("3D000")), true},
+		{"too many connections", postgresMessage('E', postgresErrorBody("53300")), false},
+		{"starting up", postgresMessage('E', postgresErrorBody("57P03")), false},
+		{"oversize error", []byte{'E', 0x7f, 0xff, 0xff, 0xff}, false},
+		{"short error", []byte{'E', 0, 0, 0, 2}, false},
+		{"unexpected message", postgresMessage('Z', []byte{'I'}), false},
+		{"closed", nil, false},
+	}
+	for _, test := range tests {
+		conn := sqlServer(test.response, true)
+		err := postgresHandshake(conn, u)
+		conn.Close()
+		if (err == nil) != test.valid {
+			t.Errorf("Unexpected result for %s: %v", test.name, err)
+		}
+	}
+}
+
+func TestPostgresError(t *testing.T) {
+	code, message := postgresError(postgresErrorBody("53300"))
+	if code != "53300" || message != "refused" {
+		t.Errorf("Unexpected error.  Expected=53300 refused, Got=%s %s", code, message)
+	}
+	if code, _ := postgresError([]byte("\x00\x00")); code != "" {
+		t.Errorf("Unexpected code for an empty error.  Expected=, Got=%s", code)
+	}
+}
+
+func TestSQLHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(mysqlPacket(mysqlGreeting()))
+			conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sqlHandshake(ctx, "mysql://webadm@"+l.Addr().String()+"/webadm"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	l.Close()
+	if err := sqlHandshake(ctx, "mysql://webadm@"+l.Addr().String()+"/webadm"); err == nil {
+		t.Error("Expected an error connecting to a closed port")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// systemdListener returns the listening socket passed by systemd socket activation, or nil if the exporter wasn't
+// socket activated.
+func systemdListener() (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil || len(listeners) == 0 {
+		return nil, err
+	}
+	if len(listeners) > 1 {
+		httpLog.Warn("Systemd passed multiple sockets, only the first is used", "count", len(listeners))
+		for _, ln := range listeners[1:] {
+			if ln != nil {
+				ln.Close()
+			}
+		}
+	}
+	return listeners[0], nil
+}
+
+// sdNotify sends a state notification to systemd.  It does nothing unless the exporter was started by a
+// Type=notify unit.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		mainLog.Warn("Unable to notify systemd", "state", state, "err", err)
+	}
+}
+
+// watchdog pings the systemd watchdog at half the interval configured by WatchdogSec, so that systemd restarts the
+// exporter if it stops responding.  It does nothing if the watchdog isn't enabled.
+func watchdog() {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		mainLog.Warn("Unable to read systemd watchdog settings", "err", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	mainLog.Info("Systemd watchdog is enabled", "interval", interval)
+	for range time.Tick(interval / 2) {
+		sdNotify(daemon.SdNotifyWatchdog)
+	}
+}
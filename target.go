@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// expandTarget converts a target given as a bare hostname (or host:port) into a URL, using the configured API scheme
+// and port.  Targets that are already URLs are returned unchanged.
+func expandTarget(target string) string {
+	if strings.Contains(target, "://") {
+		return target
+	}
+	host := target
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		host = net.JoinHostPort(strings.Trim(target, "[]"), strconv.Itoa(cfg().API.Port))
+	}
+	return fmt.Sprintf("%s://%s", cfg().API.Scheme, host)
+}
+
+// targetLabels returns the labels added to the metrics of the target with the given URL: the target label, along with
+// any labels configured for a static target.
+func targetLabels(targetURL string) prometheus.Labels {
+	labels := prometheus.Labels{"target": targetURL}
+	for _, t := range cfg().Targets {
+		if t.URL != targetURL {
+			continue
+		}
+		for name, value := range t.Labels {
+			labels[name] = value
+		}
+		break
+	}
+	return labels
+}
+
+// checkTargetLabels returns an error if the labels of a static target clash with those of the exporter's metrics, as
+// registering its metrics would then fail.
+func checkTargetLabels(c *config.Config) (err error) {
+	for _, t := range c.Targets {
+		if len(t.Labels) == 0 {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("target %s: labels clash with those of the exporter's metrics: %v", t.URL, r)
+				}
+			}()
+			labels := prometheus.Labels{"target": t.URL}
+			for name, value := range t.Labels {
+				labels[name] = value
+			}
+			initCollectors(prometheus.WrapRegistererWith(labels, prometheus.NewRegistry()))
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targetExpiry is how long the state and exporter metrics of a target are retained after its last probe.  Any number
+// of targets may be requested through /probe so those that are no longer probed have to be forgotten.
+const targetExpiry = time.Hour
+
+// probedTargets records when each target was last probed
+var probedTargets = struct {
+	sync.Mutex
+	last   map[string]time.Time
+	pruned time.Time
+}{last: make(map[string]time.Time)}
+
+// touchTarget records a probe of targetHost and forgets the targets that haven't been probed within targetExpiry
+func touchTarget(targetHost string) {
+	probedTargets.Lock()
+	defer probedTargets.Unlock()
+	now := time.Now()
+	probedTargets.last[targetHost] = now
+	if now.Sub(probedTargets.pruned) < time.Minute {
+		return
+	}
+	probedTargets.pruned = now
+	for t, last := range probedTargets.last {
+		if now.Sub(last) > targetExpiry {
+			delete(probedTargets.last, t)
+			forgetTarget(t)
+		}
+	}
+}
+
+// forgetTarget discards the probe history and circuit of targetHost, along with its exporter metrics
+func forgetTarget(targetHost string) {
+	target := apiURL(targetHost)
+	history.mu.Lock()
+	delete(history.targets, targetHost)
+	history.mu.Unlock()
+	breaker.mu.Lock()
+	delete(breaker.circuits, target)
+	breaker.mu.Unlock()
+	if exporter == nil {
+		return
+	}
+	exporter.probesTotal.DeletePartialMatch(prometheus.Labels{"target": targetHost})
+	exporter.probeDuration.DeleteLabelValues(targetHost)
+	exporter.lastSuccess.DeleteLabelValues(targetHost)
+	exporter.retries.DeleteLabelValues(target)
+	exporter.circuitOpen.DeleteLabelValues(target)
+	exporter.coalesced.DeleteLabelValues(target)
+}
+
+// staticTarget returns the static target whose host matches that of apiURL, allowing per-target settings to be
+// applied to probes of it.  A zero Target is returned if there's no match.
+func staticTarget(apiURL string) config.Target {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return config.Target{}
+	}
+	for _, t := range cfg().Targets {
+		tu, err := url.Parse(expandTarget(t.URL))
+		if err == nil && strings.EqualFold(tu.Host, u.Host) {
+			return t
+		}
+	}
+	return config.Target{}
+}
+
+// apiURL returns the URL of the API at targetHost.  The configured API path is appended unless the target URL already
+// includes a path.
+func apiURL(targetHost string) string {
+	if u, err := url.Parse(targetHost); err == nil && strings.Trim(u.Path, "/") != "" {
+		return targetHost
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(targetHost, "/"), strings.TrimPrefix(cfg().API.Path, "/"))
+}
+
+// targetAllowed checks a /probe target against the configured scheme and host allow-lists.  Allow-list entries may be
+// hostnames, wildcard domains (*.example.com) or CIDRs.  Hostnames that don't match a name entry are resolved and are
+// only allowed if all their addresses are within an allowed CIDR.  An empty host allow-list permits any host.
+func targetAllowed(ctx context.Context, targetHost string) error {
+	u, err := url.Parse(targetHost)
+	if err != nil {
+		return fmt.Errorf("invalid target URL: %v", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("target URL has no host: %s", targetHost)
+	}
+	schemeOK := false
+	for _, scheme := range cfg().Exporter.AllowedSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			schemeOK = true
+			break
+		}
+	}
+	if !schemeOK {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	nets, byName := allowedNets(host)
+	if byName {
+		return nil
+	}
+	if len(nets) == 0 {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IP{ip}
+	} else {
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("unable to resolve %s: %v", host, err)
+		}
+		for _, a := range ipAddrs {
+			addrs = append(addrs, a.IP)
+		}
+	}
+	for _, addr := range addrs {
+		if !ipInNets(addr, nets) {
+			return fmt.Errorf("address %s of host %s is not allowed", addr, host)
+		}
+	}
+	return nil
+}
+
+// allowedNets checks host against the target allow-list.  It returns true if host is allowed by name, or if there's
+// no allow-list.  Otherwise it returns the CIDRs that the host's addresses must be within.
+func allowedNets(host string) ([]*net.IPNet, bool) {
+	if len(cfg().Exporter.AllowedTargets) == 0 {
+		return nil, true
+	}
+	host = strings.ToLower(host)
+	var nets []*net.IPNet
+	for _, entry := range cfg().Exporter.AllowedTargets {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+		entry = strings.ToLower(entry)
+		if host == entry {
+			return nil, true
+		}
+		if strings.HasPrefix(entry, "*.") && strings.HasSuffix(host, entry[1:]) {
+			return nil, true
+		}
+	}
+	return nets, false
+}
+
+// allowedDial returns a dial function that only connects to host at addresses within nets.  The address is checked
+// once it has been resolved for the connection, so that a DNS record changed after targetAllowed resolved it can't
+// redirect the probe.  Connections to anything else, such as a proxy, are made normally.
+func allowedDial(host string, nets []*net.IPNet) dialFunc {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr := net.ParseIP(ip); addr == nil || !ipInNets(addr, nets) {
+				return fmt.Errorf("address %s of host %s is not allowed", ip, host)
+			}
+			return nil
+		},
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if h, _, err := net.SplitHostPort(addr); err == nil && strings.EqualFold(h, host) {
+			return d.DialContext(ctx, network, addr)
+		}
+		return defaultDial(ctx, network, addr)
+	}
+}
+
+// ipInNets returns true if ip is within any of nets
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTargetAllowed(t *testing.T) {
+	currentConfig.Store(new(config.Config))
+	cfg().Exporter.AllowedSchemes = []string{"https"}
+	cfg().Exporter.AllowedTargets = []string{"otp1.example.com", "*.otp.example.org", "192.0.2.0/24"}
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"https://otp1.example.com:8443", true},
+		{"https://OTP1.example.com", true},
+		{"http://otp1.example.com", false},
+		{"file:///etc/passwd", false},
+		{"https://otp2.example.com", false},
+		{"https://node1.otp.example.org/manag", true},
+		{"https://otp.example.org.evil.com", false},
+		{"https://192.0.2.10:8443", true},
+		{"https://198.51.100.10", false},
+		{"https://[2001:db8::1]", false},
+		{"otp1.example.com", false},
+	}
+	for _, tt := range tests {
+		err := targetAllowed(context.Background(), tt.target)
+		if (err == nil) != tt.allowed {
+			t.Errorf("Unexpected result for %s. Expected allowed=%t, Got=%v", tt.target, tt.allowed, err)
+		}
+	}
+}
+
+func TestExpandTarget(t *testing.T) {
+	currentConfig.Store(new(config.Config))
+	cfg().API.Scheme = "https"
+	cfg().API.Port = 8443
+	tests := map[string]string{
+		"otp1.example.com":           "https://otp1.example.com:8443",
+		"otp1.example.com:9443":      "https://otp1.example.com:9443",
+		"http://otp1.example.com/":   "http://otp1.example.com/",
+		"2001:db8::1":                "https://[2001:db8::1]:8443",
+		"[2001:db8::1]:9443":         "https://[2001:db8::1]:9443",
+		"https://otp1.example.com:1": "https://otp1.example.com:1",
+	}
+	for target, expected := range tests {
+		if got := expandTarget(target); got != expected {
+			t.Errorf("Unexpected expansion of %s. Expected=%s, Got=%s", target, expected, got)
+		}
+	}
+}
+
+func TestCredentialsProfile(t *testing.T) {
+	currentConfig.Store(new(config.Config))
+	cfg().API.Scheme = "https"
+	cfg().API.Port = 8443
+	cfg().API.Username = "admin"
+	cfg().Credentials = map[string]config.Credentials{
+		"tenant1": {Username: "t1admin"},
+		"tenant2": {Username: "t2admin"},
+	}
+	cfg().Targets = []config.Target{{URL: "otp2.example.com", Credentials: "tenant2"}}
+	tests := []struct {
+		target   string
+		profile  string
+		expected string
+	}{
+		{"https://otp1.example.com:8443/manag/", "", "admin"},
+		{"https://otp1.example.com:8443/manag/", "tenant1", "t1admin"},
+		{"https://otp2.example.com:8443/manag/", "", "t2admin"},
+		{"https://otp2.example.com:8443/manag/", "tenant1", "t1admin"},
+	}
+	for _, tt := range tests {
+		if username, _ := apiCredentials(tt.target, tt.profile); username != tt.expected {
+			t.Errorf("Unexpected username for %s with profile %q. Expected=%s, Got=%s", tt.target, tt.profile, tt.expected, username)
+		}
+	}
+}
+
+func TestAllowedDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+
+	// localhost stands in for a name that resolves to a different address at dial time than when it was checked
+	addr := net.JoinHostPort("localhost", port)
+	if conn, err := allowedDial("localhost", []*net.IPNet{loopback})(context.Background(), "tcp4", addr); err != nil {
+		t.Errorf("Unable to connect to an allowed address: %v", err)
+	} else {
+		conn.Close()
+	}
+	if conn, err := allowedDial("localhost", []*net.IPNet{other})(context.Background(), "tcp4", addr); err == nil {
+		conn.Close()
+		t.Error("Connected to an address outside the allowed networks")
+	}
+	// Other hosts, such as a proxy, aren't restricted
+	proxy := net.JoinHostPort("127.0.0.1", port)
+	if conn, err := allowedDial("localhost", []*net.IPNet{other})(context.Background(), "tcp4", proxy); err != nil {
+		t.Errorf("Unable to connect to another host: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestTouchTarget(t *testing.T) {
+	currentConfig.Store(new(config.Config))
+	cfg().API.Path = "/manag/"
+	cfg().Exporter.ProbeHistory = 10
+	cfg().Exporter.CircuitBreaker.Failures = 1
+	defer func(m *exporterMetrics) { exporter = m }(exporter)
+	reg := prometheus.NewRegistry()
+	exporter = initExporterCollectors(reg)
+
+	stale, current := "https://stale.example.com", "https://current.example.com"
+	for _, host := range []string{stale, current} {
+		history.add(host, probeRecord{Time: time.Now()})
+		breaker.record(apiURL(host), errors.New("failed"))
+		exporter.recordProbe(host, false, 1)
+		exporter.retries.WithLabelValues(apiURL(host)).Inc()
+		exporter.coalesced.WithLabelValues(apiURL(host)).Inc()
+	}
+	probedTargets.Lock()
+	probedTargets.last[stale] = time.Now().Add(-2 * targetExpiry)
+	probedTargets.pruned = time.Time{}
+	probedTargets.Unlock()
+	touchTarget(current)
+
+	if _, ok := history.snapshot()[stale]; ok {
+		t.Error("History of the stale target was retained")
+	}
+	if _, ok := history.snapshot()[current]; !ok {
+		t.Error("History of the current target was discarded")
+	}
+	if _, ok := breaker.circuits[apiURL(stale)]; ok {
+		t.Error("Circuit of the stale target was retained")
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "target" && strings.Contains(l.GetValue(), "stale") {
+					t.Errorf("Series of the stale target retained: %s", mf.GetName())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// runTextfile probes the static targets at the configured interval and writes the results to the textfile until a
+// SIGINT or SIGTERM is received.
+func runTextfile() {
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	mainLog.Info("Writing metrics to textfile", "filename", cfg().Textfile.Filename)
+	for {
+		interval := cfg().Textfile.Interval
+		if err := writeTextfile(); err != nil {
+			mainLog.Warn("Unable to write textfile", "err", err)
+		}
+		select {
+		case <-stopSignals:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// writeTextfile probes the static targets and atomically replaces the textfile with the results.  The file is written
+// alongside the textfile and renamed so that node_exporter never reads a partial file.
+func writeTextfile() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().API.Timeout)
+	defer cancel()
+	reg := probeTargets(ctx, allTargets(), false)
+
+	dir, base := filepath.Split(cfg().Textfile.Filename)
+	// node_exporter only reads files with a .prom suffix so the temporary file is ignored.
+	tmp, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeMetrics(reg, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp creates files readable only by the owner but node_exporter often runs as a different user.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cfg().Textfile.Filename)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps TLS protocol versions to the names exported in metrics
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// probePhases are the phases of a request whose durations are recorded
+type probePhases struct {
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+	// rpc is the time between a request being written and the first byte of the response
+	rpc time.Duration
+}
+
+// probeTrace records details of the connections made to a target during a probe.  When a probe makes several
+// requests, the duration of each phase is the total across all of them.
+type probeTrace struct {
+	mu       sync.Mutex
+	tlsState *tls.ConnectionState
+	phases   probePhases
+}
+
+// withTrace returns a context that records connection details to t for any requests made with it.
+func (t *probeTrace) withTrace(ctx context.Context) context.Context {
+	var dnsStart, connectStart, tlsStart, wroteRequest time.Time
+	// The trace hooks are called from the transport's goroutines so all access is under the mutex.
+	start := func(s *time.Time) {
+		t.mu.Lock()
+		*s = time.Now()
+		t.mu.Unlock()
+	}
+	done := func(d *time.Duration, s *time.Time) {
+		t.mu.Lock()
+		*d += time.Since(*s)
+		t.mu.Unlock()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { start(&dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { done(&t.phases.dns, &dnsStart) },
+		ConnectStart:      func(string, string) { start(&connectStart) },
+		ConnectDone:       func(string, string, error) { done(&t.phases.connect, &connectStart) },
+		TLSHandshakeStart: func() { start(&tlsStart) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			done(&t.phases.tls, &tlsStart)
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			t.tlsState = &state
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			// Reused connections don't perform a handshake so their TLS state is taken from the connection itself.
+			if tc, ok := info.Conn.(*tls.Conn); ok && info.Reused {
+				state := tc.ConnectionState()
+				t.mu.Lock()
+				t.tlsState = &state
+				t.mu.Unlock()
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { start(&wroteRequest) },
+		GotFirstResponseByte: func() { done(&t.phases.rpc, &wroteRequest) },
+	})
+}
+
+// add adds the phase durations of o to t, and takes its TLS state if it has one
+func (t *probeTrace) add(o *probeTrace) {
+	o.mu.Lock()
+	phases, tlsState := o.phases, o.tlsState
+	o.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases.dns += phases.dns
+	t.phases.connect += phases.connect
+	t.phases.tls += phases.tls
+	t.phases.rpc += phases.rpc
+	if tlsState != nil {
+		t.tlsState = tlsState
+	}
+}
+
+// record populates the phase timing and TLS metrics.  The TLS metrics are taken from the most recent TLS connection
+// and nothing is recorded if none was used, for example when all the responses were cached or the target uses plain
+// HTTP.
+func (t *probeTrace) record(m *prometheusMetrics) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m.dnsDuration.Set(t.phases.dns.Seconds())
+	m.connectDuration.Set(t.phases.connect.Seconds())
+	m.tlsDuration.Set(t.phases.tls.Seconds())
+	m.serverDuration.Set(t.phases.rpc.Seconds())
+	if t.tlsState == nil {
+		return
+	}
+	if len(t.tlsState.PeerCertificates) > 0 {
+		m.tlsCertExpiry.WithLabelValues().Set(float64(t.tlsState.PeerCertificates[0].NotAfter.Unix()))
+	}
+	version, ok := tlsVersions[t.tlsState.Version]
+	if !ok {
+		version = "unknown"
+	}
+	m.tlsVersion.WithLabelValues(version).Set(1)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// spanBatchSize is the number of finished spans that triggers an export, in addition to the periodic export
+const spanBatchSize = 100
+
+// traceSpan records a traced operation, such as a probe or an RPC batch
+type traceSpan struct {
+	mu      sync.Mutex
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []otlpAttribute
+	err     error
+}
+
+type spanKey struct{}
+
+// startSpan starts a span as a child of the span, or remote parent, in ctx.  Spans are only recorded, and their trace
+// context propagated, while traces are exported.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	s := &traceSpan{name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*traceSpan); ok {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// withTraceparent returns a context whose spans continue the trace in a W3C traceparent header, if it's valid
+func withTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	remote := new(traceSpan)
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+// traceparent returns the W3C traceparent header identifying the span
+func (s *traceSpan) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+func (s *traceSpan) setAttr(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, otlpAttr(key, value))
+}
+
+func (s *traceSpan) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// finish ends the span and queues it for export
+func (s *traceSpan) finish() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	spans.add(s)
+}
+
+// otlpSpan is a span in the OTLP JSON encoding
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano otlpUint64      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpUint64      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// otlpTraceRequest is an OTLP ExportTraceServiceRequest
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func (s *traceSpan) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: otlpUint64(s.start.UnixNano()),
+		EndTimeUnixNano:   otlpUint64(s.end.UnixNano()),
+		Attributes:        s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	o.Status.Code = spanStatusOK
+	if s.err != nil {
+		o.Status.Code = spanStatusError
+		o.Status.Message = redactString(s.err.Error())
+	}
+	return o
+}
+
+// spanQueue holds finished spans until they're exported
+type spanQueue struct {
+	mu    sync.Mutex
+	spans []*traceSpan
+	full  chan struct{}
+}
+
+var spans = &spanQueue{full: make(chan struct{}, 1)}
+
+// add queues a span if traces are exported.  Spans are dropped if the collector can't keep up.
+func (q *spanQueue) add(s *traceSpan) {
+	if !cfg().OTLP.Exports("traces") {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.spans) >= 10*spanBatchSize {
+		return
+	}
+	q.spans = append(q.spans, s)
+	if len(q.spans) >= spanBatchSize {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes and returns the queued spans
+func (q *spanQueue) take() []*traceSpan {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.spans
+	q.spans = nil
+	return s
+}
+
+// traceExporter sends the queued spans to the OTLP collector every few seconds, or sooner if a batch is full
+func traceExporter() {
+	for {
+		select {
+		case <-spans.full:
+		case <-time.After(5 * time.Second):
+		}
+		queued := spans.take()
+		if len(queued) == 0 {
+			continue
+		}
+		var ss otlpScopeSpans
+		ss.Scope.Name = "github.com/crooks/openotp_exporter"
+		ss.Scope.Version = version
+		for _, s := range queued {
+			ss.Spans = append(ss.Spans, s.otlp())
+		}
+		var rs otlpResourceSpans
+		rs.Resource.Attributes = otlpResource()
+		rs.ScopeSpans = []otlpScopeSpans{ss}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg().OTLP.Timeout)
+		err := otlpPost(ctx, "/v1/traces", otlpTraceRequest{ResourceSpans: []otlpResourceSpans{rs}})
+		cancel()
+		if err != nil {
+			otlpLog.Warn("Unable to export spans", "spans", len(queued), "err", err)
+		}
+	}
+}
+
+// tracingTransport adds the traceparent header of the current span to outgoing requests, so that probes can be
+// correlated with traces on the WebADM side.  The header is only sent while traces are exported, as otherwise it
+// refers to spans that were never recorded.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if s, ok := req.Context().Value(spanKey{}).(*traceSpan); ok && cfg().OTLP.Exports("traces") {
+		req = req.Clone(req.Context())
+		req.Header.Set("traceparent", s.traceparent())
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
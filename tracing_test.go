@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+func TestTracingTransport(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: tracingTransport{http.DefaultTransport}}
+
+	tests := []struct {
+		signals []string
+		traced  bool
+	}{
+		{nil, false},
+		{[]string{"metrics"}, false},
+		{[]string{"metrics", "traces"}, true},
+	}
+	for _, test := range tests {
+		c := new(config.Config)
+		c.OTLP.Endpoint = "http://collector.example.com:4318"
+		c.OTLP.Signals = test.signals
+		currentConfig.Store(c)
+		ctx, span := startSpan(context.Background(), "test", spanKindClient)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		header = ""
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		switch {
+		case test.traced && header != span.traceparent():
+			t.Errorf("Unexpected traceparent with signals %v.  Expected=%s, Got=%s", test.signals, span.traceparent(),
+				header)
+		case !test.traced && header != "":
+			t.Errorf("Unexpected traceparent with signals %v: %s", test.signals, header)
+		}
+		if req.Header.Get("traceparent") != "" {
+			t.Error("Original request was modified")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dialFunc is the signature of http.Transport.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// defaultDial is the dialer used by http.DefaultTransport
+var defaultDial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+
+// countingDial wraps dial so that the connections it opens, and the bytes sent and received over them, are recorded
+// in the exporter's metrics.
+func countingDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || exporter == nil {
+			return conn, err
+		}
+		exporter.rpcConnections.Inc()
+		return &countingConn{Conn: conn}, nil
+	}
+}
+
+// countingConn records the bytes transferred over a connection and decrements the open connection count when it's
+// closed.
+type countingConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	exporter.rpcBytes.WithLabelValues("read").Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	exporter.rpcBytes.WithLabelValues("written").Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(exporter.rpcConnections.Dec)
+	return c.Conn.Close()
+}
+
+// metricsTransport records the status code of each API request and the TLS handshakes performed for them
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if exporter == nil {
+		return t.next.RoundTrip(req)
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				exporter.tlsHandshakes.WithLabelValues(strconv.FormatBool(state.DidResume)).Inc()
+			}
+		},
+	})
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	exporter.rpcRequests.WithLabelValues(code).Inc()
+	return resp, err
+}
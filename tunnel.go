@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sshDialer returns a dial function that connects through the SSH jump host.  Each connection runs ssh -W, which
+// forwards its stdin and stdout to the target, as an OpenSSH ProxyCommand would.
+func sshDialer(jumpHost string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		rpcLog.Debug("Connecting through SSH tunnel", "jump_host", jumpHost, "address", addr)
+		return dialSSH(ctx, jumpHost, addr)
+	}
+}
+
+// dialSSH starts ssh -W for addr through jumpHost and returns a connection over its stdin and stdout.  BatchMode
+// prevents ssh prompting for a password or host key confirmation, which would otherwise hang the probe.  The ssh
+// process is killed if ctx expires before the connection has been established, as shown by the first data from the
+// target.  After that it lasts until the connection is closed, so that it can be reused by later probes.
+func dialSSH(ctx context.Context, jumpHost, addr string) (net.Conn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	connCtx, cancel := context.WithCancel(context.Background())
+	c := &sshConn{
+		stdin:       stdinW,
+		stdout:      stdoutR,
+		jumpHost:    jumpHost,
+		addr:        addr,
+		cancel:      cancel,
+		established: make(chan struct{}),
+	}
+	c.cmd = exec.CommandContext(connCtx, "ssh", "-W", addr, "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes", jumpHost)
+	c.cmd.Stdin = stdinR
+	c.cmd.Stdout = stdoutW
+	c.cmd.Stderr = &c.stderr
+	err = c.cmd.Start()
+	// The child has its own copies of these
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		cancel()
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, fmt.Errorf("unable to start ssh: %v", err)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-c.established:
+		case <-connCtx.Done():
+		}
+	}()
+	return c, nil
+}
+
+// sshConn is a connection forwarded by an ssh process
+type sshConn struct {
+	cmd      *exec.Cmd
+	stdin    *os.File
+	stdout   *os.File
+	stderr   bytes.Buffer
+	jumpHost string
+	addr     string
+	// cancel kills the ssh process
+	cancel context.CancelFunc
+	// established is closed once data has been received from the target
+	established chan struct{}
+	once        sync.Once
+}
+
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if n > 0 {
+		c.once.Do(func() { close(c.established) })
+	}
+	return n, err
+}
+
+func (c *sshConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+// Close ends the ssh process.  Anything it wrote to stderr is logged as it usually explains a failed connection.
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	c.stdout.Close()
+	c.cancel()
+	c.cmd.Wait()
+	if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+		rpcLog.Debug("SSH tunnel closed", "jump_host", c.jumpHost, "address", c.addr, "stderr", msg)
+	}
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return sshAddr(c.jumpHost) }
+func (c *sshConn) RemoteAddr() net.Addr { return sshAddr(c.addr) }
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	if err := c.stdout.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return c.stdout.SetReadDeadline(t) }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return c.stdin.SetWriteDeadline(t) }
+
+// sshAddr is the address of either end of an SSH tunnel
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDialSSH(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script in place of ssh")
+	}
+	// The fake ssh echoes its input back, as a target would respond to a request
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// Expiry of the dial context after the connection is established doesn't affect it
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := dialSSH(ctx, "jump.example.com", "otp.example.com:443")
+	if err != nil {
+		t.Fatalf("dialSSH returned: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	for _, msg := range []string{"first", "again"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write returned: %v", err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Fatalf("Unexpected response.  Expected=%s, Got=%s, err=%v", msg, buf, err)
+		}
+		cancel()
+		// Allow the cancellation to take effect
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Expiry before the connection is established kills ssh
+	ctx, cancel = context.WithCancel(context.Background())
+	conn, err = dialSSH(ctx, "jump.example.com", "otp.example.com:443")
+	if err != nil {
+		t.Fatalf("dialSSH returned: %v", err)
+	}
+	defer conn.Close()
+	cancel()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("Unexpected read result after the dial context expired.  Expected=EOF, Got=%v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/crooks/openotp_exporter/config"
+)
+
+// apiCreds are credentials for the OpenOTP API
+type apiCreds struct {
+	username string
+	password string
+}
+
+// vaultCreds holds the most recent credentials retrieved from Vault
+var vaultCreds atomic.Pointer[apiCreds]
+
+// apiCredentials returns the username and password used to authenticate to the OpenOTP API at target.  A credentials
+// profile, selected by the probe or configured for the target, takes precedence.  Otherwise credentials retrieved
+// from Vault take precedence over a password from the keyring, which takes precedence over the config file.
+func apiCredentials(target, profile string) (string, string) {
+	if profile == "" {
+		profile = staticTarget(target).Credentials
+	}
+	if c, ok := cfg().Credentials[profile]; ok {
+		return c.Username, c.Password
+	}
+	if c := vaultCreds.Load(); c != nil && cfg().Secrets.Vault.Enabled() {
+		return c.username, c.password
+	}
+	if cfg().Secrets.Keyring.Enabled && cfg().API.Username != "" {
+		// A failed lookup has already been logged
+		if password, err := keyringPassword(target); err == nil {
+			return cfg().API.Username, password
+		}
+	}
+	return cfg().API.Username, cfg().API.Password
+}
+
+// vaultResponse contains the fields of interest from Vault's API responses
+type vaultResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+// vaultClient is a minimal client for the Vault HTTP API
+type vaultClient struct {
+	cfg    config.Vault
+	client *http.Client
+	token  string
+}
+
+func newVaultClient(v config.Vault) (*vaultClient, error) {
+	tlsConfig := new(tls.Config)
+	if v.CAFile != "" {
+		pemCerts, err := os.ReadFile(v.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Vault CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in Vault CA file %s", v.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &vaultClient{
+		cfg: v,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   30 * time.Second,
+		},
+		token: v.Token,
+	}, nil
+}
+
+// request performs a Vault API request and decodes the response
+func (v *vaultClient) request(ctx context.Context, method, path string, body interface{}) (*vaultResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	url := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(v.cfg.Address, "/"), strings.TrimPrefix(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	vr := new(vaultResponse)
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil {
+		return nil, fmt.Errorf("unable to decode Vault response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(vr.Errors, ", "))
+	}
+	return vr, nil
+}
+
+// login obtains a client token using the configured auth method.  Token auth doesn't require a login.
+func (v *vaultClient) login(ctx context.Context) error {
+	var body map[string]string
+	switch v.cfg.AuthMethod {
+	case "token":
+		return nil
+	case "approle":
+		body = map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID}
+	case "kubernetes":
+		jwt, err := os.ReadFile(v.cfg.JWTFile)
+		if err != nil {
+			return fmt.Errorf("unable to read service account token: %v", err)
+		}
+		body = map[string]string{"role": v.cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+	v.token = ""
+	vr, err := v.request(ctx, http.MethodPost, fmt.Sprintf("auth/%s/login", v.cfg.AuthMount), body)
+	if err != nil {
+		return fmt.Errorf("vault login failed: %v", err)
+	}
+	v.token = vr.Auth.ClientToken
+	return nil
+}
+
+// credentials reads the API username and password from the configured secret.  Both KV v1 and v2 engines are
+// supported.
+func (v *vaultClient) credentials(ctx context.Context) (*apiCreds, error) {
+	if err := v.login(ctx); err != nil {
+		return nil, err
+	}
+	vr, err := v.request(ctx, http.MethodGet, v.cfg.SecretPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s: %v", v.cfg.SecretPath, err)
+	}
+	data := vr.Data
+	// KV v2 nests the secret within a second data field.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	username, _ := data[v.cfg.UsernameKey].(string)
+	password, _ := data[v.cfg.PasswordKey].(string)
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("secret %s does not contain %s and %s", v.cfg.SecretPath, v.cfg.UsernameKey, v.cfg.PasswordKey)
+	}
+	return &apiCreds{username: username, password: password}, nil
+}
+
+// refreshVaultCredentials retrieves the API credentials from Vault and stores them for use by subsequent probes.
+func refreshVaultCredentials(v config.Vault) error {
+	client, err := newVaultClient(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	creds, err := client.credentials(ctx)
+	if err != nil {
+		return err
+	}
+	vaultCreds.Store(creds)
+	return nil
+}
+
+// vaultRefresher periodically refreshes the API credentials from Vault.  Failures are logged and the previous
+// credentials remain in use.
+func vaultRefresher() {
+	for {
+		v := cfg().Secrets.Vault
+		if !v.Enabled() {
+			// Vault has been disabled by a config reload.  Check again later in case it's re-enabled.
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(v.RefreshInterval)
+		if err := refreshVaultCredentials(v); err != nil {
+			vaultLog.Warn("Unable to refresh credentials from Vault", "err", err)
+			continue
+		}
+		vaultLog.Debug("Refreshed API credentials from Vault")
+	}
+}
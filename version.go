@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build information, populated at build time with:
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.revision=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	revision  = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString returns a description of the exporter's build
+func versionString() string {
+	return fmt.Sprintf(
+		"openotp_exporter version %s (revision: %s, built: %s, %s)",
+		version, revision, buildDate, runtime.Version(),
+	)
+}